@@ -0,0 +1,293 @@
+package coalago
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ResourcePolicy restricts which peers may call a resource. Keys are peer
+// Curve25519 public keys or Ed25519 identities of 32 bytes in hex, standard
+// base64 or unpadded URL-safe base64. Groups refer
+// to the groups of the server's AccessPolicy. Without keys and groups any peer
+// is allowed.
+type ResourcePolicy struct {
+	RequireCOAPS bool     `json:"require_coaps" yaml:"require_coaps"`
+	Keys         []string `json:"keys" yaml:"keys"`
+	Groups       []string `json:"groups" yaml:"groups"`
+}
+
+// AccessPolicy holds the key groups and the policies of resources by path
+// and method name (GET, POST, PUT, DELETE or * for any). A policy set on
+// CoAPResource takes precedence over the one of AccessPolicy.
+// With DenyByDefault resources without any policy are not reachable.
+type AccessPolicy struct {
+	DenyByDefault bool                                 `json:"deny_by_default" yaml:"deny_by_default"`
+	Groups        map[string][]string                  `json:"groups" yaml:"groups"`
+	Resources     map[string]map[string]ResourcePolicy `json:"resources" yaml:"resources"`
+}
+
+var (
+	ErrInvalidPeerKey   = errors.New("invalid peer key: expected 32 bytes in hex or base64")
+	ErrUnknownKeyGroup  = errors.New("unknown key group")
+	ErrNoPolicyFilePath = errors.New("access policy was not loaded from a file")
+	ErrAccessDenied     = errors.New("access denied")
+)
+
+type accessControl struct {
+	mx        sync.RWMutex
+	policy    AccessPolicy
+	groups    map[string]map[string]bool
+	resources map[string]*resourceRule
+	// Policies set on the resources added to the server
+	own  map[string]*resourceRule
+	path string
+}
+
+// resourceRule is a ResourcePolicy with its keys decoded.
+type resourceRule struct {
+	requireCOAPS bool
+	keys         map[string]bool
+	groups       []string
+}
+
+func newAccessControl() *accessControl {
+	return &accessControl{own: make(map[string]*resourceRule)}
+}
+
+// Size of the peer keys in policies and allowlists
+const PEER_KEY_SIZE = 32
+
+// decodePeerKey tells the encoding of a key by its length, which differs
+// for the three encodings of 32 bytes.
+func decodePeerKey(key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	var b []byte
+	var err error
+	switch len(key) {
+	case hex.EncodedLen(PEER_KEY_SIZE):
+		b, err = hex.DecodeString(key)
+	case base64.StdEncoding.EncodedLen(PEER_KEY_SIZE):
+		b, err = base64.StdEncoding.DecodeString(key)
+	case base64.RawURLEncoding.EncodedLen(PEER_KEY_SIZE):
+		b, err = base64.RawURLEncoding.DecodeString(key)
+	default:
+		return nil, ErrInvalidPeerKey
+	}
+	if err != nil || len(b) != PEER_KEY_SIZE {
+		return nil, ErrInvalidPeerKey
+	}
+	return b, nil
+}
+
+func decodePeerKeys(keys []string) (map[string]bool, error) {
+	res := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		b, err := decodePeerKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %q", err, k)
+		}
+		res[string(b)] = true
+	}
+	return res, nil
+}
+
+func policyResourceKey(path, method string) string {
+	return strings.Trim(path, "/ ") + " " + strings.ToUpper(method)
+}
+
+// set replaces the policy, unless it is invalid or lacks a group that the
+// policy of an added resource refers to.
+func (ac *accessControl) set(policy AccessPolicy) error {
+	groups := make(map[string]map[string]bool, len(policy.Groups))
+	for name, keys := range policy.Groups {
+		decoded, err := decodePeerKeys(keys)
+		if err != nil {
+			return err
+		}
+		groups[name] = decoded
+	}
+
+	resources := make(map[string]*resourceRule)
+	for path, methods := range policy.Resources {
+		for method, p := range methods {
+			rule, err := newResourceRule(p, groups)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", method, path, err)
+			}
+			resources[policyResourceKey(path, method)] = rule
+		}
+	}
+
+	ac.mx.Lock()
+	defer ac.mx.Unlock()
+	for key, rule := range ac.own {
+		if err := checkGroups(rule.groups, groups); err != nil {
+			return fmt.Errorf("resource %s: %w", key, err)
+		}
+	}
+	ac.policy = policy
+	ac.groups = groups
+	ac.resources = resources
+	return nil
+}
+
+func newResourceRule(p ResourcePolicy, groups map[string]map[string]bool) (*resourceRule, error) {
+	keys, err := decodePeerKeys(p.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkGroups(p.Groups, groups); err != nil {
+		return nil, err
+	}
+	return &resourceRule{requireCOAPS: p.RequireCOAPS, keys: keys, groups: p.Groups}, nil
+}
+
+func checkGroups(names []string, groups map[string]map[string]bool) error {
+	for _, g := range names {
+		if _, ok := groups[g]; !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownKeyGroup, g)
+		}
+	}
+	return nil
+}
+
+// add validates the policy of a resource the server adds, its groups must
+// be ones of the current AccessPolicy.
+func (ac *accessControl) add(resource *CoAPResource) error {
+	key := policyResourceKey(resource.Path, coapMethodName(resource.Method))
+
+	ac.mx.Lock()
+	defer ac.mx.Unlock()
+	if resource.Policy == nil {
+		delete(ac.own, key)
+		return nil
+	}
+	rule, err := newResourceRule(*resource.Policy, ac.groups)
+	if err != nil {
+		return err
+	}
+	ac.own[key] = rule
+	return nil
+}
+
+func (ac *accessControl) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var policy AccessPolicy
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &policy)
+	default:
+		err = json.Unmarshal(data, &policy)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = ac.set(policy); err != nil {
+		return err
+	}
+
+	ac.mx.Lock()
+	ac.path = path
+	ac.mx.Unlock()
+	return nil
+}
+
+func (ac *accessControl) reload() error {
+	ac.mx.RLock()
+	path := ac.path
+	ac.mx.RUnlock()
+
+	if path == "" {
+		return ErrNoPolicyFilePath
+	}
+	return ac.load(path)
+}
+
+func coapMethodName(method CoapMethod) string {
+	switch method {
+	case CoapMethodGet:
+		return "GET"
+	case CoapMethodPost:
+		return "POST"
+	case CoapMethodPut:
+		return "PUT"
+	case CoapMethodDelete:
+		return "DELETE"
+	default:
+		return ""
+	}
+}
+
+// check returns CoapCodeEmpty when the message may reach the resource,
+// CoapCodeUnauthorized when the peer is not authenticated and
+// CoapCodeForbidden when the authenticated peer is not allowed.
+func (ac *accessControl) check(resource *CoAPResource, message *CoAPMessage) CoapCode {
+	if ac == nil {
+		return CoapCodeEmpty
+	}
+
+	ac.mx.RLock()
+	defer ac.mx.RUnlock()
+
+	key := policyResourceKey(resource.Path, coapMethodName(resource.Method))
+	policy := ac.own[key]
+	if policy == nil {
+		if p, ok := ac.resources[key]; ok {
+			policy = p
+		} else if p, ok := ac.resources[policyResourceKey(resource.Path, "*")]; ok {
+			policy = p
+		}
+	}
+
+	if policy == nil {
+		if !ac.policy.DenyByDefault {
+			return CoapCodeEmpty
+		}
+		if message.GetScheme() != COAPS_SCHEME {
+			return CoapCodeUnauthorized
+		}
+		return CoapCodeForbidden
+	}
+
+	isCOAPS := message.GetScheme() == COAPS_SCHEME
+	if policy.requireCOAPS && !isCOAPS {
+		return CoapCodeUnauthorized
+	}
+	if len(policy.keys) == 0 && len(policy.groups) == 0 {
+		return CoapCodeEmpty
+	}
+	if !isCOAPS {
+		return CoapCodeUnauthorized
+	}
+
+	peerKeys := []string{string(message.PeerPublicKey)}
+	if len(message.PeerIdentity) > 0 {
+		peerKeys = append(peerKeys, string(message.PeerIdentity))
+	}
+
+	for _, k := range peerKeys {
+		if policy.keys[k] {
+			return CoapCodeEmpty
+		}
+		for _, g := range policy.groups {
+			if ac.groups[g][k] {
+				return CoapCodeEmpty
+			}
+		}
+	}
+	return CoapCodeForbidden
+}
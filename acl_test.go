@@ -0,0 +1,222 @@
+package coalago
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+func TestAccessPolicyCheck(t *testing.T) {
+	allowed := bytes.Repeat([]byte{1}, PEER_KEY_SIZE)
+	ac := newAccessControl()
+	err := ac.set(AccessPolicy{
+		DenyByDefault: true,
+		Groups:        map[string][]string{"admins": {hex.EncodeToString(allowed)}},
+		Resources: map[string]map[string]ResourcePolicy{
+			"/admin":  {"GET": {RequireCOAPS: true, Groups: []string{"admins"}}},
+			"/public": {"*": {}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(path string, method CoapMethod, peerKey []byte) CoapCode {
+		message := NewCoAPMessage(CON, GET)
+		if peerKey != nil {
+			message.SetSchemeCOAPS()
+			message.PeerPublicKey = peerKey
+		}
+		return ac.check(NewCoAPResource(method, path, nil), message)
+	}
+
+	cases := []struct {
+		path     string
+		method   CoapMethod
+		peerKey  []byte
+		expected CoapCode
+	}{
+		{"/admin", CoapMethodGet, allowed, CoapCodeEmpty},
+		{"/admin", CoapMethodGet, bytes.Repeat([]byte{2}, PEER_KEY_SIZE), CoapCodeForbidden},
+		{"/admin", CoapMethodGet, nil, CoapCodeUnauthorized},
+		{"/admin", CoapMethodPost, allowed, CoapCodeForbidden},
+		{"/public", CoapMethodPut, nil, CoapCodeEmpty},
+		{"/other", CoapMethodGet, nil, CoapCodeUnauthorized},
+	}
+	for _, c := range cases {
+		if code := request(c.path, c.method, c.peerKey); code != c.expected {
+			t.Errorf("%v %s: expected %v, got %v", c.method, c.path, c.expected, code)
+		}
+	}
+
+	if err = ac.set(AccessPolicy{Resources: map[string]map[string]ResourcePolicy{
+		"/admin": {"GET": {Groups: []string{"unknown"}}},
+	}}); err == nil {
+		t.Fatal("expected unknown group to be rejected")
+	}
+	if code := request("/admin", CoapMethodGet, allowed); code != CoapCodeEmpty {
+		t.Fatal("rejected policy has replaced the current one")
+	}
+}
+
+func TestResourcePolicyValidation(t *testing.T) {
+	srv := NewServer()
+	err := srv.SetAccessPolicy(AccessPolicy{Groups: map[string][]string{"admins": {strings.Repeat("00", PEER_KEY_SIZE)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource := func(path string, policy ResourcePolicy) *CoAPResource {
+		res := NewCoAPResource(CoapMethodGet, path, func(message *CoAPMessage) *CoAPResourceHandlerResult {
+			return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+		})
+		res.Policy = &policy
+		return res
+	}
+
+	if err = srv.AddResource(resource("/unknown", ResourcePolicy{Groups: []string{"users"}})); !errors.Is(err, ErrUnknownKeyGroup) {
+		t.Fatalf("expected %v, got %v", ErrUnknownKeyGroup, err)
+	}
+	if err = srv.AddResource(resource("/bad", ResourcePolicy{Keys: []string{"not a key!"}})); err == nil {
+		t.Fatal("expected invalid key to be rejected")
+	}
+	if err = srv.AddResource(resource("/admin", ResourcePolicy{Groups: []string{"admins"}})); err != nil {
+		t.Fatal(err)
+	}
+
+	message := NewCoAPMessage(CON, GET)
+	message.SetSchemeCOAPS()
+	message.PeerPublicKey = make([]byte, PEER_KEY_SIZE)
+	if code := srv.access.check(resource("/admin", ResourcePolicy{}), message); code != CoapCodeEmpty {
+		t.Fatalf("expected group member to be allowed, got %v", code)
+	}
+
+	if err = srv.SetAccessPolicy(AccessPolicy{}); !errors.Is(err, ErrUnknownKeyGroup) {
+		t.Fatalf("expected policy without the group of a resource to be rejected, got %v", err)
+	}
+}
+
+func TestAccessPolicyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coala-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	identity, err := session.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "policy.yaml")
+	writePolicy := func(key string) {
+		policy := "resources:\n  /secure:\n    GET:\n      require_coaps: true\n      keys: [\"" + key + "\"]\n"
+		if err := ioutil.WriteFile(path, []byte(policy), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePolicy(hex.EncodeToString(identity.PublicKey()))
+
+	srv := NewServer()
+	if err = srv.LoadAccessPolicy(path); err != nil {
+		t.Fatal(err)
+	}
+	srv.AddGETResource("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("secret"), CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12319")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+	client.SetIdentity(identity)
+
+	resp, err := client.GET("coaps://127.0.0.1:12319/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeContent || string(resp.Body) != "secret" {
+		t.Fatalf("unexpected response %v %q", resp.Code, resp.Body)
+	}
+
+	resp, err = client.GET("coap://127.0.0.1:12319/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeUnauthorized {
+		t.Fatalf("expected %v, got %v", CoapCodeUnauthorized, resp.Code)
+	}
+
+	writePolicy(hex.EncodeToString(bytes.Repeat([]byte{2}, PEER_KEY_SIZE)))
+	if err = srv.ReloadAccessPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.GET("coaps://127.0.0.1:12319/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeForbidden {
+		t.Fatalf("expected %v, got %v", CoapCodeForbidden, resp.Code)
+	}
+}
+
+func TestDecodePeerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xfb}, PEER_KEY_SIZE)
+	for _, encoded := range []string{
+		hex.EncodeToString(key),
+		base64.StdEncoding.EncodeToString(key),
+		base64.RawURLEncoding.EncodeToString(key),
+	} {
+		if b, err := decodePeerKey(encoded); err != nil || !bytes.Equal(b, key) {
+			t.Errorf("%s: unexpected key %x, %v", encoded, b, err)
+		}
+	}
+	for _, encoded := range []string{"00", hex.EncodeToString(key[1:]), base64.URLEncoding.EncodeToString(key[1:]) + "A"} {
+		if _, err := decodePeerKey(encoded); err == nil {
+			t.Errorf("%s: expected invalid key", encoded)
+		}
+	}
+}
+
+func TestCoapsRequestWithoutEncryptedURI(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tr := newtransport(&connection{conn: conn})
+	tr.sessions = NewMemorySessionStorage()
+
+	victim := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	ses, err := session.NewSecuredSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ses.PeerPublicKey = bytes.Repeat([]byte{1}, PEER_KEY_SIZE)
+	tr.sessions.Set(conn.LocalAddr().String(), victim.String(), "", ses)
+
+	// A spoofed request without payload that nothing would fail to decrypt
+	message := NewCoAPMessage(CON, DELETE)
+	message.SetSchemeCOAPS()
+	message.SetURIPath("/admin")
+	message.Sender = victim
+	if ok, err := localStateSecurityInputLayer(tr, message, ""); ok || !errors.Is(err, ErrorCoapsURIMissing) {
+		t.Fatalf("expected %v, got %v", ErrorCoapsURIMissing, err)
+	}
+	if message.PeerPublicKey != nil {
+		t.Fatal("request got the key of the peer")
+	}
+}
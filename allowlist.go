@@ -0,0 +1,222 @@
+package coalago
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Prefix of the Ed25519 identities in allowlist files
+const ALLOWLIST_IDENTITY_PREFIX = "ed25519:"
+
+var ErrInvalidAllowlistKey = errors.New("allowlist keys must be 32 byte Curve25519 or Ed25519 public keys")
+
+// Allowlist is a set of pinned peer public keys: Curve25519 keys of peers
+// without an identity, matched by BreakConnectionOnPK, and Ed25519 identities,
+// matched by PinIdentity. The Curve25519 key of a peer with an identity is
+// ephemeral, so it is pinned by its identity.
+//
+// In a file every line holds one key in hex or base64, identities prefixed
+// with "ed25519:", optionally followed by a comment after '#'. Empty lines
+// and lines starting with '#' are ignored.
+type Allowlist struct {
+	mx      sync.RWMutex
+	entries []allowlistEntry
+}
+
+type allowlistEntry struct {
+	key      []byte
+	identity bool
+	comment  string
+}
+
+func NewAllowlist() *Allowlist {
+	return &Allowlist{}
+}
+
+func LoadAllowlist(path string) (*Allowlist, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAllowlist(data)
+}
+
+func ParseAllowlist(data []byte) (*Allowlist, error) {
+	a := NewAllowlist()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var comment string
+		if i := strings.Index(line, "#"); i >= 0 {
+			comment = strings.TrimSpace(line[i+1:])
+			line = line[:i]
+		}
+
+		identity := strings.HasPrefix(line, ALLOWLIST_IDENTITY_PREFIX)
+		key, err := decodePeerKey(strings.TrimPrefix(line, ALLOWLIST_IDENTITY_PREFIX))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		a.add(key, identity, comment)
+	}
+	return a, scanner.Err()
+}
+
+// Add adds the Curve25519 public key and returns false if it is already in
+// the list or is not a Curve25519 public key.
+func (a *Allowlist) Add(key []byte, comment string) bool {
+	return len(key) == ed25519.PublicKeySize && a.add(key, false, comment)
+}
+
+// AddIdentity adds the Ed25519 identity and returns false if it is already
+// in the list or is not an Ed25519 public key.
+func (a *Allowlist) AddIdentity(identity ed25519.PublicKey, comment string) bool {
+	return len(identity) == ed25519.PublicKeySize && a.add(identity, true, comment)
+}
+
+func (a *Allowlist) add(key []byte, identity bool, comment string) bool {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	if a.index(key, identity) >= 0 {
+		return false
+	}
+	a.entries = append(a.entries, allowlistEntry{key: append([]byte{}, key...), identity: identity, comment: comment})
+	return true
+}
+
+// Remove removes the Curve25519 public key and returns false if it is not in the list.
+func (a *Allowlist) Remove(key []byte) bool {
+	return a.remove(key, false)
+}
+
+// RemoveIdentity removes the Ed25519 identity and returns false if it is not in the list.
+func (a *Allowlist) RemoveIdentity(identity ed25519.PublicKey) bool {
+	return a.remove(identity, true)
+}
+
+func (a *Allowlist) remove(key []byte, identity bool) bool {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	i := a.index(key, identity)
+	if i < 0 {
+		return false
+	}
+	a.entries = append(a.entries[:i], a.entries[i+1:]...)
+	return true
+}
+
+func (a *Allowlist) Contains(key []byte) bool {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.index(key, false) >= 0
+}
+
+func (a *Allowlist) ContainsIdentity(identity ed25519.PublicKey) bool {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.index(identity, true) >= 0
+}
+
+func (a *Allowlist) index(key []byte, identity bool) int {
+	for i, e := range a.entries {
+		if e.identity == identity && bytes.Equal(e.key, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Keys returns the Curve25519 public keys in the order they were added.
+func (a *Allowlist) Keys() [][]byte {
+	return a.keys(false)
+}
+
+// Identities returns the Ed25519 identities in the order they were added.
+func (a *Allowlist) Identities() []ed25519.PublicKey {
+	keys := a.keys(true)
+	identities := make([]ed25519.PublicKey, len(keys))
+	for i, k := range keys {
+		identities[i] = k
+	}
+	return identities
+}
+
+func (a *Allowlist) keys(identity bool) [][]byte {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+
+	var keys [][]byte
+	for _, e := range a.entries {
+		if e.identity == identity {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// Comment returns the comment of the key or identity.
+func (a *Allowlist) Comment(key []byte) string {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+
+	for _, e := range a.entries {
+		if bytes.Equal(e.key, key) {
+			return e.comment
+		}
+	}
+	return ""
+}
+
+// Marshal encodes the list in the file format with keys in hex.
+func (a *Allowlist) Marshal() []byte {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+
+	var buf bytes.Buffer
+	for _, e := range a.entries {
+		if e.identity {
+			buf.WriteString(ALLOWLIST_IDENTITY_PREFIX)
+		}
+		buf.WriteString(hex.EncodeToString(e.key))
+		if e.comment != "" {
+			buf.WriteString(" # " + e.comment)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// Save writes the list to path, replacing the file atomically.
+func (a *Allowlist) Save(path string) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, a.Marshal(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// BreakConnectionOnPK can be set as CoAPMessage.BreakConnectionOnPK
+// to abort handshakes with peers whose Curve25519 key is not in the list.
+func (a *Allowlist) BreakConnectionOnPK(actualPK []byte) bool {
+	return !a.Contains(actualPK)
+}
+
+// PinIdentity can be set as PeerIdentityPolicy.Pin to reject peers whose
+// identity is not in the list.
+func (a *Allowlist) PinIdentity(identity ed25519.PublicKey) bool {
+	return a.ContainsIdentity(identity)
+}
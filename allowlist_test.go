@@ -0,0 +1,90 @@
+package coalago
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	first := bytes.Repeat([]byte{1}, 32)
+	second := bytes.Repeat([]byte{2}, 32)
+
+	list, err := ParseAllowlist([]byte("# pinned peers\n\n" +
+		"0101010101010101010101010101010101010101010101010101010101010101 # gateway\n" +
+		base64.StdEncoding.EncodeToString(second) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.Contains(first) || !list.Contains(second) || list.Comment(first) != "gateway" {
+		t.Fatal("keys are not parsed")
+	}
+	if list.BreakConnectionOnPK(first) || !list.BreakConnectionOnPK([]byte("other")) {
+		t.Fatal("unexpected pinning result")
+	}
+
+	if list.Add(first, "") || !list.Remove(second) || list.Remove(second) {
+		t.Fatal("unexpected add or remove result")
+	}
+
+	dir, err := ioutil.TempDir("", "coala-allowlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "allowlist")
+	if err = list.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAllowlist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Keys()) != 1 || !loaded.Contains(first) || loaded.Comment(first) != "gateway" {
+		t.Fatalf("unexpected allowlist %q", loaded.Marshal())
+	}
+
+	if _, err = ParseAllowlist([]byte("not a key\n")); err == nil {
+		t.Fatal("expected invalid key to be rejected")
+	}
+	if _, err = ParseAllowlist([]byte("0102\n")); err == nil {
+		t.Fatal("expected key that is not 32 bytes to be rejected")
+	}
+	if list.Add([]byte("short"), "") {
+		t.Fatal("expected key that is not 32 bytes to be rejected")
+	}
+}
+
+func TestAllowlistIdentities(t *testing.T) {
+	identity := bytes.Repeat([]byte{3}, 32)
+
+	list, err := ParseAllowlist([]byte(ALLOWLIST_IDENTITY_PREFIX + base64.StdEncoding.EncodeToString(identity) + " # sensor\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.PinIdentity(identity) || list.PinIdentity(bytes.Repeat([]byte{4}, 32)) {
+		t.Fatal("unexpected identity pinning result")
+	}
+	// An identity is not a handshake key, it never matches one
+	if !list.BreakConnectionOnPK(identity) || list.Contains(identity) {
+		t.Fatal("identity matched as Curve25519 key")
+	}
+	if !list.Add(identity, "curve") || len(list.Keys()) != 1 || len(list.Identities()) != 1 {
+		t.Fatal("keys and identities are not kept apart")
+	}
+
+	loaded, err := ParseAllowlist(list.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.ContainsIdentity(identity) || !loaded.Contains(identity) || loaded.Comment(identity) != "sensor" {
+		t.Fatalf("unexpected allowlist %q", loaded.Marshal())
+	}
+	if !loaded.RemoveIdentity(identity) || loaded.ContainsIdentity(identity) || !loaded.Contains(identity) {
+		t.Fatal("unexpected remove result")
+	}
+}
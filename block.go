@@ -1,9 +1,20 @@
 package coalago
 
 import (
+	"errors"
 	"math"
 )
 
+const (
+	MIN_BLOCK_SIZE = 16
+	// BERT blocks of RFC 8323 carry any multiple of 1024 bytes, their
+	// numbers count 1024 byte units
+	BERT_SZX        = 7
+	BERT_BLOCK_SIZE = 1024
+)
+
+var ErrInvalidBlockSize = errors.New("invalid block size")
+
 func newBlock(moreBlocks bool, num, size int) *block {
 	block := &block{
 		BlockNumber: num,
@@ -13,6 +24,17 @@ func newBlock(moreBlocks bool, num, size int) *block {
 	return block
 }
 
+// newBlockAt makes the block option of the data starting at offset. Sizes
+// above 1024 bytes make BERT blocks.
+func newBlockAt(moreBlocks bool, offset, size int) *block {
+	if size > BERT_BLOCK_SIZE {
+		block := newBlock(moreBlocks, offset/BERT_BLOCK_SIZE, BERT_BLOCK_SIZE)
+		block.BERT = true
+		return block
+	}
+	return newBlock(moreBlocks, offset/size, size)
+}
+
 func newBlockFromInt(blockValue int) *block {
 	block := &block{}
 
@@ -25,15 +47,20 @@ type block struct {
 	BlockNumber int
 	MoreBlocks  bool
 	BlockSize   int
+	BERT        bool
 }
 
 func (block *block) ToInt() int {
-	if block.BlockSize > 1024 || block.BlockSize <= 0 {
-		return 0
+	var szx int
+	if block.BERT {
+		szx = BERT_SZX
+	} else {
+		if !isBlockSize(block.BlockSize) {
+			return 0
+		}
+		szx = computeSZX(block.BlockSize)
 	}
 
-	szx := computeSZX(block.BlockSize)
-
 	m := 1
 	if !block.MoreBlocks {
 		m = 0
@@ -53,11 +80,51 @@ func (block *block) FromInt(blockValue int) error {
 
 	block.BlockNumber = num
 	block.MoreBlocks = m != 0
-	block.BlockSize = int(math.Pow(2, float64(szx+4)))
+	block.BERT = szx == BERT_SZX
+	if block.BERT {
+		block.BlockSize = BERT_BLOCK_SIZE
+	} else {
+		block.BlockSize = int(math.Pow(2, float64(szx+4)))
+	}
 
 	return nil
 }
 
+// isBlockSize tells if the size can be encoded in SZX: a power of two
+// from 16 to 1024 bytes.
+func isBlockSize(size int) bool {
+	return size >= MIN_BLOCK_SIZE && size <= BERT_BLOCK_SIZE && size&(size-1) == 0
+}
+
+// checkBlockSize accepts SZX block sizes and multiples of 1024 bytes for BERT.
+func checkBlockSize(size int) error {
+	if isBlockSize(size) || (size > BERT_BLOCK_SIZE && size%BERT_BLOCK_SIZE == 0) {
+		return nil
+	}
+	return ErrInvalidBlockSize
+}
+
+// storeBlock puts the payload of the block into buf split in parts of unit
+// bytes, indexed by their number in these units, and returns the last index.
+// It lets BERT blocks and blocks larger than the receiver wants be
+// reassembled the same way as the others.
+func storeBlock(buf map[int][]byte, b *block, payload []byte, unit int) int {
+	index := b.BlockNumber * b.BlockSize / unit
+	if len(payload) <= unit {
+		buf[index] = payload
+		return index
+	}
+	for start := 0; start < len(payload); start += unit {
+		stop := start + unit
+		if stop > len(payload) {
+			stop = len(payload)
+		}
+		buf[index] = payload[start:stop]
+		index++
+	}
+	return index - 1
+}
+
 /*
  * Encodes a block size into a 3-bit SZX value as specified by
  * draft-ietf-core-block-14, Section-2.2:
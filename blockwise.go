@@ -0,0 +1,415 @@
+package coalago
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// BlockwiseMode selects how payloads larger than a block are transferred.
+type BlockwiseMode int
+
+const (
+	// BlockwiseSelectiveRepeat is the Coala scheme: a window of CON blocks
+	// acknowledged one by one, with the server pushing Block2 blocks.
+	BlockwiseSelectiveRepeat BlockwiseMode = iota
+	// BlockwiseRFC7959 is the lock-step transfer of RFC 7959 spoken by
+	// stock CoAP implementations: one block per request, with the client
+	// asking for every Block2 block.
+	BlockwiseRFC7959
+)
+
+var (
+	ErrBlockwiseMismatch = errors.New("blockwise transfer: unexpected block")
+
+	// Bodies of RFC 7959 responses whose next blocks have not been requested yet
+	blockwiseResponses = cache.New(time.Minute, time.Minute)
+)
+
+type blockwiseModes struct {
+	mx      sync.RWMutex
+	byPeer  map[string]BlockwiseMode
+	general BlockwiseMode
+
+	// Block sizes, the ones of peers are also shrunk on their request
+	sizes       map[string]int
+	generalSize int
+}
+
+func newBlockwiseModes() *blockwiseModes {
+	return &blockwiseModes{
+		byPeer:      make(map[string]BlockwiseMode),
+		sizes:       make(map[string]int),
+		generalSize: MAX_PAYLOAD_SIZE,
+	}
+}
+
+func (m *blockwiseModes) setDefault(mode BlockwiseMode) {
+	m.mx.Lock()
+	m.general = mode
+	m.mx.Unlock()
+}
+
+func (m *blockwiseModes) setPeer(addr string, mode BlockwiseMode) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	m.mx.Lock()
+	m.byPeer[udpAddr.String()] = mode
+	m.mx.Unlock()
+	return nil
+}
+
+func (m *blockwiseModes) mode(addr net.Addr) BlockwiseMode {
+	if m == nil {
+		return BlockwiseSelectiveRepeat
+	}
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	if addr != nil {
+		if mode, ok := m.byPeer[addr.String()]; ok {
+			return mode
+		}
+	}
+	return m.general
+}
+
+func (m *blockwiseModes) setDefaultSize(size int) error {
+	if err := checkBlockSize(size); err != nil {
+		return err
+	}
+	m.mx.Lock()
+	m.generalSize = size
+	m.mx.Unlock()
+	return nil
+}
+
+func (m *blockwiseModes) setPeerSize(addr string, size int) error {
+	if err := checkBlockSize(size); err != nil {
+		return err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	m.mx.Lock()
+	m.sizes[udpAddr.String()] = size
+	m.mx.Unlock()
+	return nil
+}
+
+// shrink remembers that the peer at addr takes blocks of size at most.
+func (m *blockwiseModes) shrink(addr net.Addr, size int) {
+	if m == nil || addr == nil || checkBlockSize(size) != nil {
+		return
+	}
+	m.mx.Lock()
+	current, ok := m.sizes[addr.String()]
+	if !ok {
+		current = m.generalSize
+	}
+	if size < current {
+		m.sizes[addr.String()] = size
+	}
+	m.mx.Unlock()
+}
+
+func (m *blockwiseModes) size(addr net.Addr) int {
+	if m == nil {
+		return MAX_PAYLOAD_SIZE
+	}
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	if addr != nil {
+		if size, ok := m.sizes[addr.String()]; ok {
+			return size
+		}
+	}
+	return m.generalSize
+}
+
+// blockSize is the size of blocks exchanged with the peer at addr. BERT
+// blocks are used only over reliable transports, datagrams keep to 1024 bytes.
+func (sr *transport) blockSize(addr net.Addr) int {
+	size := sr.blockwise.size(addr)
+	if size > MAX_PAYLOAD_SIZE && !isReliableNetwork(sr.conn.LocalAddr()) {
+		return MAX_PAYLOAD_SIZE
+	}
+	return size
+}
+
+// windowBlockSize is the block size of selective-repeat transfers, they
+// number every block and never use BERT.
+func (sr *transport) windowBlockSize(addr net.Addr) int {
+	if size := sr.blockSize(addr); size < MAX_PAYLOAD_SIZE {
+		return size
+	}
+	return MAX_PAYLOAD_SIZE
+}
+
+// responseBlockSize is the block size of the response, the Block2 option
+// it copies from the request may ask for smaller blocks.
+func (sr *transport) responseBlockSize(response *CoAPMessage, addr net.Addr) int {
+	size := sr.windowBlockSize(addr)
+	if b := response.GetBlock2(); b != nil && !b.BERT && b.BlockSize < size {
+		return b.BlockSize
+	}
+	return size
+}
+
+func isReliableNetwork(addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	return !strings.HasPrefix(addr.Network(), "udp")
+}
+
+// lockStep tells if requests use RFC 7959 transfers: the peer was configured
+// so, or the transport is reliable and has no use for a window of blocks.
+func (sr *transport) lockStep() bool {
+	return sr.blockwise.mode(sr.conn.RemoteAddr()) == BlockwiseRFC7959 || isReliableNetwork(sr.conn.LocalAddr())
+}
+
+// isRFC7959Request tells if the request comes from a peer using RFC 7959:
+// it was configured so, or it sent block options the way Coala does not.
+func (m *blockwiseModes) isRFC7959Request(message *CoAPMessage) bool {
+	if m.mode(message.Sender) == BlockwiseRFC7959 || isReliableNetwork(message.Sender) {
+		return true
+	}
+	if message.Type != CON || message.GetOption(OptionSelectiveRepeatWindowSize) != nil {
+		return false
+	}
+	return message.GetBlock1() != nil || message.GetBlock2() != nil ||
+		message.GetOption(OptionSize1) != nil || message.GetOption(OptionSize2) != nil
+}
+
+// newLockStepBlock makes a request of the next block from the original
+// request: all its options, a new message ID and the given block option.
+func newLockStepBlock(origMessage *CoAPMessage, optionBlock OptionCode, b *block, frame []byte) *CoAPMessage {
+	msg := origMessage.Clone(false)
+	msg.Options = append([]*CoAPMessageOption{}, origMessage.Options...)
+	msg.MessageID = generateMessageID()
+	msg.Recipient = origMessage.Recipient
+	msg.RemoveOptions(OptionBlock1)
+	msg.RemoveOptions(OptionBlock2)
+	msg.RemoveOptions(OptionSize1)
+	msg.RemoveOptions(OptionSize2)
+	msg.RemoveOptions(OptionSelectiveRepeatWindowSize)
+	msg.AddOption(optionBlock, b.ToInt())
+	msg.Payload = NewBytesPayload(frame)
+	return msg
+}
+
+// sendCONLockStep sends the request with RFC 7959 block-wise transfers.
+func (sr *transport) sendCONLockStep(message *CoAPMessage) (resp *CoAPMessage, err error) {
+	if isBigPayload(message, sr.blockSize(sr.conn.RemoteAddr())) {
+		for retries := 0; ; retries++ {
+			resp, err = sr.sendLockStepBlock1(message)
+			if err != nil || !isDigestMismatch(resp) || retries == MAX_DIGEST_RETRIES {
+				break
+			}
+		}
+	} else {
+		// Early negotiation of the block size, it also tells the server we use RFC 7959
+		resp, err = sr.exchange(newLockStepBlock(message, OptionBlock2, newBlockAt(false, 0, sr.blockSize(sr.conn.RemoteAddr())), nil))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if b := resp.GetBlock2(); b != nil && b.MoreBlocks {
+		return sr.receiveLockStepBlock2(message, resp)
+	}
+	return resp, nil
+}
+
+func (sr *transport) sendLockStepBlock1(message *CoAPMessage) (*CoAPMessage, error) {
+	payload := message.Payload.Bytes()
+	blockSize := sr.blockSize(sr.conn.RemoteAddr())
+
+	for start := 0; ; {
+		stop := start + blockSize
+		if stop > len(payload) {
+			stop = len(payload)
+		}
+
+		req := newLockStepBlock(message, OptionBlock1, newBlockAt(stop < len(payload), start, blockSize), payload[start:stop])
+		if start == 0 {
+			req.AddOption(OptionSize1, len(payload))
+		}
+		if stop == len(payload) {
+			addPayloadDigest(req, sr.digest, payload)
+		}
+
+		resp, err := sr.exchange(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Code != CoapCodeContinue || stop == len(payload) {
+			return resp, nil
+		}
+
+		b := resp.GetBlock1()
+		if b == nil {
+			return nil, ErrBlockwiseMismatch
+		}
+		// The server may ask for smaller blocks, the sent data stays aligned to them
+		if !b.BERT && b.BlockSize < blockSize {
+			blockSize = b.BlockSize
+			sr.blockwise.shrink(sr.conn.RemoteAddr(), blockSize)
+		}
+		start = stop
+	}
+}
+
+func (sr *transport) receiveLockStepBlock2(message *CoAPMessage, resp *CoAPMessage) (*CoAPMessage, error) {
+	body := resp.Payload.Bytes()
+
+	for {
+		b := resp.GetBlock2()
+		if b == nil || !b.MoreBlocks {
+			break
+		}
+
+		next := newBlock(false, len(body)/b.BlockSize, b.BlockSize)
+		next.BERT = b.BERT
+		req := newLockStepBlock(message, OptionBlock2, next, nil)
+
+		var err error
+		if resp, err = sr.exchange(req); err != nil {
+			return nil, err
+		}
+		if b = resp.GetBlock2(); b == nil || b.BlockNumber*b.BlockSize != len(body) {
+			return nil, newError("receive", req, sr.conn.RemoteAddr().String(), 0, ErrBlockwiseMismatch)
+		}
+		body = append(body, resp.Payload.Bytes()...)
+	}
+
+	resp.Payload = NewBytesPayload(body)
+	return resp, nil
+}
+
+// exchange sends a single CON request and waits for its response,
+// also when the response is separate from the ACK.
+func (sr *transport) exchange(message *CoAPMessage) (*CoAPMessage, error) {
+	data, err := preparationSendingMessage(sr, message, sr.conn.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	acked := false
+	for attempts := 1; ; {
+		if !acked {
+			MetricSentMessages.Inc()
+			if _, err = sr.conn.Write(data); err != nil {
+				MetricSentMessageErrors.Inc()
+				return nil, err
+			}
+		}
+
+		resp, err := receiveMessage(sr, message)
+		if errors.Is(err, ErrMaxAttempts) {
+			if attempts == maxSendAttempts {
+				MetricExpiredMessages.Inc()
+				return nil, newError("send", message, sr.conn.RemoteAddr().String(), attempts, err)
+			}
+			attempts++
+			if !acked {
+				MetricRetransmitMessages.Inc()
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Type == ACK && resp.Code == CoapCodeEmpty {
+			acked = true
+			continue
+		}
+		if resp.Type == CON {
+			sr.sendToSocket(ackTo(message, resp, CoapCodeEmpty))
+		}
+		return resp, nil
+	}
+}
+
+// blockwiseResponseKey keys the response of a request by its token as well,
+// requests on the same socket tell their responses apart by it.
+func blockwiseResponseKey(message *CoAPMessage) string {
+	return fmt.Sprint(message.Sender, message.GetTokenString(), message.GetMethod(), message.GetURIPath(), "?", strings.Join(message.GetURIQueryArray(), "&"))
+}
+
+// sendLockStepBlock2 answers an RFC 7959 request with the block of the
+// response it asks for, the first one by default.
+func sendLockStepBlock2(sr *transport, request *CoAPMessage, response *CoAPMessage) error {
+	blockSize := sr.blockSize(request.Sender)
+	start := 0
+	if b := request.GetBlock2(); b != nil {
+		// A BERT request leaves the size to the server
+		if !b.BERT && b.BlockSize < blockSize {
+			blockSize = b.BlockSize
+		}
+		start = b.BlockNumber * b.BlockSize
+	}
+
+	body := response.Payload.Bytes()
+	if start == 0 && len(body) <= blockSize {
+		response.RemoveOptions(OptionBlock2)
+		return sr.sendToSocketByAddress(response, request.Sender)
+	}
+
+	key := blockwiseResponseKey(request)
+	if start >= len(body) {
+		responseMessage := NewCoAPMessageId(ACK, CoapCodeBadOption, request.MessageID)
+		responseMessage.Token = request.Token
+		return sr.sendToSocketByAddress(responseMessage, request.Sender)
+	}
+	stop := start + blockSize
+	if stop > len(body) {
+		stop = len(body)
+	}
+
+	if stop < len(body) {
+		blockwiseResponses.SetDefault(key, response)
+	} else {
+		blockwiseResponses.Delete(key)
+	}
+
+	blockMessage := response.Clone(false)
+	blockMessage.Options = append([]*CoAPMessageOption{}, response.Options...)
+	blockMessage.MessageID = request.MessageID
+	blockMessage.Token = request.Token
+	blockMessage.Payload = NewBytesPayload(body[start:stop])
+	blockMessage.AddOption(OptionBlock2, newBlockAt(stop < len(body), start, blockSize).ToInt())
+	if start == 0 {
+		blockMessage.AddOption(OptionSize2, len(body))
+	}
+	return sr.sendToSocketByAddress(blockMessage, request.Sender)
+}
+
+// cachedLockStepBlock2 serves a request for a later block of a response
+// that was already produced by the handler. A request for the first block
+// gets a new response.
+func cachedLockStepBlock2(sr *transport, request *CoAPMessage) bool {
+	b := request.GetBlock2()
+	if b == nil {
+		return false
+	}
+	if b.BlockNumber == 0 {
+		blockwiseResponses.Delete(blockwiseResponseKey(request))
+		return false
+	}
+	response, ok := blockwiseResponses.Get(blockwiseResponseKey(request))
+	if !ok {
+		return false
+	}
+	sendLockStepBlock2(sr, request, response.(*CoAPMessage))
+	return true
+}
@@ -0,0 +1,263 @@
+package coalago
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlockwiseRFC7959(t *testing.T) {
+	var calls int32
+	body := bytes.Repeat([]byte("0123456789"), 500)
+
+	srv := NewServer()
+	srv.AddPOSTResource("/echo", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		atomic.AddInt32(&calls, 1)
+		return NewResponse(NewBytesPayload(append(message.Payload.Bytes(), '!')), CoapCodeChanged)
+	})
+	srv.AddGETResource("/large", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewBytesPayload(body), CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12322")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+	if err := client.SetPeerBlockwiseMode("127.0.0.1:12322", BlockwiseRFC7959); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.POST(body, "coap://127.0.0.1:12322/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeChanged || !bytes.Equal(resp.Body, append(body, '!')) {
+		t.Fatalf("unexpected response %v of %d bytes", resp.Code, len(resp.Body))
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("handler was called %d times", n)
+	}
+
+	resp, err = client.GET("coaps://127.0.0.1:12322/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Body, body) {
+		t.Fatalf("unexpected body of %d bytes", len(resp.Body))
+	}
+
+	// A stock CoAP client asking for 64 byte blocks
+	conn, err := net.Dial("udp", "127.0.0.1:12322")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := NewCoAPMessage(CON, GET)
+	request.SetURIPath("/large")
+	request.AddOption(OptionBlock2, newBlock(false, 1, 64).ToInt())
+	data, _ := Serialize(request)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, MTU)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := Deserialize(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := response.GetBlock2()
+	if response.Type != ACK || b == nil || b.BlockNumber != 1 || b.BlockSize != 64 || !b.MoreBlocks {
+		t.Fatalf("unexpected block %+v", b)
+	}
+	if !bytes.Equal(response.Payload.Bytes(), body[64:128]) {
+		t.Fatalf("unexpected payload %q", response.Payload.Bytes())
+	}
+}
+
+func TestBlockSZX(t *testing.T) {
+	for size := MIN_BLOCK_SIZE; size <= 1024; size *= 2 {
+		b := newBlockFromInt(newBlock(true, 5, size).ToInt())
+		if b.BlockSize != size || b.BlockNumber != 5 || !b.MoreBlocks || b.BERT {
+			t.Fatalf("unexpected block %+v", b)
+		}
+	}
+
+	bert := newBlockAt(false, 8192, 4096)
+	b := newBlockFromInt(bert.ToInt())
+	if !b.BERT || b.BlockNumber != 8 || b.BlockSize != BERT_BLOCK_SIZE {
+		t.Fatalf("unexpected BERT block %+v", b)
+	}
+
+	for _, size := range []int{8, 100, 1536} {
+		if checkBlockSize(size) == nil {
+			t.Fatalf("block size %d is accepted", size)
+		}
+	}
+	if checkBlockSize(3072) != nil {
+		t.Fatal("BERT block size is not accepted")
+	}
+
+	buf := make(map[int][]byte)
+	if last := storeBlock(buf, b, bytes.Repeat([]byte{1}, 2500), BERT_BLOCK_SIZE); last != 10 {
+		t.Fatalf("unexpected last part %d", last)
+	}
+	if len(buf[8]) != 1024 || len(buf[10]) != 452 {
+		t.Fatal("BERT block is not split in 1024 byte parts")
+	}
+}
+
+func TestBlockSizeNegotiation(t *testing.T) {
+	var sizes sync.Map
+	body := bytes.Repeat([]byte("0123456789"), 300)
+
+	srv := NewServer()
+	if err := srv.SetBlockSize(256); err != nil {
+		t.Fatal(err)
+	}
+	srv.AddPOSTResource("/echo", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		if b := message.GetBlock1(); b != nil {
+			sizes.Store(b.BlockSize, true)
+		}
+		return NewResponse(message.Payload, CoapCodeChanged)
+	})
+	go func() {
+		err := srv.Listen(":12324")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	// The server shrinks the 1024 byte blocks of the client
+	client := NewClient()
+	resp, err := client.POST(body, "coap://127.0.0.1:12324/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeChanged || !bytes.Equal(resp.Body, body) {
+		t.Fatalf("unexpected response %v of %d bytes", resp.Code, len(resp.Body))
+	}
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:12324")
+	if size := client.blockwise.size(addr); size != 256 {
+		t.Fatalf("client did not learn the block size: %d", size)
+	}
+
+	// The client asks for blocks smaller than the ones of the server
+	client = NewClient()
+	if err = client.SetPeerBlockSize("127.0.0.1:12324", 64); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.POST(body, "coap://127.0.0.1:12324/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Body, body) {
+		t.Fatalf("unexpected body of %d bytes", len(resp.Body))
+	}
+	if _, ok := sizes.Load(64); !ok {
+		t.Fatal("client did not send 64 byte blocks")
+	}
+
+	// The negotiation options are not added to the message of the caller
+	message, _ := constructMessage(POST, "coap://127.0.0.1:12324/echo")
+	message.Payload = NewStringPayload("ping")
+	options := len(message.Options)
+	for i := 0; i < 2; i++ {
+		if _, err = client.Send(message, "127.0.0.1:12324"); err != nil {
+			t.Fatal(err)
+		}
+		if len(message.Options) != options {
+			t.Fatalf("message has %d options instead of %d", len(message.Options), options)
+		}
+	}
+
+	// Lock-step transfers go on with the smaller blocks
+	client = NewClient()
+	client.SetBlockwiseMode(BlockwiseRFC7959)
+	resp, err = client.POST(body, "coap://127.0.0.1:12324/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Body, body) {
+		t.Fatalf("unexpected body of %d bytes", len(resp.Body))
+	}
+}
+
+func TestBlockwiseRFC7959ResponsePerRequest(t *testing.T) {
+	var version int32
+	srv := NewServer()
+	srv.AddGETResource("/changing", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		v := atomic.AddInt32(&version, 1)
+		return NewResponse(NewBytesPayload(bytes.Repeat([]byte{byte('a' + v)}, 200)), CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12336")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	conn, err := net.Dial("udp", "127.0.0.1:12336")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	get := func(token string, num int) []byte {
+		t.Helper()
+		request := NewCoAPMessage(CON, GET)
+		request.Token = []byte(token)
+		request.SetURIPath("/changing")
+		request.AddOption(OptionBlock2, newBlock(false, num, 64).ToInt())
+		data, _ := Serialize(request)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, MTU)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := Deserialize(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.Payload.Bytes()
+	}
+
+	first := get("first", 0)
+	second := get("second", 0)
+	if first[0] == second[0] {
+		t.Fatal("handler was not called for the second request")
+	}
+	if block := get("first", 1); block[0] != first[0] {
+		t.Fatalf("first request got block of another response %q", block[0])
+	}
+	if block := get("second", 1); block[0] != second[0] {
+		t.Fatalf("second request got block of another response %q", block[0])
+	}
+
+	// Asking for the first block again gets a new response
+	again := get("first", 0)
+	if again[0] == first[0] {
+		t.Fatal("first block was served from the old response")
+	}
+	if block := get("first", 1); block[0] != again[0] {
+		t.Fatalf("block of the old response %q", block[0])
+	}
+}
@@ -1,9 +1,14 @@
 package coalago
 
 import (
+	"context"
+	"crypto/ed25519"
 	"errors"
 	"net"
 	"net/url"
+	"sync"
+
+	"github.com/coalalib/coalago/session"
 )
 
 var (
@@ -16,14 +21,40 @@ type Response struct {
 	Body          []byte
 	Code          CoapCode
 	PeerPublicKey []byte
+	PeerIdentity  ed25519.PublicKey
 }
 
 type Client struct {
-	privateKey []byte
+	privateKey   []byte
+	cipherSuites []session.CipherSuite
+	identity     *session.Identity
+	peerIdentity PeerIdentityPolicy
+	rekeyPolicy  RekeyPolicy
+	rekeys       *rekeyer
+	sessions     SessionStorage
+	previous     *sessionStorageImpl
+	hooks        SecurityHooks
+	blockwise    *blockwiseModes
+	windowPolicy WindowPolicy
+	digest       DigestAlgorithm
+	limits       TransferLimits
+
+	transport Transport
+	socketMx  sync.Mutex
+	sockets   map[string]*clientSocket
 }
 
 func NewClient() *Client {
 	c := new(Client)
+	c.rekeyPolicy = DefaultRekeyPolicy
+	c.rekeys = newRekeyer(c)
+	c.sessions = globalSessions
+	c.previous = newSessionStorageImpl(false)
+	c.blockwise = newBlockwiseModes()
+	c.windowPolicy = DefaultWindowPolicy
+	c.limits = DefaultTransferLimits
+	c.transport = UDPTransport
+	c.sockets = make(map[string]*clientSocket)
 	return c
 }
 
@@ -33,6 +64,162 @@ func NewClientWithPrivateKey(pk []byte) *Client {
 	return c
 }
 
+// SetCipherSuites sets the cipher suites offered in ClientHello, in order of preference.
+func (c *Client) SetCipherSuites(suites ...session.CipherSuite) {
+	c.cipherSuites = suites
+}
+
+// SetIdentity makes the client sign its coaps:// handshakes with a long-term
+// Ed25519 identity. Session keys are ephemeral then, instead of being derived
+// from the private key.
+func (c *Client) SetIdentity(identity session.Identity) {
+	c.identity = &identity
+}
+
+// SetPeerIdentityPolicy sets which server identities coaps:// handshakes
+// accept, so that requests only go out to the expected servers.
+func (c *Client) SetPeerIdentityPolicy(policy PeerIdentityPolicy) {
+	c.peerIdentity = policy
+}
+
+// SetSecurityHooks sets the receiver of the client's security events.
+func (c *Client) SetSecurityHooks(hooks SecurityHooks) {
+	c.hooks = hooks
+}
+
+// SetRekeyPolicy sets the limits after which coaps:// session keys are renewed.
+func (c *Client) SetRekeyPolicy(policy RekeyPolicy) {
+	c.rekeyPolicy = policy
+}
+
+// SetSessionStorage sets where the client keeps its coaps:// sessions.
+// By default sessions are kept in memory and shared with other clients.
+func (c *Client) SetSessionStorage(storage SessionStorage) {
+	c.sessions = storage
+}
+
+// SetWindowPolicy sets the bounds of the selective-repeat window of transfers.
+func (c *Client) SetWindowPolicy(policy WindowPolicy) {
+	c.windowPolicy = policy
+}
+
+// SetPayloadDigest sets the digest sent with large payloads, so that the
+// server checks them after reassembly.
+func (c *Client) SetPayloadDigest(algorithm DigestAlgorithm) {
+	c.digest = algorithm
+}
+
+// SetTransferLimits bounds the responses the client reassembles from
+// blocks. Only MaxBodySize and MaxGap apply to it.
+func (c *Client) SetTransferLimits(limits TransferLimits) {
+	c.limits = limits
+}
+
+// SetBlockwiseMode sets how large payloads are transferred to peers
+// without a mode of their own.
+func (c *Client) SetBlockwiseMode(mode BlockwiseMode) {
+	c.blockwise.setDefault(mode)
+}
+
+// SetPeerBlockwiseMode sets how large payloads are transferred to the peer at addr.
+func (c *Client) SetPeerBlockwiseMode(addr string, mode BlockwiseMode) error {
+	return c.blockwise.setPeer(addr, mode)
+}
+
+// SetBlockSize sets the size of blocks exchanged with peers without a size
+// of their own: a power of two from 16 to 1024 bytes, or a multiple of 1024
+// bytes for BERT blocks, which are used only over reliable transports.
+// Peers may shrink it for themselves.
+func (c *Client) SetBlockSize(size int) error {
+	return c.blockwise.setDefaultSize(size)
+}
+
+// SetPeerBlockSize sets the size of blocks exchanged with the peer at addr.
+func (c *Client) SetPeerBlockSize(addr string, size int) error {
+	return c.blockwise.setPeerSize(addr, size)
+}
+
+func (c *Client) newTransport(conn dialer) *transport {
+	sr := newtransport(conn)
+	sr.privateKey = c.privateKey
+	sr.cipherSuites = c.cipherSuites
+	sr.identity = c.identity
+	sr.peerIdentity = c.peerIdentity
+	sr.rekeyPolicy = c.rekeyPolicy
+	sr.rekeys = c.rekeys
+	sr.sessions = c.sessions
+	sr.previousSessions = c.previous
+	sr.hooks = c.hooks
+	sr.blockwise = c.blockwise
+	sr.windowPolicy = c.windowPolicy
+	sr.digest = c.digest
+	sr.limits = c.limits
+	watchSessionExpiry(sr)
+	return sr
+}
+
+// SetTransport sets the transport of requests, UDPTransport by default.
+// It must be called before the first request.
+func (c *Client) SetTransport(transport Transport) {
+	c.transport = transport
+}
+
+// dial returns a connection to addr on the socket of the client to that
+// peer, which is opened on first use and after expiring. ctx bounds the wait
+// for a slot of the connection pool.
+func (c *Client) dial(ctx context.Context, addr string) (dialer, error) {
+	a, err := c.transport.Resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	key := a.String()
+	c.socketMx.Lock()
+	if socket := c.sockets[key]; socket != nil {
+		if conn, ok := socket.dial(a); ok {
+			c.socketMx.Unlock()
+			return conn, nil
+		}
+	}
+	c.socketMx.Unlock()
+
+	// Opening a socket may wait for a slot of the pool, requests to peers
+	// with an open socket go on meanwhile
+	socket, err := newClientSocket(ctx, globalPoolConnections, c.transport, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.socketMx.Lock()
+	defer c.socketMx.Unlock()
+	// Another request may have opened one in the meantime
+	if current := c.sockets[key]; current != nil {
+		if conn, ok := current.dial(a); ok {
+			socket.Close()
+			return conn, nil
+		}
+	}
+	c.sockets[key] = socket
+	conn, _ := socket.dial(a)
+	return conn, nil
+}
+
+// Close closes the sockets of the client. Requests sent afterwards open new
+// ones, peers see them coming from other addresses.
+func (c *Client) Close() error {
+	c.socketMx.Lock()
+	defer c.socketMx.Unlock()
+
+	var err error
+	for key, socket := range c.sockets {
+		if e := socket.Close(); e != nil {
+			err = e
+		}
+		delete(c.sockets, key)
+	}
+	return err
+}
+
 func (c *Client) GET(url string, options ...*CoAPMessageOption) (*Response, error) {
 	message, err := constructMessage(GET, url)
 	message.AddOptions(options)
@@ -40,21 +227,26 @@ func (c *Client) GET(url string, options ...*CoAPMessageOption) (*Response, erro
 	if err != nil {
 		return nil, err
 	}
-	return clientSendCONMessage(message, c.privateKey, message.Recipient.String())
+	return c.sendCONMessage(message, message.Recipient.String())
 }
 
 func (c *Client) Send(message *CoAPMessage, addr string, options ...*CoAPMessageOption) (*Response, error) {
+	return c.SendContext(context.Background(), message, addr, options...)
+}
+
+// SendContext is Send with a context, which bounds the wait for a free
+// socket when NumberConnections sockets are open.
+func (c *Client) SendContext(ctx context.Context, message *CoAPMessage, addr string, options ...*CoAPMessageOption) (*Response, error) {
 	message.AddOptions(options)
 
-	conn, err := globalPoolConnections.Dial(addr)
+	conn, err := c.dial(ctx, addr)
 	if err != nil {
-		return nil, err
+		return nil, newError("dial", message, addr, 0, err)
 	}
 
 	defer conn.Close()
 
-	sr := newtransport(conn)
-	sr.privateKey = c.privateKey
+	sr := c.newTransport(conn)
 
 	resp, err := sr.Send(message)
 	if err != nil {
@@ -68,6 +260,7 @@ func (c *Client) Send(message *CoAPMessage, addr string, options ...*CoAPMessage
 	r.Body = resp.Payload.Bytes()
 	r.Code = resp.Code
 	r.PeerPublicKey = resp.PeerPublicKey
+	r.PeerIdentity = resp.PeerIdentity
 	return r, nil
 }
 
@@ -79,7 +272,7 @@ func (c *Client) POST(data []byte, url string, options ...*CoAPMessageOption) (*
 	message.AddOptions(options)
 
 	message.Payload = NewBytesPayload(data)
-	return clientSendCONMessage(message, c.privateKey, message.Recipient.String())
+	return c.sendCONMessage(message, message.Recipient.String())
 }
 
 func (c *Client) DELETE(data []byte, url string, options ...*CoAPMessageOption) (*Response, error) {
@@ -89,11 +282,11 @@ func (c *Client) DELETE(data []byte, url string, options ...*CoAPMessageOption)
 	}
 	message.AddOptions(options)
 
-	return clientSendCONMessage(message, c.privateKey, message.Recipient.String())
+	return c.sendCONMessage(message, message.Recipient.String())
 }
 
-func clientSendCONMessage(message *CoAPMessage, privateKey []byte, addr string) (*Response, error) {
-	resp, err := clientSendCON(message, privateKey, addr)
+func (c *Client) sendCONMessage(message *CoAPMessage, addr string) (*Response, error) {
+	resp, err := c.sendCON(message, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -101,18 +294,18 @@ func clientSendCONMessage(message *CoAPMessage, privateKey []byte, addr string)
 	r.Body = resp.Payload.Bytes()
 	r.Code = resp.Code
 	r.PeerPublicKey = resp.PeerPublicKey
+	r.PeerIdentity = resp.PeerIdentity
 	return r, nil
 }
 
-func clientSendCON(message *CoAPMessage, privateKey []byte, addr string) (resp *CoAPMessage, err error) {
-	conn, err := globalPoolConnections.Dial(addr)
+func (c *Client) sendCON(message *CoAPMessage, addr string) (resp *CoAPMessage, err error) {
+	conn, err := c.dial(context.Background(), addr)
 	if err != nil {
-		return nil, err
+		return nil, newError("dial", message, addr, 0, err)
 	}
 
 	defer conn.Close()
-	sr := newtransport(conn)
-	sr.privateKey = privateKey
+	sr := c.newTransport(conn)
 
 	return sr.Send(message)
 }
@@ -164,9 +357,9 @@ func parseURI(uri string) (path, scheme string, queries url.Values, addr net.Add
 	return
 }
 
-func isBigPayload(message *CoAPMessage) bool {
+func isBigPayload(message *CoAPMessage, blockSize int) bool {
 	if message.Payload != nil {
-		return message.Payload.Length() > MAX_PAYLOAD_SIZE
+		return message.Payload.Length() > blockSize
 	}
 
 	return false
@@ -174,7 +367,9 @@ func isBigPayload(message *CoAPMessage) bool {
 
 func Ping(addr string) (isPing bool, err error) {
 	msg := NewCoAPMessage(CON, CoapCodeEmpty)
-	resp, err := clientSendCON(msg, nil, addr)
+	client := NewClient()
+	defer client.Close()
+	resp, err := client.sendCON(msg, addr)
 	if err != nil {
 		return false, err
 	}
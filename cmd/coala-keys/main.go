@@ -0,0 +1,360 @@
+// Command coala-keys generates and converts coala key material and manages
+// allowlist files of pinned peer public keys.
+//
+//	coala-keys generate [-identity] [-format hex|base64|raw|pem|openssh] [-out FILE]
+//	coala-keys pubkey [-format hex|base64|raw|pem] [-in FILE] [KEY]
+//	coala-keys convert -to hex|base64|raw|pem|openssh [-format hex|base64|raw|pem] [-in FILE] [-out FILE] [KEY]
+//	coala-keys allowlist add FILE KEY [COMMENT]
+//	coala-keys allowlist remove FILE KEY
+//	coala-keys allowlist list FILE
+//
+// A private key is read from KEY or from the file given by -in in the format
+// given by -format, hex by default. Keys in hex or base64 are decoded, raw
+// keys are used as is, the way NewServerWithPrivateKey takes them, and PEM
+// covers the PKCS #8 and OpenSSH files of Ed25519 identities.
+//
+// Allowlists take Curve25519 public keys in hex or base64 and Ed25519
+// identities in PEM or authorized_keys format, or in hex or base64 prefixed
+// with "ed25519:".
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/coalalib/coalago"
+	"github.com/coalalib/coalago/session"
+)
+
+const usage = `usage:
+  coala-keys generate [-identity] [-format hex|base64|raw|pem|openssh] [-out FILE]
+  coala-keys pubkey [-format hex|base64|raw|pem] [-in FILE] [KEY]
+  coala-keys convert -to hex|base64|raw|pem|openssh [-format hex|base64|raw|pem] [-in FILE] [-out FILE] [KEY]
+  coala-keys allowlist add FILE KEY [COMMENT]
+  coala-keys allowlist remove FILE KEY
+  coala-keys allowlist list FILE
+`
+
+var errUsage = errors.New("invalid arguments")
+
+// stdout is where keys and public keys are printed
+var stdout io.Writer = os.Stdout
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "generate":
+		err = generate(os.Args[2:])
+	case "pubkey":
+		err = pubkey(os.Args[2:])
+	case "convert":
+		err = convert(os.Args[2:])
+	case "allowlist":
+		err = allowlist(os.Args[2:])
+	default:
+		err = errUsage
+	}
+
+	if err == errUsage {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "coala-keys:", err)
+		os.Exit(1)
+	}
+}
+
+// key is a private key: a byte blob for the coaps:// handshake or an Ed25519 identity.
+type key struct {
+	private  []byte
+	identity *session.Identity
+}
+
+func parseKey(data []byte, format string) (key, error) {
+	var b []byte
+	var err error
+	switch format {
+	case "pem":
+		identity, err := session.ParseIdentity(data)
+		if err != nil {
+			return key{}, err
+		}
+		return key{identity: &identity}, nil
+	case "hex":
+		b, err = hex.DecodeString(strings.TrimSpace(string(data)))
+	case "base64":
+		b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	case "raw":
+		b = data
+	default:
+		return key{}, fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return key{}, fmt.Errorf("invalid %s key: %v", format, err)
+	}
+	if len(b) == 0 {
+		return key{}, errors.New("empty key")
+	}
+	return key{private: b}, nil
+}
+
+func readKey(in, format string, args []string) (key, error) {
+	switch {
+	case in != "" && len(args) == 0:
+		data, err := ioutil.ReadFile(in)
+		if err != nil {
+			return key{}, err
+		}
+		return parseKey(data, format)
+	case in == "" && len(args) == 1:
+		return parseKey([]byte(args[0]), format)
+	default:
+		return key{}, errUsage
+	}
+}
+
+func encodeKey(k key, format string) ([]byte, error) {
+	if k.identity != nil {
+		switch format {
+		case "pem":
+			return k.identity.MarshalPEM()
+		case "openssh":
+			return k.identity.MarshalOpenSSH("")
+		case "raw":
+			return k.identity.PrivateKey.Seed(), nil
+		}
+		k = key{private: k.identity.PrivateKey.Seed()}
+	}
+
+	switch format {
+	case "hex":
+		return []byte(hex.EncodeToString(k.private) + "\n"), nil
+	case "base64":
+		return []byte(base64.StdEncoding.EncodeToString(k.private) + "\n"), nil
+	case "raw":
+		return k.private, nil
+	case "pem", "openssh":
+		identity, err := session.NewIdentityFromSeed(k.private)
+		if err != nil {
+			return nil, err
+		}
+		return encodeKey(key{identity: &identity}, format)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func output(out string, data []byte) error {
+	if out == "" {
+		_, err := stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(out, data, 0600)
+}
+
+func generate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	isIdentity := fs.Bool("identity", false, "generate an Ed25519 identity instead of a handshake private key")
+	format := fs.String("format", "", "output format: hex, base64, raw, pem or openssh")
+	out := fs.String("out", "", "write the key to a file instead of stdout")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+
+	var k key
+	if *isIdentity {
+		identity, err := session.NewIdentity()
+		if err != nil {
+			return err
+		}
+		k.identity = &identity
+		if *format == "" {
+			*format = "pem"
+		}
+	} else {
+		k.private = make([]byte, session.KEY_SIZE)
+		if _, err := rand.Read(k.private); err != nil {
+			return err
+		}
+		if *format == "" {
+			*format = "hex"
+		}
+	}
+
+	data, err := encodeKey(k, *format)
+	if err != nil {
+		return err
+	}
+	if err = output(*out, data); err != nil {
+		return err
+	}
+	if *out != "" {
+		return printPublicKeys(k)
+	}
+	return nil
+}
+
+// curvePublicKey derives the Curve25519 public key the same way as
+// session.NewSecuredSession does for a server or client private key.
+func curvePublicKey(private []byte) ([]byte, error) {
+	ses, err := session.NewSecuredSession(private)
+	if err != nil {
+		return nil, err
+	}
+	return ses.Curve.GetPublicKey(), nil
+}
+
+func printPublicKeys(k key) error {
+	if k.identity != nil {
+		printPublicKey("ed25519", k.identity.PublicKey())
+		authorized, err := session.MarshalPublicKeyOpenSSH(k.identity.PublicKey())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "ed25519 openssh: %s", authorized)
+		return nil
+	}
+
+	publicKey, err := curvePublicKey(k.private)
+	if err != nil {
+		return err
+	}
+	printPublicKey("curve25519", publicKey)
+	return nil
+}
+
+func printPublicKey(name string, publicKey []byte) {
+	fmt.Fprintf(stdout, "%s hex: %s\n", name, hex.EncodeToString(publicKey))
+	fmt.Fprintf(stdout, "%s base64: %s\n", name, base64.StdEncoding.EncodeToString(publicKey))
+}
+
+func pubkey(args []string) error {
+	fs := flag.NewFlagSet("pubkey", flag.ContinueOnError)
+	in := fs.String("in", "", "read the private key from a file")
+	format := fs.String("format", "hex", "input format: hex, base64, raw or pem")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	k, err := readKey(*in, *format, fs.Args())
+	if err != nil {
+		return err
+	}
+	return printPublicKeys(k)
+}
+
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	in := fs.String("in", "", "read the private key from a file")
+	out := fs.String("out", "", "write the key to a file instead of stdout")
+	to := fs.String("to", "", "output format: hex, base64, raw, pem or openssh")
+	format := fs.String("format", "hex", "input format: hex, base64, raw or pem")
+	if err := fs.Parse(args); err != nil || *to == "" {
+		return errUsage
+	}
+
+	k, err := readKey(*in, *format, fs.Args())
+	if err != nil {
+		return err
+	}
+	data, err := encodeKey(k, *to)
+	if err != nil {
+		return err
+	}
+	return output(*out, data)
+}
+
+// publicKey decodes a Curve25519 public key in hex or base64, or an Ed25519
+// identity in PEM or authorized_keys format or in hex or base64 with the
+// "ed25519:" prefix. Keys of other sizes never match a peer.
+func publicKey(s string) (_ []byte, identity bool, err error) {
+	if publicKey, err := session.ParsePublicKey([]byte(s)); err == nil {
+		return publicKey, true, nil
+	}
+
+	identity = strings.HasPrefix(s, coalago.ALLOWLIST_IDENTITY_PREFIX)
+	s = strings.TrimPrefix(s, coalago.ALLOWLIST_IDENTITY_PREFIX)
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		if b, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, false, coalago.ErrInvalidPeerKey
+		}
+	}
+	if len(b) != session.KEY_SIZE {
+		return nil, false, coalago.ErrInvalidAllowlistKey
+	}
+	return b, identity, nil
+}
+
+func allowlist(args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	command, path, args := args[0], args[1], args[2:]
+
+	list, err := coalago.LoadAllowlist(path)
+	if os.IsNotExist(err) && command == "add" {
+		list, err = coalago.NewAllowlist(), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "list":
+		if len(args) != 0 {
+			return errUsage
+		}
+		for _, k := range list.Keys() {
+			fmt.Fprintf(stdout, "%s %s %s\n", hex.EncodeToString(k), base64.StdEncoding.EncodeToString(k), list.Comment(k))
+		}
+		for _, k := range list.Identities() {
+			fmt.Fprintf(stdout, "%s%s %s\n", coalago.ALLOWLIST_IDENTITY_PREFIX, hex.EncodeToString(k), list.Comment(k))
+		}
+		return nil
+	case "add":
+		if len(args) < 1 {
+			return errUsage
+		}
+		k, identity, err := publicKey(args[0])
+		if err != nil {
+			return err
+		}
+		var added bool
+		if identity {
+			added = list.AddIdentity(k, strings.Join(args[1:], " "))
+		} else {
+			added = list.Add(k, strings.Join(args[1:], " "))
+		}
+		if !added {
+			return errors.New("key is already in the allowlist")
+		}
+	case "remove":
+		if len(args) != 1 {
+			return errUsage
+		}
+		k, identity, err := publicKey(args[0])
+		if err != nil {
+			return err
+		}
+		if identity && !list.RemoveIdentity(k) || !identity && !list.Remove(k) {
+			return errors.New("key is not in the allowlist")
+		}
+	default:
+		return errUsage
+	}
+	return list.Save(path)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// run runs a command and returns what it printed.
+func run(t *testing.T, command func([]string) error, args ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	if err := command(args); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return buf.String()
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coala-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		identity bool
+		format   string
+		input    string
+		public   string
+	}{
+		{false, "hex", "hex", "curve25519 hex: "},
+		{false, "base64", "base64", "curve25519 hex: "},
+		{false, "raw", "raw", "curve25519 hex: "},
+		{true, "pem", "pem", "ed25519 hex: "},
+		{true, "openssh", "pem", "ed25519 hex: "},
+	}
+	for _, c := range cases {
+		generated := filepath.Join(dir, c.format)
+		args := []string{"-format", c.format, "-out", generated}
+		if c.identity {
+			args = append(args, "-identity")
+		}
+		printed := run(t, generate, args...)
+		if !strings.HasPrefix(printed, c.public) {
+			t.Fatalf("%s: unexpected public key %q", c.format, printed)
+		}
+
+		// pubkey prints what generate printed
+		if public := run(t, pubkey, "-format", c.input, "-in", generated); public != printed {
+			t.Fatalf("%s: expected %q, got %q", c.format, printed, public)
+		}
+
+		// Converting to hex and back keeps the key
+		converted := filepath.Join(dir, c.format+".hex")
+		to := "hex"
+		if c.identity {
+			to = "pem"
+		}
+		run(t, convert, "-format", c.input, "-to", to, "-in", generated, "-out", converted)
+		if public := run(t, pubkey, "-format", to, "-in", converted); public != printed {
+			t.Fatalf("%s: expected %q after convert, got %q", c.format, printed, public)
+		}
+		back := filepath.Join(dir, c.format+".back")
+		run(t, convert, "-format", to, "-to", c.format, "-in", converted, "-out", back)
+		if public := run(t, pubkey, "-format", c.input, "-in", back); public != printed {
+			t.Fatalf("%s: expected %q after converting back, got %q", c.format, printed, public)
+		}
+	}
+}
+
+func TestRawKeyIsNotDecoded(t *testing.T) {
+	text := "0123456789abcdef"
+	raw := run(t, convert, "-format", "raw", "-to", "hex", text)
+	if strings.TrimSpace(raw) != hex.EncodeToString([]byte(text)) {
+		t.Fatalf("raw key was decoded: %q", raw)
+	}
+	decoded := run(t, convert, "-format", "hex", "-to", "hex", text)
+	if strings.TrimSpace(decoded) != text {
+		t.Fatalf("unexpected hex key %q", decoded)
+	}
+
+	if err := convert([]string{"-format", "hex", "-to", "raw", "not hex"}); err == nil {
+		t.Fatal("expected invalid hex key to be rejected")
+	}
+}
+
+func TestAllowlistKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coala-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.allow")
+
+	key := strings.Repeat("01", 32)
+	identity := strings.Repeat("02", 32)
+	run(t, allowlist, "add", path, key, "gateway")
+	run(t, allowlist, "add", path, "ed25519:"+identity, "sensor")
+	if err = allowlist([]string{"add", path, "0102"}); err == nil {
+		t.Fatal("expected key that is not 32 bytes to be rejected")
+	}
+
+	listed := run(t, allowlist, "list", path)
+	if !strings.Contains(listed, key+" ") || !strings.Contains(listed, "ed25519:"+identity+" sensor") {
+		t.Fatalf("unexpected allowlist %q", listed)
+	}
+
+	// The identity is not removed as a Curve25519 key
+	if err = allowlist([]string{"remove", path, identity}); err == nil {
+		t.Fatal("expected identity to be kept apart from keys")
+	}
+	run(t, allowlist, "remove", path, "ed25519:"+identity)
+}
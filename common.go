@@ -204,6 +204,8 @@ func optionCodeToString(option OptionCode) string {
 		return "URIPort"
 	case OptionLocationPath:
 		return "LocationPath"
+	case OptionOSCORE:
+		return "OSCORE"
 	case OptionURIPath:
 		return "URIPath"
 	case OptionContentFormat:
@@ -238,8 +240,16 @@ func optionCodeToString(option OptionCode) string {
 		return "SessionExpired"
 	case OptionSelectiveRepeatWindowSize:
 		return "OptionSelectiveRepeatWindowSize"
-	// case OptionWindowtOffset:
-	// 	return "OptionWindowOffset"
+	case OptionSelectiveAck:
+		return "OptionSelectiveAck"
+	case OptionTransferID:
+		return "OptionTransferID"
+	case OptionPayloadDigest:
+		return "OptionPayloadDigest"
+	case OptionMessageID:
+		return "OptionMessageID"
+	case OptionSessionRekey:
+		return "OptionSessionRekey"
 	case OptionСoapsUri:
 		return "OptionСoapsUri"
 	case OptionProxySecurityID:
@@ -273,6 +283,10 @@ func constructNextBlock(blockType OptionCode, s *stateSend) (*CoAPMessage, bool)
 	s.start = s.stop
 
 	blockMessage.CloneOptions(s.origMessage, OptionProxyURI, OptionProxySecurityID)
+	if blockType == OptionBlock1 {
+		// Early negotiation of the size of response blocks
+		blockMessage.CloneOptions(s.origMessage, OptionBlock2)
+	}
 	blockMessage.ProxyAddr = s.origMessage.ProxyAddr
 
 	return blockMessage, !isMore
@@ -293,27 +307,11 @@ func ackTo(initMessage *CoAPMessage, origMessage *CoAPMessage, code CoapCode) *C
 	return result
 }
 
-func ackToWithWindowOffset(initMessage *CoAPMessage, origMessage *CoAPMessage, code CoapCode, windowSize int, blockNumber int, buf map[int][]byte) *CoAPMessage {
-	// var offset = 0
-	// for i := blockNumber; i > blockNumber-windowSize; i-- {
-	// 	offset++
-	// }
-
-	result := NewCoAPMessage(ACK, code)
-	result.MessageID = origMessage.MessageID
-	result.Token = origMessage.Token
-	result.CloneOptions(origMessage, OptionURIScheme, OptionSelectiveRepeatWindowSize, OptionBlock1, OptionBlock2, OptionProxySecurityID)
-	result.Recipient = origMessage.Sender
-
-	// if offset > 0 {
-	// 	result.AddOption(OptionWindowtOffset, uint16(offset))
-	// }
-
-	if initMessage != nil {
-		result.ProxyAddr = initMessage.ProxyAddr
-		result.CloneOptions(initMessage, OptionProxyURI)
+func ackToWithSelectiveAck(initMessage *CoAPMessage, origMessage *CoAPMessage, code CoapCode, buf map[int][]byte) *CoAPMessage {
+	result := ackTo(initMessage, origMessage, code)
+	if sack := encodeSelectiveAck(buf); sack != nil {
+		result.AddOption(OptionSelectiveAck, sack)
 	}
-
 	return result
 }
 
@@ -345,6 +343,7 @@ func newBlockingMessage(
 	msg.AddOption(optionBlock, b.ToInt())
 	msg.Recipient = recipient
 	msg.ProxyAddr = origMessage.ProxyAddr
+	msg.OSCOREContext = origMessage.OSCOREContext
 
 	return msg
 }
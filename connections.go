@@ -2,12 +2,23 @@ package coalago
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/coalalib/coalago/session"
 )
 
+// Sockets open at once, further ones wait for a free slot
 var NumberConnections = 1024
 
+// Sockets wait that long for a free slot before failing with ErrNoConnections
+var CONNECTIONS_WAIT_TIMEOUT = 10 * time.Second
+
+var ErrNoConnections = errors.New("no free connections")
+
 var globalPoolConnections = newConnpool()
 
 type dialer interface {
@@ -22,14 +33,11 @@ type dialer interface {
 }
 
 type connection struct {
-	end  chan struct{}
 	conn *net.UDPConn
 }
 
 func (c *connection) Close() error {
-	err := c.conn.Close()
-	<-c.end
-	return err
+	return c.conn.Close()
 }
 
 func (c *connection) RemoteAddr() net.Addr {
@@ -60,49 +68,95 @@ func (c *connection) WriteTo(buf []byte, addr string) (int, error) {
 	return c.conn.WriteTo(buf, a)
 }
 
-func newDialer(end chan struct{}, addr string) (dialer, error) {
-	a, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return nil, err
-	}
-	end <- struct{}{}
-	conn, err := net.DialUDP("udp4", nil, a)
-	if err != nil {
-		return nil, err
-	}
+// ConnectionStats describe the use of the NumberConnections slots.
+type ConnectionStats struct {
+	Open    int
+	Waiting int
+	// Sockets that had to wait for a slot, and those that gave up
+	Waited   uint64
+	TimedOut uint64
+}
 
-	c := new(connection)
-	c.conn = conn
-	c.end = end
-	return c, nil
+// connpool limits the sockets open at once to NumberConnections.
+type connpool struct {
+	mx    sync.Mutex
+	open  int
+	free  chan struct{}
+	stats ConnectionStats
 }
 
-func newListener(addr string) (dialer, error) {
-	a, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return nil, err
+func newConnpool() *connpool {
+	c := new(connpool)
+	c.free = make(chan struct{})
+	return c
+}
+
+// acquire takes a slot, waiting until one is released, the context is done
+// or CONNECTIONS_WAIT_TIMEOUT passes.
+func (c *connpool) acquire(ctx context.Context) error {
+	var timeout <-chan time.Time
+	for {
+		c.mx.Lock()
+		if c.open < NumberConnections {
+			c.open++
+			if timeout != nil {
+				c.stats.Waiting--
+			}
+			c.mx.Unlock()
+			return nil
+		}
+		if timeout == nil {
+			c.stats.Waiting++
+			c.stats.Waited++
+			timer := time.NewTimer(CONNECTIONS_WAIT_TIMEOUT)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		free := c.free
+		c.mx.Unlock()
+
+		select {
+		case <-free:
+		case <-ctx.Done():
+			c.giveUp(false)
+			return ctx.Err()
+		case <-timeout:
+			c.giveUp(true)
+			return ErrNoConnections
+		}
 	}
-	conn, err := net.ListenUDP("udp4", a)
-	if err != nil {
-		return nil, err
+}
+
+func (c *connpool) giveUp(timedOut bool) {
+	c.mx.Lock()
+	c.stats.Waiting--
+	if timedOut {
+		c.stats.TimedOut++
 	}
-	c := new(connection)
-	c.conn = conn
-	return c, nil
+	c.mx.Unlock()
 }
 
-type connpool struct {
-	balance chan struct{}
+// release frees a slot and wakes the sockets waiting for one.
+func (c *connpool) release() {
+	c.mx.Lock()
+	c.open--
+	close(c.free)
+	c.free = make(chan struct{})
+	c.mx.Unlock()
 }
 
-func newConnpool() *connpool {
-	c := new(connpool)
-	c.balance = make(chan struct{}, NumberConnections)
-	return c
+func (c *connpool) Stats() ConnectionStats {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	stats := c.stats
+	stats.Open = c.open
+	return stats
 }
 
-func (c *connpool) Dial(addr string) (dialer, error) {
-	return newDialer(c.balance, addr)
+// GetConnectionStats tells how many sockets are open and waiting for a slot.
+func GetConnectionStats() ConnectionStats {
+	return globalPoolConnections.Stats()
 }
 
 func (c *connection) SetReadDeadline() {
@@ -110,11 +164,12 @@ func (c *connection) SetReadDeadline() {
 }
 
 type packet struct {
-	acked    bool
-	attempts int
-	lastSend time.Time
-	message  *CoAPMessage
-	response *CoAPMessage
+	acked             bool
+	fastRetransmitted bool
+	attempts          int
+	lastSend          time.Time
+	message           *CoAPMessage
+	response          *CoAPMessage
 }
 
 const (
@@ -122,24 +177,28 @@ const (
 )
 
 func receiveMessage(tr *transport, origMessage *CoAPMessage) (*CoAPMessage, error) {
+	limit := messageSizeLimit(tr.conn.LocalAddr())
 	for {
 		tr.conn.SetReadDeadline()
 
-		buff := make([]byte, MTU+1)
+		buff := make([]byte, limit+1)
 		n, err := tr.conn.Read(buff)
 		if err != nil {
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 				return nil, ErrMaxAttempts
 			}
-			return nil, err
+			return nil, newError("receive", origMessage, tr.conn.RemoteAddr().String(), 0, err)
 		}
-		if n > MTU {
+		if n > limit {
 			continue
 		}
 
 		message, err := preparationReceivingBuffer(tr, buff[:n], tr.conn.RemoteAddr(), origMessage.ProxyAddr)
+		if errors.Is(err, session.ErrOSCOREReplay) {
+			continue
+		}
 		if err != nil {
-			return nil, err
+			return nil, newError("receive", origMessage, tr.conn.RemoteAddr().String(), 0, err)
 		}
 
 		if !bytes.Equal(message.Token, origMessage.Token) {
@@ -0,0 +1,49 @@
+package coalago
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConnpoolLimit(t *testing.T) {
+	number, timeout := NumberConnections, CONNECTIONS_WAIT_TIMEOUT
+	defer func() { NumberConnections, CONNECTIONS_WAIT_TIMEOUT = number, timeout }()
+	NumberConnections, CONNECTIONS_WAIT_TIMEOUT = 1, 100*time.Millisecond
+
+	pool := newConnpool()
+	if err := pool.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pool.acquire(context.Background()); err != ErrNoConnections {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pool.acquire(ctx); err != context.Canceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	stats := pool.Stats()
+	if stats.Open != 1 || stats.Waiting != 0 || stats.Waited != 2 || stats.TimedOut != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// A waiting socket gets the released slot
+	CONNECTIONS_WAIT_TIMEOUT = time.Second
+	go func() {
+		for pool.Stats().Waiting == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		pool.release()
+	}()
+	if err := pool.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pool.release()
+	if stats = pool.Stats(); stats.Open != 0 {
+		t.Fatalf("slots are not released: %+v", stats)
+	}
+}
@@ -185,6 +185,8 @@ const (
 	MediaTypeApplicationSoapFastInfoSet MediaType = 49
 	MediaTypeApplicationJSON            MediaType = 50
 	MediaTypeApplicationXObitBinary     MediaType = 51
+	MediaTypeApplicationEDHOCCBORSeq    MediaType = 64
+	MediaTypeApplicationCIDEDHOCCBORSeq MediaType = 65
 	MediaTypeTextPlainVndOmaLwm2m       MediaType = 1541
 	MediaTypeTlvVndOmaLwm2m             MediaType = 1542
 	MediaTypeJSONVndOmaLwm2m            MediaType = 1543
@@ -210,6 +212,7 @@ const (
 	OptionObserve       OptionCode = 6
 	OptionURIPort       OptionCode = 7
 	OptionLocationPath  OptionCode = 8
+	OptionOSCORE        OptionCode = 9
 	OptionURIPath       OptionCode = 11
 	OptionContentFormat OptionCode = 12
 	OptionMaxAge        OptionCode = 14
@@ -240,7 +243,19 @@ const (
 
 	OptionSelectiveRepeatWindowSize OptionCode = 3001
 	OptionProxySecurityID           OptionCode = 3004
-	// OptionWindowtOffset             OptionCode = 3012
+	/// Selective ACK option tells the sender of blocks which ones were received
+	/// after the first missing block, see `encodeSelectiveAck`
+	OptionSelectiveAck OptionCode = 3012
+	/// Transfer ID option makes a Block1 transfer resumable, see `SetTransferID`
+	OptionTransferID OptionCode = 3014
+	/// Payload digest option carries the digest of the whole payload in the final block
+	OptionPayloadDigest OptionCode = 3016
+	/// Message ID option carries the message ID of coaps:// messages over
+	/// RFC 8323 transports, their payload is sealed with it
+	OptionMessageID OptionCode = 3018
+	/// Session rekey option asks the client to renew the coaps:// session,
+	/// peers answer with it when their own rekey limits are reached
+	OptionSessionRekey OptionCode = 3020
 
 	OptionСoapsUri OptionCode = 4005
 )
@@ -0,0 +1,72 @@
+package coalago
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"hash/crc32"
+)
+
+// DigestAlgorithm selects the digest of the whole payload a block-wise
+// transfer sends with its final block, the receiver checks it after the
+// blocks are reassembled.
+type DigestAlgorithm byte
+
+const (
+	DigestNone DigestAlgorithm = iota
+	DigestSHA256
+	DigestCRC32C
+)
+
+// Transfers whose reassembled payload does not match the digest are retried that many times
+const MAX_DIGEST_RETRIES = 2
+
+var (
+	ErrPayloadDigest = errors.New("payload digest mismatch")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// payloadDigest returns the value of the digest option: the algorithm in
+// one byte followed by the digest, or nil without a known algorithm.
+func payloadDigest(algorithm DigestAlgorithm, payload []byte) []byte {
+	switch algorithm {
+	case DigestSHA256:
+		sum := sha256.Sum256(payload)
+		return append([]byte{byte(algorithm)}, sum[:]...)
+	case DigestCRC32C:
+		sum := crc32.Checksum(payload, crc32c)
+		return []byte{byte(algorithm), byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+	}
+	return nil
+}
+
+func addPayloadDigest(message *CoAPMessage, algorithm DigestAlgorithm, payload []byte) {
+	if digest := payloadDigest(algorithm, payload); digest != nil {
+		message.AddOption(OptionPayloadDigest, string(digest))
+	}
+}
+
+// checkPayloadDigest accepts payloads without a digest. A digest of an
+// unknown algorithm cannot be checked, which may as well be a corrupted
+// one, so it does not match.
+func checkPayloadDigest(option *CoAPMessageOption, payload []byte) bool {
+	if option == nil {
+		return true
+	}
+	value := []byte(option.StringValue())
+	if len(value) == 0 {
+		return false
+	}
+	digest := payloadDigest(DigestAlgorithm(value[0]), payload)
+	if digest == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(digest, value) == 1
+}
+
+// isDigestMismatch tells if the response reports that the reassembled
+// payload did not match its digest.
+func isDigestMismatch(resp *CoAPMessage) bool {
+	return resp.Code == CoapCodeRequestEntityIncomplete && resp.GetOption(OptionPayloadDigest) != nil
+}
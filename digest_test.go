@@ -0,0 +1,124 @@
+package coalago
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPayloadDigest(t *testing.T) {
+	payload := []byte("firmware image")
+	for _, algorithm := range []DigestAlgorithm{DigestSHA256, DigestCRC32C} {
+		option := NewOption(OptionPayloadDigest, string(payloadDigest(algorithm, payload)))
+		if !checkPayloadDigest(option, payload) {
+			t.Fatalf("digest %d does not match", algorithm)
+		}
+		if checkPayloadDigest(option, []byte("firmware imagE")) {
+			t.Fatalf("digest %d matches a changed payload", algorithm)
+		}
+	}
+	if !checkPayloadDigest(nil, payload) {
+		t.Fatal("payload without a digest is rejected")
+	}
+	for _, value := range []string{"", "\xffunknown", "\x00"} {
+		if checkPayloadDigest(NewOption(OptionPayloadDigest, value), payload) {
+			t.Fatalf("digest %q of an unknown algorithm is accepted", value)
+		}
+	}
+}
+
+func TestPayloadDigestMismatch(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sr := newtransport(&connection{conn: conn})
+
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	state := newBlock1State()
+	send := func(num int, more bool, payload []byte, digest []byte) bool {
+		message := NewCoAPMessage(CON, POST)
+		message.Token = []byte("token")
+		message.Sender = peer.LocalAddr()
+		message.AddOption(OptionBlock1, newBlock(more, num, 16).ToInt())
+		if digest != nil {
+			message.AddOption(OptionPayloadDigest, string(digest))
+		}
+		message.Payload = NewBytesPayload(payload)
+		ok, _, err := localStateReceiveARQBlock1(sr, state, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	// A stale block of a reused token
+	send(0, true, []byte("stale block 0..."), nil)
+	if send(1, false, []byte("end"), payloadDigest(DigestSHA256, []byte("fresh block 0...end"))) {
+		t.Fatal("payload with a wrong digest is accepted")
+	}
+
+	buf := make([]byte, MTU)
+	for {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, err := Deserialize(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack.Code == CoapCodeContinue {
+			continue
+		}
+		if !isDigestMismatch(ack) {
+			t.Fatalf("unexpected response %v", ack.Code)
+		}
+		break
+	}
+
+	// The retried transfer starts from scratch
+	send(0, true, []byte("fresh block 0..."), nil)
+	if !send(1, false, []byte("end"), payloadDigest(DigestSHA256, []byte("fresh block 0...end"))) {
+		t.Fatal("retried transfer is not accepted")
+	}
+}
+
+func TestPayloadDigestTransfer(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+
+	srv := NewServer()
+	srv.SetPayloadDigest(DigestSHA256)
+	srv.AddPOSTResource("/echo", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		if !checkPayloadDigest(message.GetOption(OptionPayloadDigest), message.Payload.Bytes()) {
+			return NewResponse(NewEmptyPayload(), CoapCodeBadRequest)
+		}
+		return NewResponse(message.Payload, CoapCodeChanged)
+	})
+	go func() {
+		err := srv.Listen(":12326")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+	client.SetPayloadDigest(DigestCRC32C)
+
+	resp, err := client.POST(body, "coap://127.0.0.1:12326/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeChanged || !bytes.Equal(resp.Body, body) {
+		t.Fatalf("unexpected response %v of %d bytes", resp.Code, len(resp.Body))
+	}
+}
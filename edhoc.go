@@ -0,0 +1,190 @@
+package coalago
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+	"github.com/patrickmn/go-cache"
+)
+
+// EDHOC (RFC 9528) runs over CoAP as in Appendix A.2: message_1 is POSTed
+// prefixed with CBOR true, message_3 prefixed with the Responder's connection
+// identifier, and message_2 comes in the 2.04 response to message_1.
+
+const (
+	EDHOC_PATH = "/.well-known/edhoc"
+
+	edhocInitiatorMarker  = 0xf5 // CBOR true
+	edhocConnectionIDSize = 4
+)
+
+var (
+	ErrorEDHOC     = errors.New("EDHOC key exchange failed")
+	ErrorEDHOCBusy = errors.New("too many EDHOC key exchanges in progress")
+)
+
+// MAX_EDHOC_RESPONDERS is how many exchanges a server waits for message_3 of
+// at a time. Further message_1 are answered with 5.03.
+var MAX_EDHOC_RESPONDERS = 1024
+
+func newEDHOCResponders() *cache.Cache {
+	return cache.New(SESSIONS_POOL_EXPIRATION, time.Second)
+}
+
+// staticCurve25519 derives the static key the same way as coaps:// sessions do.
+func staticCurve25519(privateKey []byte) (session.Curve25519, error) {
+	if len(privateKey) == 0 {
+		return session.NewCurve25519()
+	}
+	return session.NewStaticCurve25519(sha256.Sum256(privateKey)), nil
+}
+
+func newEDHOCConnectionID() ([]byte, error) {
+	id := make([]byte, edhocConnectionIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// EnableEDHOC serves EDHOC at EDHOC_PATH. The server authenticates with the
+// static key derived from its private key and kid. Every completed exchange
+// adds an OSCORE security context for the client.
+func (s *Server) EnableEDHOC(kid []byte, credentials session.EDHOCCredentialLookup) {
+	s.AddPOSTResource(EDHOC_PATH, func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		payload := message.Payload.Bytes()
+		if len(payload) > 0 && payload[0] == edhocInitiatorMarker {
+			return s.receiveEDHOCMessage1(payload[1:], kid, credentials)
+		}
+		return s.receiveEDHOCMessage3(payload)
+	})
+}
+
+func edhocErrorResponse(err error) *CoAPResourceHandlerResult {
+	result := NewResponse(NewBytesPayload(session.EDHOCError(err)), CoapCodeBadRequest)
+	result.MediaType = MediaTypeApplicationEDHOCCBORSeq
+	return result
+}
+
+func (s *Server) receiveEDHOCMessage1(message1, kid []byte, credentials session.EDHOCCredentialLookup) *CoAPResourceHandlerResult {
+	if s.edhocResponders.ItemCount() >= MAX_EDHOC_RESPONDERS {
+		result := edhocErrorResponse(ErrorEDHOCBusy)
+		result.Code = CoapCodeServiceUnavailable
+		return result
+	}
+
+	static, err := staticCurve25519(s.privatekey)
+	if err != nil {
+		return edhocErrorResponse(err)
+	}
+
+	var responderID []byte
+	for {
+		if responderID, err = newEDHOCConnectionID(); err != nil {
+			return edhocErrorResponse(err)
+		}
+		if _, ok := s.edhocResponders.Get(string(responderID)); !ok && s.oscoreContexts.get(responderID, nil) == nil {
+			break
+		}
+	}
+
+	responder, err := session.NewEDHOC(static, kid, responderID, credentials)
+	if err != nil {
+		return edhocErrorResponse(err)
+	}
+	if err = responder.ReceiveMessage1(message1); err != nil {
+		return edhocErrorResponse(err)
+	}
+	message2, err := responder.Message2()
+	if err != nil {
+		return edhocErrorResponse(err)
+	}
+
+	s.edhocResponders.SetDefault(string(responderID), responder)
+
+	result := NewResponse(NewBytesPayload(message2), CoapCodeChanged)
+	result.MediaType = MediaTypeApplicationEDHOCCBORSeq
+	return result
+}
+
+func (s *Server) receiveEDHOCMessage3(payload []byte) *CoAPResourceHandlerResult {
+	responderID, message3, err := session.DecodeEDHOCConnectionID(payload)
+	if err != nil {
+		return edhocErrorResponse(err)
+	}
+
+	v, ok := s.edhocResponders.Get(string(responderID))
+	if !ok {
+		return edhocErrorResponse(session.ErrEDHOCState)
+	}
+	s.edhocResponders.Delete(string(responderID))
+	responder := v.(*session.EDHOC)
+
+	if err = responder.ReceiveMessage3(message3); err != nil {
+		return edhocErrorResponse(err)
+	}
+	ctx, err := responder.OSCOREContext()
+	if err != nil {
+		return edhocErrorResponse(err)
+	}
+	s.AddOSCOREContext(ctx)
+
+	return NewResponse(NewEmptyPayload(), CoapCodeChanged)
+}
+
+// EDHOC runs the EDHOC key exchange with the server at addr and returns the
+// OSCORE security context to protect requests to it. The client authenticates
+// with the static key derived from its private key and kid.
+func (c *Client) EDHOC(addr string, kid []byte, credentials session.EDHOCCredentialLookup) (*session.OSCOREContext, error) {
+	static, err := staticCurve25519(c.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	initiatorID, err := newEDHOCConnectionID()
+	if err != nil {
+		return nil, err
+	}
+	initiator, err := session.NewEDHOC(static, kid, initiatorID, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	message2, err := c.sendEDHOCMessage(addr, append([]byte{edhocInitiatorMarker}, initiator.Message1()...))
+	if err != nil {
+		return nil, err
+	}
+	if err = initiator.ReceiveMessage2(message2); err != nil {
+		return nil, err
+	}
+
+	message3, err := initiator.Message3()
+	if err != nil {
+		return nil, err
+	}
+	payload := append(session.EncodeEDHOCConnectionID(initiator.PeerConnectionID), message3...)
+	if _, err = c.sendEDHOCMessage(addr, payload); err != nil {
+		return nil, err
+	}
+
+	return initiator.OSCOREContext()
+}
+
+func (c *Client) sendEDHOCMessage(addr string, payload []byte) ([]byte, error) {
+	message := NewCoAPMessage(CON, POST)
+	message.SetSchemeCOAP()
+	message.SetURIPath(EDHOC_PATH)
+	message.AddOption(OptionContentFormat, MediaTypeApplicationCIDEDHOCCBORSeq)
+	message.Payload = NewBytesPayload(payload)
+
+	resp, err := c.sendCON(message, addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != CoapCodeChanged {
+		return nil, ErrorEDHOC
+	}
+	return resp.Payload.Bytes(), nil
+}
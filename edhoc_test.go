@@ -0,0 +1,111 @@
+package coalago
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+func TestEDHOCBootstrapsOSCORE(t *testing.T) {
+	serverKey := session.NewStaticCurve25519(sha256.Sum256([]byte("server key")))
+	clientKey := session.NewStaticCurve25519(sha256.Sum256([]byte("client key")))
+
+	srv := NewServerWithPrivateKey([]byte("server key"))
+	srv.EnableEDHOC([]byte{0x32}, func(kid []byte) (session.EDHOCCredential, bool) {
+		if string(kid) != "\x0a" {
+			return session.EDHOCCredential{}, false
+		}
+		return session.EDHOCCredential{PublicKey: clientKey.GetPublicKey()}, true
+	})
+	srv.AddGETResource("/object", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		if message.OSCOREContext == nil {
+			return NewResponse(NewStringPayload("unprotected"), CoapCodeForbidden)
+		}
+		return NewResponse(NewStringPayload("protected"), CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12317")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	serverCredentials := func(kid []byte) (session.EDHOCCredential, bool) {
+		return session.EDHOCCredential{PublicKey: serverKey.GetPublicKey()}, string(kid) == "\x32"
+	}
+
+	ctx, err := NewClientWithPrivateKey([]byte("client key")).EDHOC("127.0.0.1:12317", []byte{0x0a}, serverCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := NewCoAPMessage(CON, GET)
+	message.SetSchemeCOAP()
+	message.SetURIPath("/object")
+	message.OSCOREContext = ctx
+	resp, err := NewClient().Send(message, "127.0.0.1:12317")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeContent || string(resp.Body) != "protected" {
+		t.Fatalf("unexpected response %v %q", resp.Code, resp.Body)
+	}
+
+	if _, err = NewClientWithPrivateKey([]byte("other key")).EDHOC("127.0.0.1:12317", []byte{0x0a}, serverCredentials); err == nil {
+		t.Fatal("expected EDHOC with unknown client key to fail")
+	}
+}
+
+func TestEDHOCRespondersPerServer(t *testing.T) {
+	serverKey := session.NewStaticCurve25519(sha256.Sum256([]byte("server key")))
+	clientKey := session.NewStaticCurve25519(sha256.Sum256([]byte("client key")))
+	clientCredentials := func(kid []byte) (session.EDHOCCredential, bool) {
+		return session.EDHOCCredential{PublicKey: clientKey.GetPublicKey()}, true
+	}
+	serverCredentials := func(kid []byte) (session.EDHOCCredential, bool) {
+		return session.EDHOCCredential{PublicKey: serverKey.GetPublicKey()}, true
+	}
+
+	srv := NewServerWithPrivateKey([]byte("server key"))
+	other := NewServerWithPrivateKey([]byte("server key"))
+
+	initiator, err := session.NewEDHOC(clientKey, []byte{0x0a}, []byte{0x01}, serverCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := srv.receiveEDHOCMessage1(initiator.Message1(), []byte{0x32}, clientCredentials)
+	if result.Code != CoapCodeChanged {
+		t.Fatalf("unexpected response %v to message_1", result.Code)
+	}
+	if err = initiator.ReceiveMessage2(result.Payload.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	message3, err := initiator.Message3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := append(session.EncodeEDHOCConnectionID(initiator.PeerConnectionID), message3...)
+
+	// Only the server that sent message_2 completes the exchange
+	if result = other.receiveEDHOCMessage3(payload); result.Code != CoapCodeBadRequest {
+		t.Fatalf("message_3 completed at another server: %v", result.Code)
+	}
+	if result = srv.receiveEDHOCMessage3(payload); result.Code != CoapCodeChanged {
+		t.Fatalf("unexpected response %v to message_3", result.Code)
+	}
+
+	defer func(max int) { MAX_EDHOC_RESPONDERS = max }(MAX_EDHOC_RESPONDERS)
+	MAX_EDHOC_RESPONDERS = 1
+	for i, code := range []CoapCode{CoapCodeChanged, CoapCodeServiceUnavailable} {
+		initiator, err = session.NewEDHOC(clientKey, []byte{0x0a}, []byte{byte(i)}, serverCredentials)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result = srv.receiveEDHOCMessage1(initiator.Message1(), []byte{0x32}, clientCredentials); result.Code != code {
+			t.Fatalf("expected %v to message_1 #%d, got %v", code, i, result.Code)
+		}
+	}
+}
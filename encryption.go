@@ -66,6 +66,9 @@ func decryptionOptions(message *CoAPMessage, aead session.AEAD) error {
 		return err
 	}
 
+	// Only the encrypted URI counts
+	message.RemoveOptions(OptionURIPath)
+	message.RemoveOptions(OptionURIQuery)
 	message.SetURIPath(parsedURL.Path)
 
 	for k, v := range queries {
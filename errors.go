@@ -0,0 +1,68 @@
+package coalago
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error describes a failed exchange with a peer. The cause is one of the
+// package errors such as ErrMaxAttempts or ErrorHandshake, so it can be
+// matched with errors.Is.
+type Error struct {
+	Op        string
+	Addr      string
+	MessageID uint16
+	Token     []byte
+	Attempts  int
+	Err       error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString("coala: ")
+	b.WriteString(e.Op)
+	if e.Addr != "" {
+		b.WriteString(" " + e.Addr)
+	}
+	fmt.Fprintf(&b, " mid=%d", e.MessageID)
+	if len(e.Token) > 0 {
+		b.WriteString(" token=" + hex.EncodeToString(e.Token))
+	}
+	if e.Attempts > 0 {
+		fmt.Fprintf(&b, " attempts=%d", e.Attempts)
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError adds the exchange context to err. An err that already is an *Error
+// keeps the context of where it happened first.
+func newError(op string, message *CoAPMessage, addr string, attempts int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		if e.Attempts == 0 {
+			e.Attempts = attempts
+		}
+		return err
+	}
+
+	return &Error{
+		Op:        op,
+		Addr:      addr,
+		MessageID: message.MessageID,
+		Token:     message.Token,
+		Attempts:  attempts,
+		Err:       err,
+	}
+}
@@ -0,0 +1,35 @@
+package coalago
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorIs(t *testing.T) {
+	message := NewCoAPMessageId(CON, GET, 42)
+	message.Token = []byte{0xca, 0xfe}
+
+	err := newError("send", message, "127.0.0.1:5683", 6, ErrMaxAttempts)
+	if !errors.Is(err, ErrMaxAttempts) {
+		t.Fatalf("expected %v to match ErrMaxAttempts", err)
+	}
+	if errors.Is(err, ErrorHandshake) {
+		t.Fatalf("unexpected match of %v with ErrorHandshake", err)
+	}
+
+	expected := "coala: send 127.0.0.1:5683 mid=42 token=cafe attempts=6: max attempts"
+	if err.Error() != expected {
+		t.Fatalf("expected %q, got %q", expected, err.Error())
+	}
+
+	// The context of the first failure is kept
+	wrapped := newError("handshake", NewCoAPMessageId(CON, GET, 1), "", 0, err)
+	var e *Error
+	if !errors.As(wrapped, &e) || e.Op != "send" || e.MessageID != 42 || e.Attempts != 6 {
+		t.Fatalf("unexpected error context: %v", wrapped)
+	}
+
+	if newError("send", message, "", 0, nil) != nil {
+		t.Fatal("expected nil error")
+	}
+}
@@ -10,7 +10,12 @@ var (
 	MetricSentMessageErrors,
 	MetricSessionsRate,
 	MetricSessionsCount,
-	MetricSuccessfulHandhshakes counterImpl
+	MetricSuccessfulHandhshakes,
+	MetricSessionRekeys,
+	MetricRejectedTransfers,
+	MetricDroppedBlocks,
+	MetricTransferStorageErrors,
+	MetricOverloadedMessages counterImpl
 )
 
 type Counter interface {
@@ -8,4 +8,6 @@ require (
 	github.com/onsi/gomega v1.10.3
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	golang.org/x/net v0.0.0-20201006153459-a7d1128ccaa0
+	gopkg.in/yaml.v2 v2.3.0
 )
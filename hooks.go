@@ -0,0 +1,103 @@
+package coalago
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// SecurityEventType names a security event, it is also used in audit logs.
+type SecurityEventType string
+
+const (
+	SecurityEventHandshakeSucceeded SecurityEventType = "handshake_succeeded"
+	SecurityEventHandshakeFailed    SecurityEventType = "handshake_failed"
+	SecurityEventDecryptFailed      SecurityEventType = "decrypt_failed"
+	SecurityEventSessionCreated     SecurityEventType = "session_created"
+	SecurityEventSessionDeleted     SecurityEventType = "session_deleted"
+	SecurityEventPeerRejected       SecurityEventType = "peer_rejected"
+)
+
+// SecurityEvent describes what happened to the security of the exchange with a peer.
+// PeerPublicKey and PeerIdentity are set when they are known at that moment.
+type SecurityEvent struct {
+	Type          SecurityEventType
+	Time          time.Time
+	LocalAddr     string
+	PeerAddr      string
+	ProxyAddr     string
+	PeerPublicKey []byte
+	PeerIdentity  ed25519.PublicKey
+	Err           error
+}
+
+// SecurityHooks receives security events of a Client or Server. Events are
+// delivered synchronously from the goroutines handling messages, so the
+// implementation must be safe for concurrent use and return quickly.
+type SecurityHooks interface {
+	SecurityEvent(event SecurityEvent)
+}
+
+// SecurityHooksFunc adapts a function to SecurityHooks.
+type SecurityHooksFunc func(event SecurityEvent)
+
+func (f SecurityHooksFunc) SecurityEvent(event SecurityEvent) {
+	f(event)
+}
+
+func (tr *transport) securityEvent(event SecurityEvent) {
+	if tr.hooks == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.LocalAddr = tr.conn.LocalAddr().String()
+	tr.hooks.SecurityEvent(event)
+}
+
+// AuditLogger writes security events as JSON lines.
+type AuditLogger struct {
+	mx sync.Mutex
+	w  io.Writer
+}
+
+type auditRecord struct {
+	Time          string            `json:"time"`
+	Type          SecurityEventType `json:"type"`
+	LocalAddr     string            `json:"local_addr"`
+	PeerAddr      string            `json:"peer_addr"`
+	ProxyAddr     string            `json:"proxy_addr,omitempty"`
+	PeerPublicKey string            `json:"peer_public_key,omitempty"`
+	PeerIdentity  string            `json:"peer_identity,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+func NewAuditLogger(w io.Writer) *AuditLogger {
+	return &AuditLogger{w: w}
+}
+
+func (l *AuditLogger) SecurityEvent(event SecurityEvent) {
+	record := auditRecord{
+		Time:          event.Time.UTC().Format(time.RFC3339Nano),
+		Type:          event.Type,
+		LocalAddr:     event.LocalAddr,
+		PeerAddr:      event.PeerAddr,
+		ProxyAddr:     event.ProxyAddr,
+		PeerPublicKey: hex.EncodeToString(event.PeerPublicKey),
+		PeerIdentity:  hex.EncodeToString(event.PeerIdentity),
+	}
+	if event.Err != nil {
+		record.Error = event.Err.Error()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	l.mx.Lock()
+	l.w.Write(append(data, '\n'))
+	l.mx.Unlock()
+}
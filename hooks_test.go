@@ -0,0 +1,134 @@
+package coalago
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+func TestSecurityHooks(t *testing.T) {
+	var mx sync.Mutex
+	var serverEvents []SecurityEventType
+
+	srv := NewServer()
+	srv.SetSecurityHooks(SecurityHooksFunc(func(event SecurityEvent) {
+		mx.Lock()
+		serverEvents = append(serverEvents, event.Type)
+		mx.Unlock()
+	}))
+	resource := NewCoAPResource(CoapMethodGet, "/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("secret"), CoapCodeContent)
+	})
+	resource.Policy = &ResourcePolicy{Keys: []string{strings.Repeat("00", PEER_KEY_SIZE)}}
+	if err := srv.AddResource(resource); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		err := srv.Listen(":12320")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	var audit bytes.Buffer
+	client := NewClient()
+	client.SetSessionStorage(NewMemorySessionStorage())
+	client.SetSecurityHooks(NewAuditLogger(&audit))
+
+	message, _ := constructMessage(GET, "coaps://127.0.0.1:12320/secure")
+	message.BreakConnectionOnPK = func(actualPK []byte) bool { return true }
+	if _, err := client.Send(message, "127.0.0.1:12320"); err == nil {
+		t.Fatal("expected handshake to be broken")
+	}
+
+	resp, err := client.GET("coaps://127.0.0.1:12320/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeForbidden {
+		t.Fatalf("expected %v, got %v", CoapCodeForbidden, resp.Code)
+	}
+
+	var clientEvents []SecurityEventType
+	for _, line := range bytes.Split(bytes.TrimSpace(audit.Bytes()), []byte("\n")) {
+		var record auditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("invalid audit line %q: %v", line, err)
+		}
+		if record.PeerPublicKey == "" {
+			t.Errorf("%s: peer public key is empty", record.Type)
+		}
+		clientEvents = append(clientEvents, record.Type)
+	}
+	expectEvents(t, "client", clientEvents, SecurityEventPeerRejected, SecurityEventSessionCreated, SecurityEventHandshakeSucceeded)
+
+	mx.Lock()
+	defer mx.Unlock()
+	expectEvents(t, "server", serverEvents, SecurityEventHandshakeSucceeded, SecurityEventSessionCreated, SecurityEventPeerRejected)
+}
+
+func expectEvents(t *testing.T, side string, actual []SecurityEventType, expected ...SecurityEventType) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("%s: expected events %v, got %v", side, expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("%s: expected events %v, got %v", side, expected, actual)
+		}
+	}
+}
+
+func TestSessionExpiryEvent(t *testing.T) {
+	expiration := SESSIONS_POOL_EXPIRATION
+	SESSIONS_POOL_EXPIRATION = time.Second
+	storage := NewMemorySessionStorage()
+	SESSIONS_POOL_EXPIRATION = expiration
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var mx sync.Mutex
+	var events []SecurityEvent
+	tr := newtransport(&connection{conn: conn})
+	tr.sessions = storage
+	tr.hooks = SecurityHooksFunc(func(event SecurityEvent) {
+		mx.Lock()
+		events = append(events, event)
+		mx.Unlock()
+	})
+	watchSessionExpiry(tr)
+	defer unwatchSessionExpiry(conn.LocalAddr().String())
+
+	local := conn.LocalAddr().String()
+	storage.Set(local, "127.0.0.1:1", "", session.SecuredSession{PeerPublicKey: []byte("expired")})
+	storage.Set(local, "127.0.0.1:2", "", session.SecuredSession{})
+	storage.Delete(local, "127.0.0.1:2", "")
+
+	time.Sleep(3 * time.Second)
+
+	mx.Lock()
+	defer mx.Unlock()
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %v", events)
+	}
+	event := events[0]
+	if event.Type != SecurityEventSessionDeleted || event.PeerAddr != "127.0.0.1:1" || !errors.Is(event.Err, ErrorSessionExpired) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if string(event.PeerPublicKey) != "expired" {
+		t.Fatalf("unexpected peer public key %q", event.PeerPublicKey)
+	}
+}
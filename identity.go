@@ -0,0 +1,35 @@
+package coalago
+
+import (
+	"crypto/ed25519"
+	"errors"
+)
+
+var (
+	ErrorPeerIdentityRequired = errors.New("peer did not prove an identity")
+	ErrorPeerIdentityRejected = errors.New("peer identity is not accepted")
+)
+
+// PeerIdentityPolicy decides which Ed25519 identities a coaps:// handshake
+// accepts from the peer. It is checked before the session is established,
+// so nothing is sent to or accepted from a peer it rejects.
+type PeerIdentityPolicy struct {
+	// Required rejects peers that do not prove an identity
+	Required bool
+	// Pin accepts only the identities it returns true for, peers without
+	// an identity are rejected when it is set
+	Pin func(identity ed25519.PublicKey) bool
+}
+
+func (p PeerIdentityPolicy) check(identity ed25519.PublicKey) error {
+	if identity == nil {
+		if p.Required || p.Pin != nil {
+			return ErrorPeerIdentityRequired
+		}
+		return nil
+	}
+	if p.Pin != nil && !p.Pin(identity) {
+		return ErrorPeerIdentityRejected
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package coalago
 
+import "fmt"
+
 func requestOnReceive(resource *CoAPResource, sr *transport, message *CoAPMessage) bool {
 	if message.Code < 0 || message.Code > 4 {
 		return true
@@ -20,6 +22,17 @@ func requestOnReceive(resource *CoAPResource, sr *transport, message *CoAPMessag
 		return methodNotAllowed(sr, message)
 	}
 
+	if code := sr.access.check(resource, message); code != CoapCodeEmpty {
+		if message.Type == CON {
+			return accessDenied(sr, message, code)
+		}
+		return false
+	}
+
+	if sr.blockwise.isRFC7959Request(message) && cachedLockStepBlock2(sr, message) {
+		return false
+	}
+
 	if handlerResult := resource.Handler(message); handlerResult != nil {
 		if message.Type == NON {
 			return false
@@ -58,6 +71,29 @@ func methodNotAllowed(sr *transport, message *CoAPMessage) bool {
 	return false
 }
 
+func accessDenied(sr *transport, message *CoAPMessage, code CoapCode) bool {
+	sr.securityEvent(SecurityEvent{
+		Type:          SecurityEventPeerRejected,
+		PeerAddr:      message.Sender.String(),
+		ProxyAddr:     message.ProxyAddr,
+		PeerPublicKey: message.PeerPublicKey,
+		PeerIdentity:  message.PeerIdentity,
+		Err:           fmt.Errorf("%w: %s %v", ErrAccessDenied, message.GetURIPath(), code),
+	})
+
+	responseMessage := NewCoAPMessageId(ACK, code, message.MessageID)
+	responseMessage.Payload = NewStringPayload("Access to requested resource is denied")
+	if message.Token != nil && len(message.Token) > 0 {
+		responseMessage.Token = message.Token
+	}
+	if message.GetScheme() == COAPS_SCHEME {
+		responseMessage.SetSchemeCOAPS()
+	}
+	responseMessage.CloneOptions(message, OptionBlock1, OptionBlock2, OptionProxySecurityID)
+	sr.SendTo(responseMessage, message.Sender)
+	return false
+}
+
 func returnResultFromResource(sr *transport, message *CoAPMessage, handlerResult *CoAPResourceHandlerResult) bool {
 	// @TODO: Validate Response code! handlerResult.Code
 
@@ -84,6 +120,10 @@ func returnResultFromResource(sr *transport, message *CoAPMessage, handlerResult
 	}
 	responseMessage.CloneOptions(message, OptionBlock1, OptionBlock2, OptionSelectiveRepeatWindowSize, OptionProxySecurityID)
 
+	if sr.blockwise.isRFC7959Request(message) {
+		return sendLockStepBlock2(sr, message, responseMessage) != nil
+	}
+
 	_, err := sr.SendTo(responseMessage, message.Sender)
 	return err != nil
 }
@@ -0,0 +1,151 @@
+package coalago
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// TransferLimits bound the memory that reassembly of block-wise transfers
+// takes. Zero fields are not limited.
+type TransferLimits struct {
+	// Largest payload reassembled from blocks, larger ones are refused
+	// with 4.13 Request Entity Too Large and the limit in Size1
+	MaxBodySize int
+	// Block1 transfers reassembled at once from one host and in total,
+	// further ones are refused with 5.03 Service Unavailable
+	MaxTransfersPerPeer int
+	MaxTransfers        int
+	// Blocks more than that many blocks past the first missing one are dropped
+	MaxGap int
+}
+
+var DefaultTransferLimits = TransferLimits{
+	MaxBodySize:         16 << 20,
+	MaxTransfersPerPeer: 16,
+	MaxTransfers:        1024,
+	MaxGap:              4 * DEFAULT_WINDOW_SIZE,
+}
+
+var ErrBodyTooLarge = errors.New("body is too large")
+
+// transferLimiter counts the Block1 transfers being reassembled. A transfer
+// no block arrived for during sumTimeAttempts is over, like its local state.
+type transferLimiter struct {
+	mx     sync.Mutex
+	active map[string]activeTransfer
+	byPeer map[string]int
+}
+
+type activeTransfer struct {
+	peer string
+	seen time.Time
+}
+
+func newTransferLimiter() *transferLimiter {
+	return &transferLimiter{
+		active: make(map[string]activeTransfer),
+		byPeer: make(map[string]int),
+	}
+}
+
+func (l *transferLimiter) reached(limits TransferLimits, peer string) bool {
+	return (limits.MaxTransfers > 0 && len(l.active) >= limits.MaxTransfers) ||
+		(limits.MaxTransfersPerPeer > 0 && l.byPeer[peer] >= limits.MaxTransfersPerPeer)
+}
+
+// acquire registers the transfer or keeps it going, it tells false when
+// a new transfer would exceed the limits.
+func (l *transferLimiter) acquire(limits TransferLimits, key, peer string) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+	if t, ok := l.active[key]; ok && now.Sub(t.seen) < sumTimeAttempts {
+		t.seen = now
+		l.active[key] = t
+		return true
+	}
+
+	if l.reached(limits, peer) {
+		l.expire(now)
+		if l.reached(limits, peer) {
+			return false
+		}
+	}
+
+	l.remove(key)
+	l.active[key] = activeTransfer{peer: peer, seen: now}
+	l.byPeer[peer]++
+	return true
+}
+
+func (l *transferLimiter) release(key string) {
+	l.mx.Lock()
+	l.remove(key)
+	l.mx.Unlock()
+}
+
+func (l *transferLimiter) remove(key string) {
+	t, ok := l.active[key]
+	if !ok {
+		return
+	}
+	delete(l.active, key)
+	if l.byPeer[t.peer]--; l.byPeer[t.peer] <= 0 {
+		delete(l.byPeer, t.peer)
+	}
+}
+
+func (l *transferLimiter) expire(now time.Time) {
+	for key, t := range l.active {
+		if now.Sub(t.seen) >= sumTimeAttempts {
+			l.remove(key)
+		}
+	}
+}
+
+// peerHost is the host transfers are counted by, clients send every
+// request from a new port.
+func peerHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// limitBlock1 applies the transfer limits to the block at index of buf,
+// whose data ends at end bytes of the body. It answers refused transfers
+// and tells if the block may be kept.
+func limitBlock1(sr *transport, state *block1State, inputMessage *CoAPMessage, index, end int) (bool, error) {
+	limits := sr.limits
+	key := inputMessage.Sender.String() + string(inputMessage.Token)
+
+	size := end
+	if option := inputMessage.GetOption(OptionSize1); option != nil && option.IntValue() > size {
+		size = option.IntValue()
+	}
+	if limits.MaxBodySize > 0 && size > limits.MaxBodySize {
+		MetricRejectedTransfers.Inc()
+		sr.limiter.release(key)
+		*state = *newBlock1State()
+		ack := ackTo(nil, inputMessage, CoapCodeRequestEntityTooLarge)
+		ack.AddOption(OptionSize1, limits.MaxBodySize)
+		return false, sr.sendToSocketByAddress(ack, inputMessage.Sender)
+	}
+
+	if limits.MaxGap > 0 && index-state.advance() > limits.MaxGap {
+		MetricDroppedBlocks.Inc()
+		return false, nil
+	}
+
+	if !sr.limiter.acquire(limits, key, peerHost(inputMessage.Sender)) {
+		MetricRejectedTransfers.Inc()
+		ack := ackTo(nil, inputMessage, CoapCodeServiceUnavailable)
+		ack.AddOption(OptionMaxAge, int(sumTimeAttempts/time.Second))
+		return false, sr.sendToSocketByAddress(ack, inputMessage.Sender)
+	}
+	return true, nil
+}
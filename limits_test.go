@@ -0,0 +1,150 @@
+package coalago
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransferLimiter(t *testing.T) {
+	limits := TransferLimits{MaxTransfersPerPeer: 2, MaxTransfers: 3}
+	l := newTransferLimiter()
+
+	if !l.acquire(limits, "a1", "a") || !l.acquire(limits, "a2", "a") {
+		t.Fatal("transfers within the limits are refused")
+	}
+	if l.acquire(limits, "a3", "a") {
+		t.Fatal("transfer over the peer limit is accepted")
+	}
+	if !l.acquire(limits, "a1", "a") {
+		t.Fatal("running transfer is refused")
+	}
+	if !l.acquire(limits, "b1", "b") || l.acquire(limits, "c1", "c") {
+		t.Fatal("global limit is not applied")
+	}
+
+	l.release("a1")
+	if !l.acquire(limits, "c1", "c") {
+		t.Fatal("released transfer is still counted")
+	}
+
+	// Idle transfers are over
+	for key, transfer := range l.active {
+		transfer.seen = transfer.seen.Add(-sumTimeAttempts)
+		l.active[key] = transfer
+	}
+	if !l.acquire(limits, "a3", "a") || !l.acquire(limits, "a4", "a") {
+		t.Fatal("idle transfers are still counted")
+	}
+}
+
+func TestTransferLimitsBlock1(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sr := newtransport(&connection{conn: conn})
+	sr.limits = TransferLimits{MaxBodySize: 128, MaxTransfersPerPeer: 1, MaxGap: 2}
+
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	readAck := func() *CoAPMessage {
+		buf := make([]byte, MTU)
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, err := Deserialize(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ack
+	}
+
+	states := make(map[string]*block1State)
+	send := func(token string, num int, more bool) bool {
+		if states[token] == nil {
+			states[token] = newBlock1State()
+		}
+		message := NewCoAPMessage(CON, POST)
+		message.Token = []byte(token)
+		message.Sender = peer.LocalAddr()
+		message.AddOption(OptionBlock1, newBlock(more, num, 16).ToInt())
+		message.Payload = NewBytesPayload(bytes.Repeat([]byte{byte(num)}, 16))
+		ok, _, err := localStateReceiveARQBlock1(sr, states[token], message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	// Blocks too far from the first missing one are dropped
+	send("first", 4, true)
+	if len(states["first"].buf) != 0 {
+		t.Fatal("block past the gap is kept")
+	}
+
+	send("first", 0, true)
+	if ack := readAck(); ack.Code != CoapCodeContinue {
+		t.Fatalf("unexpected response %v", ack.Code)
+	}
+
+	// A second transfer of the peer waits
+	send("second", 0, true)
+	ack := readAck()
+	if ack.Code != CoapCodeServiceUnavailable || ack.GetOption(OptionMaxAge) == nil {
+		t.Fatalf("unexpected response %v", ack.Code)
+	}
+
+	// The body may not grow past the limit
+	send("first", 8, true)
+	ack = readAck()
+	if ack.Code != CoapCodeRequestEntityTooLarge || ack.GetOption(OptionSize1).IntValue() != 128 {
+		t.Fatalf("unexpected response %v", ack.Code)
+	}
+	if len(states["first"].buf) != 0 {
+		t.Fatal("refused transfer is kept")
+	}
+
+	// The refused transfer is not counted anymore
+	send("second", 0, true)
+	if ack := readAck(); ack.Code != CoapCodeContinue {
+		t.Fatalf("unexpected response %v", ack.Code)
+	}
+	if !send("second", 1, false) {
+		t.Fatal("transfer within the limits is refused")
+	}
+}
+
+func TestTransferLimitsBodySize(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+
+	srv := NewServer()
+	srv.SetTransferLimits(TransferLimits{MaxBodySize: 4096})
+	srv.AddPOSTResource("/echo", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(message.Payload, CoapCodeChanged)
+	})
+	addr := listenServer(t, srv, "127.0.0.1:0")
+	client := NewClient()
+
+	resp, err := client.POST(body, "coap://"+addr+"/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeRequestEntityTooLarge {
+		t.Fatalf("unexpected response %v", resp.Code)
+	}
+
+	// Responses are bounded by the client
+	client.SetTransferLimits(TransferLimits{MaxBodySize: 2048})
+	if _, err = client.POST(body[:4000], "coap://"+addr+"/echo"); err == nil {
+		t.Fatal("response over the limit is accepted")
+	}
+}
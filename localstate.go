@@ -15,8 +15,7 @@ type LocalStateFn func(*CoAPMessage)
 
 func MakeLocalStateFn(r Resourcer, tr *transport, respHandler func(*CoAPMessage, error), closeCallback func()) LocalStateFn {
 	var mx sync.Mutex
-	var bufBlock1 = make(map[int][]byte)
-	var totalBlocks1 = -1
+	var block1 = newBlock1State()
 	var runnedHandler int32 = 0
 
 	return func(message *CoAPMessage) {
@@ -43,7 +42,7 @@ func MakeLocalStateFn(r Resourcer, tr *transport, respHandler func(*CoAPMessage,
 			closeCallback()
 		}
 
-		totalBlocks1, bufBlock1 = localStateMessageHandlerSelector(tr, totalBlocks1, bufBlock1, message, respHandler)
+		localStateMessageHandlerSelector(tr, block1, message, respHandler)
 	}
 }
 
@@ -59,6 +58,8 @@ func localStateSecurityInputLayer(tr *transport, message *CoAPMessage, proxyAddr
 		return false, err
 	}
 
+	message.PeerInfo = newPeerInfo(message)
+
 	// Check if the message has coaps:// scheme and requires a new Session
 	if message.GetScheme() == COAPS_SCHEME {
 		addressSession := message.Sender.String()
@@ -73,18 +74,38 @@ func localStateSecurityInputLayer(tr *transport, message *CoAPMessage, proxyAddr
 			return false, ErrorClientSessionNotFound
 		}
 
-		// Decrypt message payload
-		err := decrypt(message, currentSession.AEAD)
-		if err != nil {
-			deleteSessionForAddress(tr.conn.LocalAddr().String(), addressSession, proxyAddr)
+		// Without the encrypted URI nothing of a request without payload
+		// is authenticated, anyone could send it from the peer's address
+		if message.Code >= GET && message.Code <= DELETE && message.GetOption(OptionСoapsUri) == nil {
+			tr.securityEvent(SecurityEvent{
+				Type:          SecurityEventDecryptFailed,
+				PeerAddr:      addressSession,
+				ProxyAddr:     proxyAddr,
+				PeerPublicKey: currentSession.PeerPublicKey,
+				PeerIdentity:  currentSession.PeerIdentity,
+				Err:           ErrorCoapsURIMissing,
+			})
 			responseMessage := NewCoAPMessageId(ACK, CoapCodeUnauthorized, message.MessageID)
-			responseMessage.AddOption(OptionSessionExpired, 1)
 			responseMessage.Token = message.Token
 			tr.SendTo(responseMessage, message.Sender)
-			return false, ErrorClientSessionExpired
+			return false, ErrorCoapsURIMissing
 		}
 
+		// Decrypt message payload
+		currentSession, err := decryptWithSession(tr, message, currentSession, tr.conn.LocalAddr().String(), addressSession, proxyAddr)
+		if err != nil {
+			return false, rejectUndecryptable(tr, message, currentSession, addressSession, proxyAddr, err)
+		}
+
+		currentSession.Usage.Add(message.Payload.Length())
+
 		message.PeerPublicKey = currentSession.PeerPublicKey
+		message.PeerIdentity = currentSession.PeerIdentity
+		message.PeerInfo.setSession(currentSession)
+	}
+
+	if ok, err := oscoreInputLayer(tr, message); !ok {
+		return false, err
 	}
 
 	/* Receive Errors */
@@ -92,11 +113,11 @@ func localStateSecurityInputLayer(tr *transport, message *CoAPMessage, proxyAddr
 	sessionExpired := message.GetOption(OptionSessionExpired)
 	if message.Code == CoapCodeUnauthorized {
 		if sessionNotFound != nil {
-			deleteSessionForAddress(tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+			deleteSessionForAddress(tr, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr, ErrorSessionNotFound)
 			return false, ErrorSessionNotFound
 		}
 		if sessionExpired != nil {
-			deleteSessionForAddress(tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+			deleteSessionForAddress(tr, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr, ErrorSessionExpired)
 			return false, ErrorSessionExpired
 		}
 	}
@@ -104,79 +125,178 @@ func localStateSecurityInputLayer(tr *transport, message *CoAPMessage, proxyAddr
 	return true, nil
 }
 
+// block1State is the reassembly state of the Block1 transfer of a local state.
+type block1State struct {
+	totalBlocks int
+	buf         map[int][]byte
+	// Digest option of the final block
+	digest *CoAPMessageOption
+	// Number of blocks received from the first one without a gap
+	contiguous int
+}
+
+func newBlock1State() *block1State {
+	return &block1State{totalBlocks: -1, buf: make(map[int][]byte)}
+}
+
+func (s *block1State) advance() int {
+	for {
+		if _, ok := s.buf[s.contiguous]; !ok {
+			return s.contiguous
+		}
+		s.contiguous++
+	}
+}
+
 func localStateMessageHandlerSelector(
 	sr *transport,
-	totalBlocks int,
-	buffer map[int][]byte,
+	state *block1State,
 
 	message *CoAPMessage,
 	respHandler func(*CoAPMessage, error),
-) (
-	int, map[int][]byte,
 ) {
 	block1 := message.GetBlock1()
 	block2 := message.GetBlock2()
 
 	if block1 != nil {
 		if message.Type == CON {
-			var (
-				ok  bool
-				err error
-			)
-			ok, totalBlocks, buffer, message, err = localStateReceiveARQBlock1(sr, totalBlocks, buffer, message)
+			ok, message, err := localStateReceiveARQBlock1(sr, state, message)
 			if ok {
-				go respHandler(message, err)
+				sr.goHandler(message, func() { respHandler(message, err) })
 			}
 		}
-		return totalBlocks, buffer
+		return
 	}
 
-	if block2 != nil {
+	// A CON with Block2 is an RFC 7959 request for a block of the response
+	if block2 != nil && message.Type != CON {
 		if message.Type == ACK {
 			id := message.Sender.String() + string(message.Token)
 
 			c, ok := sr.block2channels.Load(id)
 			if ok {
-				c.(chan *CoAPMessage) <- message
+				select {
+				case c.(chan *CoAPMessage) <- message:
+				default:
+					MetricDroppedBlocks.Inc()
+				}
 			}
 		}
-		return totalBlocks, buffer
+		return
 	}
-	go respHandler(message, nil)
-	return totalBlocks, buffer
+	sr.goHandler(message, func() { respHandler(message, nil) })
 }
 
-func localStateReceiveARQBlock1(sr *transport, totalBlocks int, buf map[int][]byte, inputMessage *CoAPMessage) (bool, int, map[int][]byte, *CoAPMessage, error) {
+func localStateReceiveARQBlock1(sr *transport, state *block1State, inputMessage *CoAPMessage) (bool, *CoAPMessage, error) {
 	block := inputMessage.GetBlock1()
 	if block == nil || inputMessage.Type != CON {
-		return false, totalBlocks, buf, inputMessage, nil
+		return false, inputMessage, nil
 	}
+	buf := state.buf
+	payload := inputMessage.Payload.Bytes()
+	window := inputMessage.GetOption(OptionSelectiveRepeatWindowSize) != nil
+
+	// BERT blocks are kept in parts of 1024 bytes
+	unit := block.BlockSize
+	if blockSize := sr.blockSize(inputMessage.Sender); len(payload) > blockSize {
+		// The receiver shrinks the blocks. Lock-step senders go on with
+		// smaller blocks after the first one, selective-repeat ones start over.
+		if blockSize > MAX_PAYLOAD_SIZE {
+			blockSize = MAX_PAYLOAD_SIZE
+		}
+		if window || block.BlockNumber != 0 {
+			return false, inputMessage, sendSmallerBlock1(sr, inputMessage, block, blockSize)
+		}
+		unit = blockSize
+	}
+
+	// Blocks of resumable transfers are kept until the transfer is complete
+	var key, value string
+	if option := inputMessage.GetOption(OptionTransferID); option != nil && sr.transfers != nil {
+		value = option.StringValue()
+		key = transferKey(transferPeer(inputMessage), value, unit)
+		if len(buf) == 0 {
+			loadTransfer(sr, key, buf)
+		}
+		if len(payload) == 0 && block.MoreBlocks {
+			return false, inputMessage, receiveTransferQuery(sr, inputMessage, buf, unit)
+		}
+	}
+
+	index := block.BlockNumber * block.BlockSize / unit
+	if ok, err := limitBlock1(sr, state, inputMessage, index, block.BlockNumber*block.BlockSize+len(payload)); !ok {
+		return false, inputMessage, err
+	}
+	// The limits may have reset the state
+	buf = state.buf
+
+	last := storeBlock(buf, block, payload, unit)
 	if !block.MoreBlocks {
-		totalBlocks = block.BlockNumber + 1
+		state.totalBlocks = last + 1
+		state.digest = inputMessage.GetOption(OptionPayloadDigest)
 	}
 
-	buf[block.BlockNumber] = inputMessage.Payload.Bytes()
-	if totalBlocks == len(buf) {
+	if state.totalBlocks == len(buf) {
 		b := []byte{}
-		for i := 0; i < totalBlocks; i++ {
+		for i := 0; i < state.totalBlocks; i++ {
 			b = append(b, buf[i]...)
 		}
+		if key != "" && sr.transfers.Delete(key) != nil {
+			MetricTransferStorageErrors.Inc()
+		}
+		sr.limiter.release(inputMessage.Sender.String() + string(inputMessage.Token))
+
+		// Stored blocks that are not of this content are dropped with the transfer
+		if key != "" && !checkTransferHash(value, b) {
+			*state = *newBlock1State()
+			return false, inputMessage, sr.sendToSocketByAddress(ackTo(nil, inputMessage, CoapCodeRequestEntityIncomplete), inputMessage.Sender)
+		}
+
+		// The sender retries the whole transfer
+		if digest := state.digest; !checkPayloadDigest(digest, b) {
+			*state = *newBlock1State()
+			ack := ackTo(nil, inputMessage, CoapCodeRequestEntityIncomplete)
+			ack.AddOption(OptionPayloadDigest, digest.StringValue())
+			return false, inputMessage, sr.sendToSocketByAddress(ack, inputMessage.Sender)
+		}
+
 		inputMessage.Payload = NewBytesPayload(b)
+		return true, inputMessage, nil
+	}
 
-		return true, totalBlocks, buf, inputMessage, nil
+	if key != "" {
+		// Blocks that are not stored are sent again if the transfer is resumed
+		for i := index; i <= last; i++ {
+			if err := sr.transfers.Store(key, i, buf[i]); err != nil {
+				MetricTransferStorageErrors.Inc()
+				break
+			}
+		}
 	}
 
 	var ack *CoAPMessage
-	w := inputMessage.GetOption(OptionSelectiveRepeatWindowSize)
-	if w != nil {
-		ack = ackToWithWindowOffset(nil, inputMessage, CoapCodeContinue, w.IntValue(), block.BlockNumber, buf)
+	if window {
+		ack = ackToWithSelectiveAck(nil, inputMessage, CoapCodeContinue, buf)
 	} else {
 		ack = ackTo(nil, inputMessage, CoapCodeContinue)
+		if unit != block.BlockSize {
+			ack.RemoveOptions(OptionBlock1)
+			ack.AddOption(OptionBlock1, newBlock(true, last, unit).ToInt())
+		}
 	}
 
 	if err := sr.sendToSocketByAddress(ack, inputMessage.Sender); err != nil {
-		return false, totalBlocks, buf, inputMessage, err
+		return false, inputMessage, err
 	}
 
-	return false, totalBlocks, buf, inputMessage, nil
+	return false, inputMessage, nil
+}
+
+// sendSmallerBlock1 rejects a block larger than the receiver takes, telling
+// the size of blocks it wants.
+func sendSmallerBlock1(sr *transport, inputMessage *CoAPMessage, block *block, blockSize int) error {
+	ack := ackTo(nil, inputMessage, CoapCodeRequestEntityTooLarge)
+	ack.RemoveOptions(OptionBlock1)
+	ack.AddOption(OptionBlock1, newBlock(block.MoreBlocks, block.BlockNumber, blockSize).ToInt())
+	return sr.sendToSocketByAddress(ack, inputMessage.Sender)
 }
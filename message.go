@@ -3,6 +3,7 @@ package coalago
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -12,6 +13,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/coalalib/coalago/session"
 )
 
 // A Message object represents a CoAP payload
@@ -33,9 +36,16 @@ type CoAPMessage struct {
 
 	BreakConnectionOnPK func(actualPK []byte) bool
 	PeerPublicKey       []byte
+	// Ed25519 identity of the peer verified during the coaps:// handshake, if it has one
+	PeerIdentity ed25519.PublicKey
+	// Peer and session of an incoming message
+	PeerInfo *PeerInfo
 
 	ProxyAddr string
 	Context   context.Context
+
+	// Protects the message with OSCORE (RFC 8613) when set
+	OSCOREContext *session.OSCOREContext
 }
 
 func NewCoAPMessage(messageType CoapType, messageCode CoapCode) *CoAPMessage {
@@ -171,8 +181,7 @@ func deserialize(data []byte) (*CoAPMessage, error) {
 			switch optCode {
 			case OptionURIScheme, OptionProxyScheme, OptionURIPort, OptionContentFormat, OptionMaxAge, OptionAccept, OptionSize1,
 				OptionSize2, OptionBlock1, OptionBlock2, OptionHandshakeType, OptionObserve,
-				OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize, OptionProxySecurityID:
-				// OptionWindowtOffset
+				OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize, OptionProxySecurityID, OptionMessageID, OptionSessionRekey:
 
 				intVal, err := decodeInt(optionValue)
 				if err != nil {
@@ -181,7 +190,7 @@ func deserialize(data []byte) (*CoAPMessage, error) {
 				msg.Options = append(msg.Options, NewOption(optCode, intVal))
 
 			case OptionURIHost, OptionEtag, OptionLocationPath, OptionURIPath, OptionURIQuery,
-				OptionLocationQuery, OptionProxyURI, OptionСoapsUri:
+				OptionLocationQuery, OptionProxyURI, OptionСoapsUri, OptionOSCORE, OptionSelectiveAck, OptionTransferID, OptionPayloadDigest:
 				msg.Options = append(msg.Options, NewOption(optCode, string(optionValue)))
 			default:
 				if lastOptionID&0x01 == 1 {
@@ -275,6 +284,7 @@ func (m *CoAPMessage) Clone(includePayload bool) *CoAPMessage {
 	cloneMessage.Options = m.Options
 	cloneMessage.ProxyAddr = m.ProxyAddr
 	cloneMessage.BreakConnectionOnPK = m.BreakConnectionOnPK
+	cloneMessage.OSCOREContext = m.OSCOREContext
 	if includePayload {
 		cloneMessage.Payload = m.Payload
 	}
@@ -161,9 +161,8 @@ func (opt *CoAPMessageOption) IsValidOption() bool {
 	case OptionIfNoneMatch, OptionURIScheme, OptionURIHost,
 		OptionEtag, OptionIfMatch, OptionObserve, OptionURIPort, OptionLocationPath,
 		OptionURIPath, OptionContentFormat, OptionMaxAge, OptionURIQuery, OptionAccept,
-		OptionLocationQuery, OptionBlock2, OptionBlock1, OptionProxyURI, OptionProxySecurityID, OptionProxyScheme, OptionSize1,
-		OptionHandshakeType, OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize:
-		// OptionWindowtOffset
+		OptionLocationQuery, OptionBlock2, OptionBlock1, OptionProxyURI, OptionProxySecurityID, OptionProxyScheme, OptionSize1, OptionSize2,
+		OptionHandshakeType, OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize, OptionOSCORE, OptionSelectiveAck, OptionTransferID, OptionPayloadDigest, OptionMessageID, OptionSessionRekey:
 		return true
 	default:
 		return false
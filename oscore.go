@@ -0,0 +1,294 @@
+package coalago
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+	"github.com/patrickmn/go-cache"
+)
+
+// OSCORE (RFC 8613) protects the code, the inner options and the payload of a
+// message end-to-end, so that they stay protected through proxies.
+// Every protected message carries its own Partial IV. An ACK is bound to the
+// request it answers by the kid and Partial IV of that request.
+
+var (
+	ErrorOSCOREContextNotFound = errors.New("OSCORE security context not found")
+	ErrorOSCOREUnprotected     = errors.New("unprotected message in OSCORE exchange")
+
+	// Requests sent or received under OSCORE by Message ID
+	oscoreExchanges = cache.New(sumTimeAttempts, time.Second)
+	// Security contexts of OSCORE transfers by token
+	oscoreTokens = cache.New(sumTimeAttempts, time.Second)
+)
+
+type oscoreExchange struct {
+	context    *session.OSCOREContext
+	requestKID []byte
+	requestPIV []byte
+}
+
+// oscoreRegistry keeps the server's security contexts by the kid of the client.
+type oscoreRegistry struct {
+	mx       sync.RWMutex
+	contexts map[string]*session.OSCOREContext
+}
+
+func newOSCORERegistry() *oscoreRegistry {
+	return &oscoreRegistry{contexts: make(map[string]*session.OSCOREContext)}
+}
+
+func oscoreRegistryKey(kid, kidContext []byte) string {
+	return fmt.Sprintf("%x/%x", kid, kidContext)
+}
+
+func (r *oscoreRegistry) add(ctx *session.OSCOREContext) {
+	r.mx.Lock()
+	r.contexts[oscoreRegistryKey(ctx.RecipientID, ctx.IDContext)] = ctx
+	r.mx.Unlock()
+}
+
+func (r *oscoreRegistry) remove(ctx *session.OSCOREContext) {
+	r.mx.Lock()
+	delete(r.contexts, oscoreRegistryKey(ctx.RecipientID, ctx.IDContext))
+	r.mx.Unlock()
+}
+
+func (r *oscoreRegistry) get(kid, kidContext []byte) *session.OSCOREContext {
+	if r == nil {
+		return nil
+	}
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.contexts[oscoreRegistryKey(kid, kidContext)]
+}
+
+func oscoreExchangeKey(tr *transport, addr string, messageID uint16) string {
+	return fmt.Sprintf("%v%v%v", tr.conn.LocalAddr().String(), addr, messageID)
+}
+
+func oscoreTokenKey(tr *transport, addr string, token []byte) string {
+	return tr.conn.LocalAddr().String() + addr + string(token)
+}
+
+func getOSCOREExchange(tr *transport, addr string, messageID uint16) *oscoreExchange {
+	v, ok := oscoreExchanges.Get(oscoreExchangeKey(tr, addr, messageID))
+	if !ok {
+		return nil
+	}
+	return v.(*oscoreExchange)
+}
+
+func getOSCORETokenContext(tr *transport, addr string, token []byte) *session.OSCOREContext {
+	key := oscoreTokenKey(tr, addr, token)
+	v, ok := oscoreTokens.Get(key)
+	if !ok {
+		return nil
+	}
+	oscoreTokens.SetDefault(key, v)
+	return v.(*session.OSCOREContext)
+}
+
+func bindOSCOREExchange(tr *transport, addr string, message *CoAPMessage, ex *oscoreExchange) {
+	oscoreExchanges.SetDefault(oscoreExchangeKey(tr, addr, message.MessageID), ex)
+	oscoreTokens.SetDefault(oscoreTokenKey(tr, addr, message.Token), ex.context)
+}
+
+// isOSCOREOuterOption reports whether the option stays readable for proxies and
+// the transport layers (class U). All other options are protected (class E).
+func isOSCOREOuterOption(code OptionCode) bool {
+	switch code {
+	case OptionURIHost, OptionURIPort, OptionObserve, OptionProxyURI, OptionProxyScheme,
+		OptionBlock1, OptionBlock2, OptionSize1, OptionSize2, OptionOSCORE,
+		OptionURIScheme, OptionHandshakeType, OptionSessionNotFound, OptionSessionExpired,
+		OptionSelectiveRepeatWindowSize, OptionSelectiveAck, OptionProxySecurityID, OptionСoapsUri:
+		return true
+	default:
+		return false
+	}
+}
+
+func oscoreOutputLayer(tr *transport, message *CoAPMessage, addr net.Addr) error {
+	if message.Code == CoapCodeEmpty {
+		return nil
+	}
+
+	var ex *oscoreExchange
+	ctx := message.OSCOREContext
+	if message.Type == ACK {
+		// ACK is protected only as a response to a protected request
+		ex = getOSCOREExchange(tr, addr.String(), message.MessageID)
+		if ex == nil {
+			return nil
+		}
+		ctx = ex.context
+	} else if ctx == nil {
+		ctx = getOSCORETokenContext(tr, addr.String(), message.Token)
+	}
+	if ctx == nil {
+		return nil
+	}
+
+	inner := &CoAPMessage{Code: message.Code, Payload: message.Payload}
+	var outerOptions []*CoAPMessageOption
+	for _, opt := range message.Options {
+		if isOSCOREOuterOption(opt.Code) {
+			outerOptions = append(outerOptions, opt)
+		} else {
+			inner.Options = append(inner.Options, opt)
+		}
+	}
+
+	data, err := Serialize(inner)
+	if err != nil {
+		return err
+	}
+	plainText := append([]byte{byte(message.Code)}, data[DataTokenStart:]...)
+
+	var partialIV, cipherText []byte
+	if ex != nil {
+		partialIV, cipherText, err = ctx.Seal(plainText, ex.requestKID, ex.requestPIV)
+	} else {
+		partialIV, cipherText, err = ctx.Seal(plainText, nil, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	var kidContext []byte
+	if ex == nil {
+		kidContext = ctx.IDContext
+		bindOSCOREExchange(tr, addr.String(), message, &oscoreExchange{
+			context:    ctx,
+			requestKID: ctx.SenderID,
+			requestPIV: partialIV,
+		})
+	}
+
+	message.Options = outerOptions
+	message.AddOption(OptionOSCORE, session.EncodeOSCOREOption(partialIV, ctx.SenderID, kidContext))
+	if message.Code.IsRegisteredMethod() {
+		message.Code = POST
+	} else {
+		message.Code = CoapCodeChanged
+	}
+	message.Payload = NewBytesPayload(cipherText)
+
+	return nil
+}
+
+func oscoreInputLayer(tr *transport, message *CoAPMessage) (isContinue bool, err error) {
+	addr := message.Sender.String()
+
+	option := message.GetOption(OptionOSCORE)
+	if option == nil {
+		return oscoreUnprotected(tr, message)
+	}
+
+	partialIV, kid, kidContext, err := session.DecodeOSCOREOption([]byte(option.StringValue()))
+	if err != nil {
+		return false, oscoreReject(tr, message, err)
+	}
+
+	var ctx *session.OSCOREContext
+	var requestKID, requestPIV []byte
+	if message.Type == ACK {
+		ex := getOSCOREExchange(tr, addr, message.MessageID)
+		if ex != nil {
+			ctx, requestKID, requestPIV = ex.context, ex.requestKID, ex.requestPIV
+		}
+	} else {
+		ctx = getOSCORETokenContext(tr, addr, message.Token)
+		if ctx == nil && kid != nil {
+			ctx = tr.oscoreContexts.get(kid, kidContext)
+		}
+	}
+	if ctx == nil {
+		return false, oscoreReject(tr, message, ErrorOSCOREContextNotFound)
+	}
+
+	plainText, err := ctx.Open(partialIV, message.Payload.Bytes(), requestKID, requestPIV)
+	if errors.Is(err, session.ErrOSCOREReplay) {
+		return false, oscoreReject(tr, message, err)
+	}
+	if err != nil || len(plainText) == 0 {
+		return false, oscoreReject(tr, message, session.ErrOSCOREDecrypt)
+	}
+
+	// Inner code, options and payload are parsed as a message without token
+	inner, err := Deserialize(append([]byte{1 << 6, plainText[0], 0, 0}, plainText[1:]...))
+	if err != nil {
+		return false, oscoreReject(tr, message, err)
+	}
+
+	if message.Type != ACK {
+		bindOSCOREExchange(tr, addr, message, &oscoreExchange{
+			context:    ctx,
+			requestKID: kid,
+			requestPIV: partialIV,
+		})
+	}
+
+	var options []*CoAPMessageOption
+	for _, opt := range message.Options {
+		if isOSCOREOuterOption(opt.Code) && opt.Code != OptionOSCORE {
+			options = append(options, opt)
+		}
+	}
+	message.Options = append(options, inner.Options...)
+	message.Code = inner.Code
+	message.Payload = inner.Payload
+	message.OSCOREContext = ctx
+
+	return true, nil
+}
+
+// oscoreUnprotected lets through unprotected messages unless they belong to an
+// OSCORE exchange. Error responses, e.g. to a request that failed verification,
+// are never protected, but anyone could have sent them, so they are returned
+// as errors that tell the code instead of a response to the request.
+func oscoreUnprotected(tr *transport, message *CoAPMessage) (isContinue bool, err error) {
+	if message.Code == CoapCodeEmpty {
+		return true, nil
+	}
+
+	addr := message.Sender.String()
+	if message.Type == ACK {
+		if getOSCOREExchange(tr, addr, message.MessageID) == nil {
+			return true, nil
+		}
+		if message.Code >= CoapCodeBadRequest {
+			return false, fmt.Errorf("%w: %v", ErrorOSCOREUnprotected, message.Code)
+		}
+		return false, ErrorOSCOREUnprotected
+	}
+	if getOSCORETokenContext(tr, addr, message.Token) != nil {
+		return false, ErrorOSCOREUnprotected
+	}
+	return true, nil
+}
+
+// oscoreReject answers a confirmable request that can't be verified or is
+// replayed with an unprotected 4.01, as required by RFC 8613.
+func oscoreReject(tr *transport, message *CoAPMessage, err error) error {
+	tr.securityEvent(SecurityEvent{
+		Type:     SecurityEventDecryptFailed,
+		PeerAddr: message.Sender.String(),
+		Err:      err,
+	})
+	if message.Type == CON {
+		// Not even the answer to a replay of a request that was answered is protected
+		oscoreExchanges.Delete(oscoreExchangeKey(tr, message.Sender.String(), message.MessageID))
+
+		responseMessage := NewCoAPMessageId(ACK, CoapCodeUnauthorized, message.MessageID)
+		responseMessage.Payload = NewStringPayload(err.Error())
+		responseMessage.Token = message.Token
+		responseMessage.CloneOptions(message, OptionProxySecurityID)
+		tr.SendTo(responseMessage, message.Sender)
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package coalago
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+func newOSCOREContexts(t *testing.T) (client, server *session.OSCOREContext) {
+	secret, salt := []byte("0123456789abcdef"), []byte("salt")
+	client, err := session.NewOSCOREContext(secret, salt, []byte{0x01}, []byte{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = session.NewOSCOREContext(secret, salt, []byte{}, []byte{0x01}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestOSCORERequest(t *testing.T) {
+	clientContext, serverContext := newOSCOREContexts(t)
+
+	srv := NewServer()
+	srv.AddOSCOREContext(serverContext)
+	srv.AddPOSTResource("/object", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		if message.OSCOREContext == nil {
+			return NewResponse(NewStringPayload("unprotected"), CoapCodeForbidden)
+		}
+		payload := append([]byte(message.GetURIQuery("q")), message.Payload.Bytes()...)
+		return NewResponse(NewBytesPayload(payload), CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12316")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+
+	scheme := COAP_SCHEME
+	send := func(ctx *session.OSCOREContext, payload []byte) (*Response, error) {
+		message := NewCoAPMessage(CON, POST)
+		message.AddOption(OptionURIScheme, scheme)
+		message.SetURIPath("/object")
+		message.SetURIQuery("q", "query")
+		message.Payload = NewBytesPayload(payload)
+		message.OSCOREContext = ctx
+		return client.Send(message, "127.0.0.1:12316")
+	}
+
+	resp, err := send(clientContext, []byte("-payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeContent || string(resp.Body) != "query-payload" {
+		t.Fatalf("unexpected response %v %q", resp.Code, resp.Body)
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), MAX_PAYLOAD_SIZE)
+	resp, err = send(clientContext, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Body, append([]byte("query"), big...)) {
+		t.Fatalf("unexpected response of %d bytes", len(resp.Body))
+	}
+
+	// Object security works inside coaps:// too
+	scheme = COAPS_SCHEME
+	resp, err = send(clientContext, []byte("-payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "query-payload" {
+		t.Fatalf("unexpected response %q", resp.Body)
+	}
+	scheme = COAP_SCHEME
+
+	resp, err = send(nil, []byte("-payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CoapCodeForbidden {
+		t.Fatalf("expected unprotected request to be forbidden, got %v", resp.Code)
+	}
+
+	unknownContext, err := session.NewOSCOREContext([]byte("0123456789abcdef"), nil, []byte{0x02}, []byte{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The unprotected 4.01 is not taken for the response of the peer
+	_, err = send(unknownContext, []byte("-payload"))
+	if !errors.Is(err, ErrorOSCOREUnprotected) || !strings.Contains(err.Error(), CoapCodeUnauthorized.String()) {
+		t.Fatalf("expected unknown context to be unauthorized, got %v", err)
+	}
+
+	// A replayed request is answered with 4.01
+	message := NewCoAPMessage(CON, POST)
+	message.SetURIPath("/object")
+	message.Payload = NewStringPayload("replayed")
+	message.OSCOREContext = clientContext
+	conn, err := net.Dial("udp", "127.0.0.1:12316")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, err := preparationSendingMessage(client.newTransport(&connection{conn: conn.(*net.UDPConn)}), message, conn.RemoteAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes []CoapCode
+	for i := 0; i < 2; i++ {
+		if _, err = conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, MTU)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, err := Deserialize(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, answer.Code)
+	}
+	if codes[0] != CoapCodeChanged || codes[1] != CoapCodeUnauthorized {
+		t.Fatalf("unexpected answers %v to a replayed request", codes)
+	}
+}
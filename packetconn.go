@@ -0,0 +1,189 @@
+package coalago
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Largest message taken from reliable transports, over UDP it is MTU
+const MAX_MESSAGE_SIZE = 1 << 16
+
+var ErrConnClosed = errors.New("use of closed connection")
+
+// PacketConn exchanges whole CoAP messages in their UDP encoding, one per
+// ReadFrom and WriteTo, with the peers of a Transport.
+type PacketConn = net.PacketConn
+
+// Transport carries CoAP messages for clients and servers. Transports whose
+// addresses are not of a "udp" network are reliable: they use lock-step
+// RFC 7959 transfers and may carry BERT blocks.
+type Transport interface {
+	// Listen opens the conn a server receives the messages of all its peers on
+	Listen(addr string) (PacketConn, error)
+	// Dial opens the conn a client exchanges messages with the peer at addr on
+	Dial(addr string) (PacketConn, error)
+	// Resolve returns the address of the peer at addr as the conns report it
+	Resolve(addr string) (net.Addr, error)
+}
+
+type udpTransport struct{}
+
+// UDPTransport is the transport of clients and servers by default.
+var UDPTransport Transport = udpTransport{}
+
+func (udpTransport) Listen(addr string) (PacketConn, error) {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp4", a)
+}
+
+// Dial opens an unconnected socket, so that it also reaches proxies.
+func (udpTransport) Dial(addr string) (PacketConn, error) {
+	return net.ListenUDP("udp4", nil)
+}
+
+func (udpTransport) Resolve(addr string) (net.Addr, error) {
+	return net.ResolveUDPAddr("udp4", addr)
+}
+
+// messageSizeLimit is the size of the largest message taken from a conn.
+func messageSizeLimit(addr net.Addr) int {
+	if isReliableNetwork(addr) {
+		return MAX_MESSAGE_SIZE
+	}
+	return MTU
+}
+
+// packetDialer is the dialer of a server on the conn of a transport.
+type packetDialer struct {
+	conn      PacketConn
+	transport Transport
+}
+
+func newPacketDialer(conn PacketConn, transport Transport) *packetDialer {
+	return &packetDialer{conn: conn, transport: transport}
+}
+
+func (d *packetDialer) Close() error {
+	return d.conn.Close()
+}
+
+func (d *packetDialer) Listen(buff []byte) (int, net.Addr, error) {
+	return d.conn.ReadFrom(buff)
+}
+
+func (d *packetDialer) Read(buff []byte) (int, error) {
+	n, _, err := d.conn.ReadFrom(buff)
+	return n, err
+}
+
+func (d *packetDialer) Write(buf []byte) (int, error) {
+	return 0, ErrNilAddr
+}
+
+func (d *packetDialer) WriteTo(buf []byte, addr string) (int, error) {
+	a, err := d.transport.Resolve(addr)
+	if err != nil {
+		return 0, err
+	}
+	return d.conn.WriteTo(buf, a)
+}
+
+// RemoteAddr is nil like the one of an unconnected UDP socket, which
+// prints as <nil> in errors.
+func (d *packetDialer) RemoteAddr() net.Addr {
+	var addr *net.UDPAddr
+	return addr
+}
+
+func (d *packetDialer) LocalAddr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+func (d *packetDialer) SetReadDeadline() {
+	d.conn.SetReadDeadline(time.Now().Add(timeWait))
+}
+
+type queuedPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// packetQueue holds the messages received by the conns of transports that
+// are not sockets, until ReadFrom takes them.
+type packetQueue struct {
+	input  chan queuedPacket
+	closed chan struct{}
+	once   sync.Once
+
+	mx       sync.Mutex
+	deadline time.Time
+}
+
+func newPacketQueue() packetQueue {
+	return packetQueue{
+		input:  make(chan queuedPacket, 4*DEFAULT_WINDOW_SIZE),
+		closed: make(chan struct{}),
+	}
+}
+
+// push waits while the queue is full, false when it is closed.
+func (q *packetQueue) push(p queuedPacket) bool {
+	select {
+	case q.input <- p:
+		return true
+	case <-q.closed:
+		return false
+	}
+}
+
+// close tells if the queue was open.
+func (q *packetQueue) close() bool {
+	open := false
+	q.once.Do(func() {
+		open = true
+		close(q.closed)
+	})
+	return open
+}
+
+func (q *packetQueue) ReadFrom(buf []byte) (int, net.Addr, error) {
+	q.mx.Lock()
+	deadline := q.deadline
+	q.mx.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-q.input:
+		return copy(buf, p.data), p.from, nil
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	case <-q.closed:
+		return 0, nil, ErrConnClosed
+	}
+}
+
+func (q *packetQueue) SetDeadline(t time.Time) error {
+	return q.SetReadDeadline(t)
+}
+
+func (q *packetQueue) SetReadDeadline(t time.Time) error {
+	q.mx.Lock()
+	q.deadline = t
+	q.mx.Unlock()
+	return nil
+}
+
+func (q *packetQueue) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package coalago
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// PeerInfo describes the peer that sent an incoming message and the session
+// the message was received in. Session fields are empty for coap:// messages.
+type PeerInfo struct {
+	Addr   net.Addr
+	Scheme int
+
+	PublicKey []byte
+	// Ed25519 identity verified during the handshake, if the peer has one
+	Identity         ed25519.PublicKey
+	SessionID        string
+	SessionCreatedAt time.Time
+	CipherSuite      session.CipherSuite
+
+	// ViaProxy is set when the message was forwarded by a proxy,
+	// ProxySecurityID then tells the clients behind this proxy apart.
+	ViaProxy        bool
+	ProxySecurityID uint32
+}
+
+func newPeerInfo(message *CoAPMessage) *PeerInfo {
+	info := &PeerInfo{
+		Addr:   message.Sender,
+		Scheme: message.GetScheme(),
+	}
+	if option := message.GetOption(OptionProxySecurityID); option != nil {
+		info.ViaProxy = true
+		info.ProxySecurityID = option.Uint32Value()
+	}
+	return info
+}
+
+func (info *PeerInfo) setSession(ses session.SecuredSession) {
+	info.PublicKey = ses.PeerPublicKey
+	info.Identity = ses.PeerIdentity
+	info.SessionID = hex.EncodeToString(ses.ID)
+	info.SessionCreatedAt = ses.CreatedAt
+	if ses.AEAD != nil {
+		info.CipherSuite = ses.AEAD.Suite()
+	}
+}
+
+// SessionAge returns how long ago the session of the message was established.
+func (info *PeerInfo) SessionAge() time.Duration {
+	if info.SessionCreatedAt.IsZero() {
+		return 0
+	}
+	return time.Since(info.SessionCreatedAt)
+}
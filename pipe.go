@@ -0,0 +1,90 @@
+package coalago
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// PipeTransport carries messages between the clients and servers of one
+// process in memory, without losing or reordering them. Its addresses are
+// names; clients get names of their own.
+type PipeTransport struct {
+	mx    sync.Mutex
+	conns map[string]*pipeConn
+	dials int
+}
+
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{conns: make(map[string]*pipeConn)}
+}
+
+func (t *PipeTransport) open(addr string) (*pipeConn, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if _, ok := t.conns[addr]; ok {
+		return nil, fmt.Errorf("pipe %s is already open", addr)
+	}
+	c := &pipeConn{transport: t, addr: pipeAddr(addr), packetQueue: newPacketQueue()}
+	t.conns[addr] = c
+	return c, nil
+}
+
+func (t *PipeTransport) Listen(addr string) (PacketConn, error) {
+	return t.open(addr)
+}
+
+func (t *PipeTransport) Dial(addr string) (PacketConn, error) {
+	t.mx.Lock()
+	t.dials++
+	name := fmt.Sprintf("pipe-%d", t.dials)
+	t.mx.Unlock()
+	return t.open(name)
+}
+
+func (t *PipeTransport) Resolve(addr string) (net.Addr, error) {
+	return pipeAddr(addr), nil
+}
+
+func (t *PipeTransport) conn(addr string) *pipeConn {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.conns[addr]
+}
+
+type pipeConn struct {
+	packetQueue
+	transport *PipeTransport
+	addr      pipeAddr
+}
+
+// WriteTo waits while the peer is not reading, like a full socket buffer.
+func (c *pipeConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	peer := c.transport.conn(addr.String())
+	if peer == nil {
+		return 0, fmt.Errorf("pipe %s is not open", addr)
+	}
+	if !peer.push(queuedPacket{data: append([]byte{}, buf...), from: c.addr}) {
+		return 0, ErrConnClosed
+	}
+	return len(buf), nil
+}
+
+func (c *pipeConn) Close() error {
+	if c.close() {
+		c.transport.mx.Lock()
+		delete(c.transport.conns, string(c.addr))
+		c.transport.mx.Unlock()
+	}
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.addr
+}
@@ -0,0 +1,173 @@
+package coalago
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+// RekeyPolicy limits how much is protected under the keys of one coaps:// session,
+// counting the messages of both directions. When any limit is reached the
+// client runs a new handshake in the background and goes on with the old keys
+// until it is done; a server asks the client to do so in its responses.
+// A zero limit is not checked.
+type RekeyPolicy struct {
+	MaxMessages int64
+	MaxBytes    int64
+	MaxAge      time.Duration
+}
+
+// Message ID is used as AEAD counter, so keys must be changed long before it wraps around
+var DefaultRekeyPolicy = RekeyPolicy{
+	MaxMessages: 30000,
+	MaxBytes:    1 << 30,
+	MaxAge:      time.Hour,
+}
+
+func (p RekeyPolicy) isDue(ses session.SecuredSession) bool {
+	if ses.Restored {
+		return true
+	}
+	if p.MaxAge > 0 && time.Since(ses.CreatedAt) >= p.MaxAge {
+		return true
+	}
+	if ses.Usage == nil {
+		return false
+	}
+	if ses.Usage.RekeyRequested() {
+		return true
+	}
+	if p.MaxMessages > 0 && ses.Usage.Messages() >= p.MaxMessages {
+		return true
+	}
+	if p.MaxBytes > 0 && ses.Usage.Bytes() >= p.MaxBytes {
+		return true
+	}
+	return false
+}
+
+// pinSession makes every message of the transfer with the message's token
+// use the current session, even if the session is rekeyed meanwhile.
+func (tr *transport) pinSession(message *CoAPMessage, addr net.Addr) (unpin func()) {
+	if message.GetScheme() != COAPS_SCHEME {
+		return func() {}
+	}
+
+	ses, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), addr.String(), sessionProxyAddr(tr, message))
+	if !ok {
+		return func() {}
+	}
+
+	id := addr.String() + message.GetTokenString()
+	tr.pinnedSessions.Store(id, ses)
+	return func() {
+		tr.pinnedSessions.Delete(id)
+	}
+}
+
+func (tr *transport) getPinnedSession(message *CoAPMessage, addr net.Addr) (session.SecuredSession, bool) {
+	v, ok := tr.pinnedSessions.Load(addr.String() + message.GetTokenString())
+	if !ok {
+		return session.SecuredSession{}, false
+	}
+	return v.(session.SecuredSession), true
+}
+
+// decryptWithSession decrypts the message with the current session, or with the
+// previous one if the message belongs to a transfer that started before a rekey.
+func decryptWithSession(tr *transport, message *CoAPMessage, currentSession session.SecuredSession, senderAddr, receiverAddr, proxyAddr string) (session.SecuredSession, error) {
+	err := decrypt(message, currentSession.AEAD)
+	if err == nil {
+		return currentSession, nil
+	}
+
+	previousSession, ok := tr.previousSessions.Get(senderAddr, receiverAddr, proxyAddr)
+	if !ok {
+		return currentSession, err
+	}
+	if decrypt(message, previousSession.AEAD) != nil {
+		return currentSession, err
+	}
+	return previousSession, nil
+}
+
+// rekeyer runs the background rekeys of the sessions of a client, one at a
+// time per session.
+type rekeyer struct {
+	client *Client
+
+	mx      sync.Mutex
+	running map[string]chan struct{}
+}
+
+func newRekeyer(client *Client) *rekeyer {
+	return &rekeyer{client: client, running: make(map[string]chan struct{})}
+}
+
+// redialer is a dialer that opens another connection on its socket, so that
+// a background handshake outlives the request that started it.
+type redialer interface {
+	redial() (dialer, bool)
+}
+
+// rekey renews the session in the background, the old one stays valid
+// meanwhile. Connections that cannot be shared rekey on the request path.
+func (r *rekeyer) rekey(tr *transport, message *CoAPMessage, address net.Addr, proxyAddr string) {
+	c, ok := tr.conn.(redialer)
+	if r == nil || !ok {
+		if _, err := newHandshake(tr, message, address, proxyAddr); err == nil {
+			MetricSessionRekeys.Inc()
+		}
+		return
+	}
+
+	key := sessionKey(tr.conn.LocalAddr().String(), address.String(), proxyAddr)
+	r.mx.Lock()
+	if _, ok := r.running[key]; ok {
+		r.mx.Unlock()
+		return
+	}
+	conn, ok := c.redial()
+	if !ok {
+		r.mx.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	r.running[key] = done
+	r.mx.Unlock()
+
+	// The request goes on with the message meanwhile
+	message = message.Clone(false)
+	message.Options = append([]*CoAPMessageOption{}, message.Options...)
+
+	go func() {
+		defer func() {
+			r.mx.Lock()
+			delete(r.running, key)
+			r.mx.Unlock()
+			close(done)
+		}()
+		defer conn.Close()
+
+		if _, err := newHandshake(r.client.newTransport(conn), message, address, proxyAddr); err == nil {
+			MetricSessionRekeys.Inc()
+		}
+	}()
+}
+
+// wait waits for the background rekey of the session to end, it tells
+// false when none is running.
+func (r *rekeyer) wait(senderAddr, receiverAddr, proxyAddr string) bool {
+	if r == nil {
+		return false
+	}
+	r.mx.Lock()
+	done, ok := r.running[sessionKey(senderAddr, receiverAddr, proxyAddr)]
+	r.mx.Unlock()
+	if ok {
+		<-done
+	}
+	return ok
+}
@@ -13,7 +13,8 @@ type CoAPResource struct {
 	Path       string
 	Handler    CoAPResourceHandler
 	MediaTypes []MediaType
-	Hash       string // Unique Resource ID
+	Hash       string          // Unique Resource ID
+	Policy     *ResourcePolicy // Read by Server.AddResource
 }
 
 type CoAPResourceHandler func(message *CoAPMessage) *CoAPResourceHandlerResult
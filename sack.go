@@ -0,0 +1,135 @@
+package coalago
+
+import (
+	"time"
+)
+
+// A selective ACK holds the number of the first missing block in 3 bytes,
+// followed by a bitmap of the blocks after it, the most significant bit of
+// the first byte being the missing block itself. Blocks before the first
+// missing one are all received.
+const (
+	SACK_BASE_SIZE  = 3
+	SACK_MAX_BLOCKS = 256
+
+	// A hole is taken for a loss, not a reordering, once this many
+	// blocks after it were received
+	SACK_REORDER_THRESHOLD = 3
+)
+
+// encodeSelectiveAck returns nil while the blocks were received in order.
+func encodeSelectiveAck(buf map[int][]byte) []byte {
+	base := 0
+	for {
+		if _, ok := buf[base]; !ok {
+			break
+		}
+		base++
+	}
+
+	highest := -1
+	for n := range buf {
+		if n > highest {
+			highest = n
+		}
+	}
+	if highest < base {
+		return nil
+	}
+
+	count := highest - base + 1
+	if count > SACK_MAX_BLOCKS {
+		count = SACK_MAX_BLOCKS
+	}
+
+	value := make([]byte, SACK_BASE_SIZE+(count+7)/8)
+	value[0] = byte(base >> 16)
+	value[1] = byte(base >> 8)
+	value[2] = byte(base)
+	for i := 0; i < count; i++ {
+		if _, ok := buf[base+i]; ok {
+			value[SACK_BASE_SIZE+i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return value
+}
+
+func decodeSelectiveAck(option *CoAPMessageOption) (base int, bitmap []byte, ok bool) {
+	var value []byte
+	switch v := option.Value.(type) {
+	case string:
+		value = []byte(v)
+	case []byte:
+		value = v
+	}
+	if len(value) < SACK_BASE_SIZE {
+		return 0, nil, false
+	}
+	base = int(value[0])<<16 | int(value[1])<<8 | int(value[2])
+	return base, value[SACK_BASE_SIZE:], true
+}
+
+// selectiveAck marks the blocks the receiver reported and returns the
+// missing ones that should be retransmitted right away. Every block is
+// retransmitted this way once, further losses are left to the timeout.
+// The window is shrunk once for all blocks sent before the first loss.
+func selectiveAck(packets []*packet, resp *CoAPMessage, w *window) []*packet {
+	option := resp.GetOption(OptionSelectiveAck)
+	if option == nil {
+		return nil
+	}
+	base, bitmap, ok := decodeSelectiveAck(option)
+	if !ok {
+		return nil
+	}
+
+	for i := 0; i < base && i < len(packets); i++ {
+		packets[i].acked = true
+	}
+
+	highest := -1
+	for i := 0; i < len(bitmap)*8 && base+i < len(packets); i++ {
+		if bitmap[i/8]&(0x80>>uint(i%8)) != 0 {
+			packets[base+i].acked = true
+			highest = base + i
+		}
+	}
+
+	highestSent := highest
+	for i := highest + 1; i < len(packets) && packets[i].attempts > 0; i++ {
+		highestSent = i
+	}
+
+	var missing []*packet
+	first := -1
+	received := 0
+	for i := highest; i >= base; i-- {
+		p := packets[i]
+		if p.acked {
+			received++
+			continue
+		}
+		if received < SACK_REORDER_THRESHOLD || p.fastRetransmitted || p.attempts == 0 || p.attempts == maxSendAttempts {
+			continue
+		}
+		p.fastRetransmitted = true
+		missing = append([]*packet{p}, missing...)
+		first = i
+	}
+	if first >= 0 {
+		w.loss(first, highestSent)
+	}
+	return missing
+}
+
+func retransmitPackets(missing []*packet, send func(*CoAPMessage) error) error {
+	for _, p := range missing {
+		MetricRetransmitMessages.Inc()
+		p.attempts++
+		p.lastSend = time.Now()
+		if err := send(p.message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
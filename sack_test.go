@@ -0,0 +1,68 @@
+package coalago
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectiveAckEncoding(t *testing.T) {
+	if encodeSelectiveAck(map[int][]byte{0: nil, 1: nil}) != nil {
+		t.Fatal("in order blocks must not be acknowledged selectively")
+	}
+
+	buf := map[int][]byte{0: nil, 1: nil, 3: nil, 5: nil, 12: nil}
+	value := encodeSelectiveAck(buf)
+	base, bitmap, ok := decodeSelectiveAck(NewOption(OptionSelectiveAck, string(value)))
+	if !ok || base != 2 {
+		t.Fatalf("unexpected base %d", base)
+	}
+	for i := 0; i < len(bitmap)*8; i++ {
+		_, received := buf[base+i]
+		if marked := bitmap[i/8]&(0x80>>uint(i%8)) != 0; marked != received {
+			t.Fatalf("block %d: marked %v, received %v", base+i, marked, received)
+		}
+	}
+}
+
+func TestSelectiveAckRetransmission(t *testing.T) {
+	packets := make([]*packet, 10)
+	for i := range packets {
+		packets[i] = &packet{message: NewCoAPMessage(CON, POST)}
+		if i < 8 {
+			packets[i].attempts = 1
+			packets[i].lastSend = time.Now()
+		}
+	}
+
+	ack := func(buf map[int][]byte) *CoAPMessage {
+		resp := NewCoAPMessage(ACK, CoapCodeContinue)
+		resp.AddOption(OptionSelectiveAck, encodeSelectiveAck(buf))
+		return resp
+	}
+
+	w := newWindow(WindowPolicy{Initial: 8, Min: 1, Max: 16}, len(packets))
+
+	// Block 2 is only reordered while too few blocks after it arrived
+	missing := selectiveAck(packets, ack(map[int][]byte{0: nil, 1: nil, 3: nil, 4: nil}), w)
+	if len(missing) != 0 || w.size() != 8 {
+		t.Fatalf("unexpected retransmission of %d blocks, window %d", len(missing), w.size())
+	}
+	if !packets[0].acked || !packets[1].acked || packets[2].acked || !packets[4].acked {
+		t.Fatal("reported blocks are not acknowledged")
+	}
+
+	missing = selectiveAck(packets, ack(map[int][]byte{0: nil, 1: nil, 3: nil, 4: nil, 6: nil, 7: nil}), w)
+	// Block 5 has not enough blocks after it yet
+	if len(missing) != 1 || missing[0] != packets[2] {
+		t.Fatalf("unexpected missing blocks %v", missing)
+	}
+	if w.size() != 4 {
+		t.Fatalf("window is not halved once: %d", w.size())
+	}
+
+	// Holes are retransmitted right away only once
+	missing = selectiveAck(packets, ack(map[int][]byte{0: nil, 1: nil, 3: nil, 4: nil, 6: nil, 7: nil}), w)
+	if len(missing) != 0 || w.size() != 4 {
+		t.Fatalf("unexpected retransmission of %d blocks, window %d", len(missing), w.size())
+	}
+}
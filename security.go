@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/coalalib/coalago/session"
+	"github.com/patrickmn/go-cache"
 )
 
 var (
@@ -15,31 +17,47 @@ var (
 )
 
 func securityOutputLayer(tr *transport, message *CoAPMessage, addr net.Addr) error {
+	if err := oscoreOutputLayer(tr, message, addr); err != nil {
+		return err
+	}
+
 	if message.GetScheme() != COAPS_SCHEME {
 		return nil
 	}
 
 	setProxyIDIfNeed(message, tr.conn.LocalAddr().String())
 
-	proxyAddr := message.ProxyAddr
-	if len(proxyAddr) > 0 {
-		proxyID, ok := getProxyIDIfNeed(proxyAddr, tr.conn.LocalAddr().String())
-		if ok {
-			proxyAddr = fmt.Sprintf("%v%v", proxyAddr, proxyID)
-		}
+	currentSession, ok := tr.getPinnedSession(message, addr)
+	if !ok {
+		currentSession, ok = getSessionForAddress(tr, tr.conn.LocalAddr().String(), addr.String(), sessionProxyAddr(tr, message))
 	}
-
-	currentSession, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), addr.String(), proxyAddr)
 	if !ok {
 		return ErrorClientSessionNotFound
 	}
 
+	// Servers cannot rekey, they ask their clients to
+	if tr.rekeys == nil && message.Type == ACK && tr.rekeyPolicy.isDue(currentSession) {
+		message.AddOption(OptionSessionRekey, 1)
+	}
+
 	if err := encrypt(message, addr, currentSession.AEAD); err != nil {
 		return err
 	}
+	currentSession.Usage.Add(message.Payload.Length())
 	return nil
 }
 
+func sessionProxyAddr(tr *transport, message *CoAPMessage) string {
+	proxyAddr := message.ProxyAddr
+	if len(proxyAddr) > 0 {
+		proxyID, ok := getProxyIDIfNeed(proxyAddr, tr.conn.LocalAddr().String())
+		if ok {
+			proxyAddr = fmt.Sprintf("%v%v", proxyAddr, proxyID)
+		}
+	}
+	return proxyAddr
+}
+
 func setProxyIDIfNeed(message *CoAPMessage, senderAddr string) uint32 {
 	if message.GetOption(OptionProxyURI) != nil {
 		v, ok := proxyIDSessions.Get(message.ProxyAddr + senderAddr)
@@ -62,21 +80,46 @@ func getProxyIDIfNeed(proxyAddr string, senderAddr string) (uint32, bool) {
 }
 
 func getSessionForAddress(tr *transport, senderAddr, receiverAddr, proxyAddr string) (session.SecuredSession, bool) {
-	securedSession, ok := globalSessions.Get(senderAddr, receiverAddr, proxyAddr)
+	securedSession, ok := tr.sessions.Get(senderAddr, receiverAddr, proxyAddr)
 	if ok {
-		globalSessions.Set(senderAddr, receiverAddr, proxyAddr, securedSession)
+		tr.sessions.Set(senderAddr, receiverAddr, proxyAddr, securedSession)
 	}
 	return securedSession, ok
 }
 
-func setSessionForAddress(privatekey []byte, securedSession session.SecuredSession, senderAddr, receiverAddr, proxyAddr string) {
-	globalSessions.Set(senderAddr, receiverAddr, proxyAddr, securedSession)
+func setSessionForAddress(tr *transport, securedSession session.SecuredSession, senderAddr, receiverAddr, proxyAddr string) {
+	if previousSession, ok := tr.sessions.Get(senderAddr, receiverAddr, proxyAddr); ok {
+		tr.previousSessions.Set(senderAddr, receiverAddr, proxyAddr, previousSession)
+	}
+	tr.sessions.Set(senderAddr, receiverAddr, proxyAddr, securedSession)
 	MetricSessionsRate.Inc()
-	MetricSessionsCount.Set(int64(globalSessions.ItemCount()))
+	MetricSessionsCount.Set(int64(tr.sessions.ItemCount()))
+
+	tr.securityEvent(SecurityEvent{
+		Type:          SecurityEventSessionCreated,
+		PeerAddr:      receiverAddr,
+		ProxyAddr:     proxyAddr,
+		PeerPublicKey: securedSession.PeerPublicKey,
+		PeerIdentity:  securedSession.PeerIdentity,
+	})
 }
 
-func deleteSessionForAddress(senderAddr, receiverAddr, proxyAddr string) {
-	globalSessions.Delete(senderAddr, receiverAddr, proxyAddr)
+// deleteSessionForAddress drops the session because of reason.
+func deleteSessionForAddress(tr *transport, senderAddr, receiverAddr, proxyAddr string, reason error) {
+	deletedSession, ok := tr.sessions.Get(senderAddr, receiverAddr, proxyAddr)
+	tr.sessions.Delete(senderAddr, receiverAddr, proxyAddr)
+	tr.previousSessions.Delete(senderAddr, receiverAddr, proxyAddr)
+
+	if ok {
+		tr.securityEvent(SecurityEvent{
+			Type:          SecurityEventSessionDeleted,
+			PeerAddr:      receiverAddr,
+			ProxyAddr:     proxyAddr,
+			PeerPublicKey: deletedSession.PeerPublicKey,
+			PeerIdentity:  deletedSession.PeerIdentity,
+			Err:           reason,
+		})
+	}
 }
 
 var (
@@ -85,8 +128,30 @@ var (
 	ErrorSessionExpired        error = errors.New("session expired")
 	ErrorClientSessionExpired  error = errors.New("client session expired")
 	ErrorHandshake             error = errors.New("error handshake")
+	ErrorHandshakeSignature    error = errors.New("handshake signature verification failed")
+	ErrorKeysNotMatch          error = errors.New(ERR_KEYS_NOT_MATCH)
+	ErrorCoapsURIMissing       error = errors.New("coaps request without encrypted URI")
 )
 
+// rejectUndecryptable reports a message the session could not decrypt,
+// deletes the session and tells the peer that it has expired.
+func rejectUndecryptable(tr *transport, message *CoAPMessage, ses session.SecuredSession, addressSession, proxyAddr string, err error) error {
+	tr.securityEvent(SecurityEvent{
+		Type:          SecurityEventDecryptFailed,
+		PeerAddr:      addressSession,
+		ProxyAddr:     proxyAddr,
+		PeerPublicKey: ses.PeerPublicKey,
+		PeerIdentity:  ses.PeerIdentity,
+		Err:           err,
+	})
+	deleteSessionForAddress(tr, tr.conn.LocalAddr().String(), addressSession, proxyAddr, err)
+	responseMessage := NewCoAPMessageId(ACK, CoapCodeUnauthorized, message.MessageID)
+	responseMessage.AddOption(OptionSessionExpired, 1)
+	responseMessage.Token = message.Token
+	tr.SendTo(responseMessage, message.Sender)
+	return ErrorClientSessionExpired
+}
+
 func securityInputLayer(tr *transport, message *CoAPMessage, proxyAddr string) (isContinue bool, err error) {
 	if len(proxyAddr) > 0 {
 		proxyID, ok := getProxyIDIfNeed(proxyAddr, tr.conn.LocalAddr().String())
@@ -99,6 +164,8 @@ func securityInputLayer(tr *transport, message *CoAPMessage, proxyAddr string) (
 		return false, err
 	}
 
+	message.PeerInfo = newPeerInfo(message)
+
 	// Check if the message has coaps:// scheme and requires a new Session
 	if message.GetScheme() == COAPS_SCHEME {
 		var addressSession string
@@ -115,18 +182,30 @@ func securityInputLayer(tr *transport, message *CoAPMessage, proxyAddr string) (
 			return false, ErrorClientSessionNotFound
 		}
 
-		// Decrypt message payload
-		err := decrypt(message, currentSession.AEAD)
+		// Decrypt message payload. The peer may already use the keys of a
+		// rekey that has not ended here yet.
+		currentSession, err := decryptWithSession(tr, message, currentSession, tr.conn.LocalAddr().String(), addressSession, proxyAddr)
+		if err != nil && tr.rekeys.wait(tr.conn.LocalAddr().String(), addressSession, proxyAddr) {
+			if rekeyed, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), addressSession, proxyAddr); ok {
+				currentSession, err = decryptWithSession(tr, message, rekeyed, tr.conn.LocalAddr().String(), addressSession, proxyAddr)
+			}
+		}
 		if err != nil {
-			deleteSessionForAddress(tr.conn.LocalAddr().String(), addressSession, proxyAddr)
-			responseMessage := NewCoAPMessageId(ACK, CoapCodeUnauthorized, message.MessageID)
-			responseMessage.AddOption(OptionSessionExpired, 1)
-			responseMessage.Token = message.Token
-			tr.SendTo(responseMessage, message.Sender)
-			return false, ErrorClientSessionExpired
+			return false, rejectUndecryptable(tr, message, currentSession, addressSession, proxyAddr, err)
+		}
+
+		currentSession.Usage.Add(message.Payload.Length())
+		if message.GetOption(OptionSessionRekey) != nil {
+			currentSession.Usage.RequestRekey()
 		}
 
 		message.PeerPublicKey = currentSession.PeerPublicKey
+		message.PeerIdentity = currentSession.PeerIdentity
+		message.PeerInfo.setSession(currentSession)
+	}
+
+	if ok, err := oscoreInputLayer(tr, message); !ok {
+		return false, err
 	}
 
 	/* Receive Errors */
@@ -134,11 +213,11 @@ func securityInputLayer(tr *transport, message *CoAPMessage, proxyAddr string) (
 	sessionExpired := message.GetOption(OptionSessionExpired)
 	if message.Code == CoapCodeUnauthorized {
 		if sessionNotFound != nil {
-			deleteSessionForAddress(tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+			deleteSessionForAddress(tr, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr, ErrorSessionNotFound)
 			return false, ErrorSessionNotFound
 		}
 		if sessionExpired != nil {
-			deleteSessionForAddress(tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+			deleteSessionForAddress(tr, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr, ErrorSessionExpired)
 			return false, ErrorSessionExpired
 		}
 	}
@@ -155,37 +234,150 @@ func receiveHandshake(tr *transport, privatekey []byte, message *CoAPMessage, pr
 		return true, nil
 	}
 
-	value := option.IntValue()
-	if value != CoapHandshakeTypeClientSignature && value != CoapHandshakeTypeClientHello {
+	switch option.IntValue() {
+	case CoapHandshakeTypeClientHello:
+		return false, receiveClientHello(tr, message, proxyAddr)
+	case CoapHandshakeTypeClientSignature:
+		return false, receiveClientSignature(tr, message, proxyAddr)
+	default:
 		return false, nil
 	}
+}
 
-	peerSession, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
-	if !ok {
-		if peerSession, err = session.NewSecuredSession(tr.privateKey); err != nil {
-			return false, ErrorHandshake
-		}
+func receiveClientHello(tr *transport, message *CoAPMessage, proxyAddr string) error {
+	if message.Payload == nil {
+		return ErrorHandshake
 	}
-	if value == CoapHandshakeTypeClientHello && message.Payload != nil {
-		peerSession.PeerPublicKey = message.Payload.Bytes()
 
-		if err := incomingHandshake(tr, peerSession.Curve.GetPublicKey(), message); err != nil {
-			return false, ErrorHandshake
-		}
-		if signature, err := peerSession.GetSignature(); err == nil {
-			if err = peerSession.PeerVerify(signature); err != nil {
-				return false, ErrorHandshake
-			}
-		}
+	peerSession, err := newSecuredSession(tr)
+	if err != nil {
+		return ErrorHandshake
+	}
+	if err = peerSession.ReceiveClientHello(message.Payload.Bytes()); err != nil {
+		tr.securityEvent(SecurityEvent{
+			Type:      SecurityEventHandshakeFailed,
+			PeerAddr:  message.Sender.String(),
+			ProxyAddr: proxyAddr,
+			Err:       err,
+		})
+		responseMessage := newServerHelloMessage(message, nil)
+		responseMessage.Code = CoapCodeNotAcceptable
+		incomingHandshake(tr, responseMessage, message.Sender)
+		return ErrorHandshake
+	}
 
-		MetricSuccessfulHandhshakes.Inc()
+	// The session stays pending until the client proves it has derived the same keys
+	tr.handshakes.pending.Set(tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr, peerSession)
 
-		peerSession.UpdatedAt = int(time.Now().Unix())
-		setSessionForAddress(privatekey, peerSession, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
-		return false, nil
+	if err := incomingHandshake(tr, newServerHelloMessage(message, peerSession.PeerHello()), message.Sender); err != nil {
+		return ErrorHandshake
+	}
+
+	return nil
+}
+
+// handshakeState is the server side of handshakes: the sessions waiting for
+// a ClientSignature and the answers to ClientSignatures, sent again to
+// retransmissions whose PeerSignature was lost.
+type handshakeState struct {
+	pending *sessionStorageImpl
+	answers *cache.Cache
+}
+
+func newHandshakeState() *handshakeState {
+	return &handshakeState{
+		pending: newSessionStorageImpl(false),
+		answers: cache.New(sumTimeAttempts, time.Second),
+	}
+}
+
+func clientSignatureKey(message *CoAPMessage, proxyAddr string) string {
+	return message.Sender.String() + proxyAddr + "/" + strconv.Itoa(int(message.MessageID))
+}
+
+// answerClientSignature sends the PeerSignature and keeps it for retransmissions.
+func answerClientSignature(tr *transport, message *CoAPMessage, proxyAddr string, answer *CoAPMessage) error {
+	tr.handshakes.answers.SetDefault(clientSignatureKey(message, proxyAddr), answer)
+	return incomingHandshake(tr, answer, message.Sender)
+}
+
+func receiveClientSignature(tr *transport, message *CoAPMessage, proxyAddr string) error {
+	if answer, ok := tr.handshakes.answers.Get(clientSignatureKey(message, proxyAddr)); ok {
+		return incomingHandshake(tr, answer.(*CoAPMessage), message.Sender)
+	}
+
+	peerSession, ok := tr.handshakes.pending.Get(tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+	if !ok {
+		responseMessage := NewCoAPMessageId(ACK, CoapCodeUnauthorized, message.MessageID)
+		responseMessage.AddOption(OptionSessionNotFound, 1)
+		responseMessage.Token = message.Token
+		tr.SendTo(responseMessage, message.Sender)
+		tr.securityEvent(SecurityEvent{
+			Type:      SecurityEventHandshakeFailed,
+			PeerAddr:  message.Sender.String(),
+			ProxyAddr: proxyAddr,
+			Err:       ErrorSessionNotFound,
+		})
+		return ErrorHandshake
 	}
+	tr.handshakes.pending.Delete(tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+
+	if err := peerSession.VerifyClientSignature(message.Payload.Bytes()); err != nil {
+		answerClientSignature(tr, message, proxyAddr, newServerSignatureMessage(message, nil))
+		tr.securityEvent(SecurityEvent{
+			Type:          SecurityEventHandshakeFailed,
+			PeerAddr:      message.Sender.String(),
+			ProxyAddr:     proxyAddr,
+			PeerPublicKey: peerSession.PeerPublicKey,
+			Err:           ErrorHandshakeSignature,
+		})
+		return ErrorHandshakeSignature
+	}
+
+	if err := tr.peerIdentity.check(peerSession.PeerIdentity); err != nil {
+		answerClientSignature(tr, message, proxyAddr, newServerSignatureMessage(message, nil))
+		tr.securityEvent(SecurityEvent{
+			Type:          SecurityEventPeerRejected,
+			PeerAddr:      message.Sender.String(),
+			ProxyAddr:     proxyAddr,
+			PeerPublicKey: peerSession.PeerPublicKey,
+			PeerIdentity:  peerSession.PeerIdentity,
+			Err:           err,
+		})
+		return err
+	}
+
+	if err := answerClientSignature(tr, message, proxyAddr, newServerSignatureMessage(message, peerSession.PeerSignature())); err != nil {
+		return ErrorHandshake
+	}
+
+	MetricSuccessfulHandhshakes.Inc()
+	tr.securityEvent(SecurityEvent{
+		Type:          SecurityEventHandshakeSucceeded,
+		PeerAddr:      message.Sender.String(),
+		ProxyAddr:     proxyAddr,
+		PeerPublicKey: peerSession.PeerPublicKey,
+		PeerIdentity:  peerSession.PeerIdentity,
+	})
+
+	peerSession.UpdatedAt = int(time.Now().Unix())
+	setSessionForAddress(tr, peerSession, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+	return nil
+}
 
-	return false, ErrorHandshake
+func newSecuredSession(tr *transport) (ses session.SecuredSession, err error) {
+	if tr.identity != nil {
+		ses, err = session.NewSecuredSessionWithIdentity(*tr.identity)
+	} else {
+		ses, err = session.NewSecuredSession(tr.privateKey)
+	}
+	if err != nil {
+		return ses, err
+	}
+	if len(tr.cipherSuites) > 0 {
+		ses.CipherSuites = tr.cipherSuites
+	}
+	return ses, nil
 }
 
 const (
@@ -193,46 +385,107 @@ const (
 )
 
 func handshake(tr *transport, message *CoAPMessage, address net.Addr, proxyAddr string) (session.SecuredSession, error) {
-	ses, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), address.String(), proxyAddr)
+	currentSession, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), address.String(), proxyAddr)
+	if ok && currentSession.Restored {
+		// Message IDs, the AEAD nonces, start anew after a restart, so the
+		// keys of a restored session must not seal messages again
+		return newHandshake(tr, message, address, proxyAddr)
+	}
 	if ok {
-		return ses, nil
-
+		// Transfers in flight and the requests sent until the rekey is done
+		// keep the old keys. If the rekey fails the old session is still
+		// valid for the peer.
+		if tr.rekeyPolicy.isDue(currentSession) {
+			tr.rekeys.rekey(tr, message, address, proxyAddr)
+			if ses, ok := getSessionForAddress(tr, tr.conn.LocalAddr().String(), address.String(), proxyAddr); ok {
+				return ses, nil
+			}
+		}
+		return currentSession, nil
 	}
 
-	ses, err := session.NewSecuredSession(tr.privateKey)
+	return newHandshake(tr, message, address, proxyAddr)
+}
+
+func newHandshake(tr *transport, message *CoAPMessage, address net.Addr, proxyAddr string) (_ session.SecuredSession, err error) {
+	var ses session.SecuredSession
+	defer func() {
+		if err == nil {
+			return
+		}
+		event := SecurityEvent{
+			Type:          SecurityEventHandshakeFailed,
+			PeerAddr:      address.String(),
+			ProxyAddr:     proxyAddr,
+			PeerPublicKey: ses.PeerPublicKey,
+			PeerIdentity:  ses.PeerIdentity,
+			Err:           err,
+		}
+		if errors.Is(err, ErrorKeysNotMatch) || errors.Is(err, ErrorPeerIdentityRequired) || errors.Is(err, ErrorPeerIdentityRejected) {
+			event.Type = SecurityEventPeerRejected
+		}
+		tr.securityEvent(event)
+	}()
+
+	ses, err = newSecuredSession(tr)
 	if err != nil {
 		return session.SecuredSession{}, err
 	}
 
-	// Sending my Public Key.
-	// Receiving Peer's Public Key as a Response!
-	peerPublicKey, err := sendHelloFromClient(tr, message, ses.Curve.GetPublicKey(), address)
+	// Sending my Public Key, Nonce and Cipher Suites.
+	// Receiving Peer's Public Key, Nonce and chosen Cipher Suite as a Response!
+	peerHello, err := sendHelloFromClient(tr, message, ses.ClientHello(), address)
 	if err != nil {
 		return session.SecuredSession{}, err
 	}
 
 	// assign new value
-	ses.PeerPublicKey = peerPublicKey
+	if err = ses.ReceivePeerHello(peerHello); err != nil {
+		return session.SecuredSession{}, ErrorHandshake
+	}
+
+	if message.BreakConnectionOnPK != nil {
+		if message.BreakConnectionOnPK(ses.PeerPublicKey) {
+			return session.SecuredSession{}, ErrorKeysNotMatch
+		}
+	}
 
-	signature, err := ses.GetSignature()
+	signature, err := ses.ClientSignature()
 	if err != nil {
 		return session.SecuredSession{}, err
 	}
 
-	err = ses.Verify(signature)
+	// Sending my key confirmation.
+	// Receiving Peer's key confirmation as a Response!
+	peerSignature, err := sendSignatureFromClient(tr, message, signature)
 	if err != nil {
 		return session.SecuredSession{}, err
 	}
 
-	globalSessions.Set(tr.conn.LocalAddr().String(), address.String(), proxyAddr, ses)
+	if err = ses.VerifyPeerSignature(peerSignature); err != nil {
+		return session.SecuredSession{}, ErrorHandshakeSignature
+	}
+
+	if err = tr.peerIdentity.check(ses.PeerIdentity); err != nil {
+		return session.SecuredSession{}, err
+	}
+
+	setSessionForAddress(tr, ses, tr.conn.LocalAddr().String(), address.String(), proxyAddr)
 	MetricSuccessfulHandhshakes.Inc()
+	tr.securityEvent(SecurityEvent{
+		Type:          SecurityEventHandshakeSucceeded,
+		PeerAddr:      address.String(),
+		ProxyAddr:     proxyAddr,
+		PeerPublicKey: ses.PeerPublicKey,
+		PeerIdentity:  ses.PeerIdentity,
+	})
 
 	return ses, nil
 }
 
-func sendHelloFromClient(tr *transport, origMessage *CoAPMessage, myPublicKey []byte, address net.Addr) ([]byte, error) {
-	var peerPublicKey []byte
-	message := newClientHelloMessage(origMessage, myPublicKey)
+func sendHelloFromClient(tr *transport, origMessage *CoAPMessage, myHello []byte, address net.Addr) ([]byte, error) {
+	var peerHello []byte
+	message := newClientHandshakeMessage(origMessage, CoapHandshakeTypeClientHello, myHello)
 
 	respMsg, err := tr.Send(message)
 	if err != nil {
@@ -246,42 +499,69 @@ func sendHelloFromClient(tr *transport, origMessage *CoAPMessage, myPublicKey []
 	optHandshake := respMsg.GetOption(OptionHandshakeType)
 	if optHandshake != nil {
 		if optHandshake.IntValue() == CoapHandshakeTypePeerHello {
-			peerPublicKey = respMsg.Payload.Bytes()
+			peerHello = respMsg.Payload.Bytes()
 		}
 	}
 
-	if origMessage.BreakConnectionOnPK != nil {
-		if origMessage.BreakConnectionOnPK(peerPublicKey) {
-			return nil, errors.New(ERR_KEYS_NOT_MATCH)
-		}
+	return peerHello, err
+}
+
+func sendSignatureFromClient(tr *transport, origMessage *CoAPMessage, signature []byte) ([]byte, error) {
+	message := newClientHandshakeMessage(origMessage, CoapHandshakeTypeClientSignature, signature)
+
+	respMsg, err := tr.Send(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if respMsg == nil {
+		return nil, ErrorHandshake
+	}
+
+	optHandshake := respMsg.GetOption(OptionHandshakeType)
+	if optHandshake == nil || optHandshake.IntValue() != CoapHandshakeTypePeerSignature {
+		return nil, ErrorHandshake
 	}
 
-	return peerPublicKey, err
+	return respMsg.Payload.Bytes(), nil
 }
 
-func newClientHelloMessage(origMessage *CoAPMessage, myPublicKey []byte) *CoAPMessage {
+func newClientHandshakeMessage(origMessage *CoAPMessage, handshakeType int, payload []byte) *CoAPMessage {
 	message := NewCoAPMessage(CON, POST)
-	message.AddOption(OptionHandshakeType, CoapHandshakeTypeClientHello)
-	message.Payload = NewBytesPayload(myPublicKey)
+	message.AddOption(OptionHandshakeType, handshakeType)
+	message.Payload = NewBytesPayload(payload)
 	message.Token = generateToken(6)
 	message.CloneOptions(origMessage, OptionProxyURI, OptionProxySecurityID)
 	message.ProxyAddr = origMessage.ProxyAddr
 	return message
 }
 
-func newServerHelloMessage(origMessage *CoAPMessage, publicKey []byte) *CoAPMessage {
+func newServerHelloMessage(origMessage *CoAPMessage, hello []byte) *CoAPMessage {
 	message := NewCoAPMessageId(ACK, CoapCodeContent, origMessage.MessageID)
 	message.AddOption(OptionHandshakeType, CoapHandshakeTypePeerHello)
-	message.Payload = NewBytesPayload(publicKey)
+	message.Payload = NewBytesPayload(hello)
+	message.Token = origMessage.Token
+	message.CloneOptions(origMessage, OptionProxySecurityID)
+	message.ProxyAddr = origMessage.ProxyAddr
+	return message
+}
+
+func newServerSignatureMessage(origMessage *CoAPMessage, signature []byte) *CoAPMessage {
+	code := CoapCodeContent
+	if signature == nil {
+		code = CoapCodeForbidden
+	}
+	message := NewCoAPMessageId(ACK, code, origMessage.MessageID)
+	message.AddOption(OptionHandshakeType, CoapHandshakeTypePeerSignature)
+	message.Payload = NewBytesPayload(signature)
 	message.Token = origMessage.Token
 	message.CloneOptions(origMessage, OptionProxySecurityID)
 	message.ProxyAddr = origMessage.ProxyAddr
 	return message
 }
 
-func incomingHandshake(tr *transport, publicKey []byte, origMessage *CoAPMessage) error {
-	message := newServerHelloMessage(origMessage, publicKey)
-	if _, err := tr.SendTo(message, origMessage.Sender); err != nil {
+func incomingHandshake(tr *transport, message *CoAPMessage, addr net.Addr) error {
+	if _, err := tr.SendTo(message, addr); err != nil {
 		return err
 	}
 
@@ -0,0 +1,378 @@
+package coalago
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+func TestHandshakeSignatureExchange(t *testing.T) {
+	srv := NewServerWithPrivateKey([]byte("server key"))
+	srv.AddGETResource("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewStringPayload("secret"), CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12313")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	resp, err := NewClient().GET("coaps://127.0.0.1:12313/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "secret" {
+		t.Fatalf("unexpected body: %q", resp.Body)
+	}
+	if len(resp.PeerPublicKey) == 0 {
+		t.Fatal("peer public key is empty")
+	}
+
+	// A ClientSignature sent again because its PeerSignature was lost gets the same answer
+	conn, err := net.Dial("udp", "127.0.0.1:12313")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exchange := func(message *CoAPMessage) *CoAPMessage {
+		t.Helper()
+		data, _ := Serialize(message)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, MTU)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := Deserialize(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	ses, err := session.NewSecuredSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := NewCoAPMessage(CON, GET)
+	peerHello := exchange(newClientHandshakeMessage(request, CoapHandshakeTypeClientHello, ses.ClientHello()))
+	if err = ses.ReceivePeerHello(peerHello.Payload.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ses.ClientSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSignature := newClientHandshakeMessage(request, CoapHandshakeTypeClientSignature, signature)
+	for i := 0; i < 2; i++ {
+		peerSignature := exchange(clientSignature)
+		if peerSignature.Code != CoapCodeContent || peerSignature.MessageID != clientSignature.MessageID {
+			t.Fatalf("attempt %d: unexpected answer %v", i+1, peerSignature.Code)
+		}
+		if err = ses.VerifyPeerSignature(peerSignature.Payload.Bytes()); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestHandshakeCipherSuiteNegotiation(t *testing.T) {
+	srv := NewServer()
+	srv.SetCipherSuites(session.CipherSuiteAES128GCM, session.CipherSuiteChaCha20Poly1305)
+	srv.AddPOSTResource("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(message.Payload, CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12314")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+	client.SetCipherSuites(session.CipherSuiteChaCha20Poly1305)
+	resp, err := client.POST([]byte("ping"), "coaps://127.0.0.1:12314/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "ping" {
+		t.Fatalf("unexpected body: %q", resp.Body)
+	}
+
+	// The session of the client is reused, another one negotiates anew
+	client = NewClient()
+	client.SetCipherSuites(session.CipherSuiteAES256GCM)
+	var failed int32
+	client.SetSecurityHooks(SecurityHooksFunc(func(event SecurityEvent) {
+		if event.Type == SecurityEventHandshakeFailed {
+			atomic.AddInt32(&failed, 1)
+		}
+	}))
+	if _, err = client.POST([]byte("ping"), "coaps://127.0.0.1:12314/secure"); err == nil {
+		t.Fatal("expected handshake without common cipher suite to fail")
+	}
+	if atomic.LoadInt32(&failed) != 1 {
+		t.Fatalf("expected one %s event, got %d", SecurityEventHandshakeFailed, failed)
+	}
+}
+
+// clientSession returns the session of the client with the peer at addr.
+func clientSession(t *testing.T, client *Client, addr string) session.SecuredSession {
+	conn, err := client.dial(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ses, ok := getSessionForAddress(client.newTransport(conn), conn.LocalAddr().String(), conn.RemoteAddr().String(), "")
+	if !ok {
+		t.Fatal("session not found")
+	}
+	return ses
+}
+
+// waitRekey waits for the session of the client with the peer at addr to be replaced.
+func waitRekey(t *testing.T, client *Client, addr string, id []byte) {
+	for i := 0; i < 40; i++ {
+		if !bytes.Equal(clientSession(t, client, addr).ID, id) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("session was not rekeyed after reaching the limit")
+}
+
+func TestRekeyByMessageCount(t *testing.T) {
+	srv := NewServer()
+	srv.AddPOSTResource("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(message.Payload, CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12315")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+	defer client.Close()
+	// Every request and its response count
+	client.SetRekeyPolicy(RekeyPolicy{MaxMessages: 4})
+
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		resp, err := client.POST([]byte("ping"), "coaps://127.0.0.1:12315/secure")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != "ping" {
+			t.Fatalf("unexpected body: %q", resp.Body)
+		}
+		ids = append(ids, clientSession(t, client, "127.0.0.1:12315").ID)
+	}
+
+	if !bytes.Equal(ids[0], ids[1]) {
+		t.Fatal("session was rekeyed before reaching the limit")
+	}
+	// The third request goes out on the old keys while the rekey runs
+	waitRekey(t, client, "127.0.0.1:12315", ids[1])
+
+	resp, err := client.POST([]byte("pong"), "coaps://127.0.0.1:12315/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "pong" {
+		t.Fatalf("unexpected body after rekey: %q", resp.Body)
+	}
+}
+
+func TestRekeyRequestedByServer(t *testing.T) {
+	srv := NewServer()
+	srv.SetRekeyPolicy(RekeyPolicy{MaxMessages: 2})
+	srv.AddPOSTResource("/secure", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(message.Payload, CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12333")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.POST([]byte("ping"), "coaps://127.0.0.1:12333/secure"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := clientSession(t, client, "127.0.0.1:12333").ID
+
+	// The response to the second request asks for a rekey, the next request starts it
+	if _, err := client.POST([]byte("ping"), "coaps://127.0.0.1:12333/secure"); err != nil {
+		t.Fatal(err)
+	}
+	waitRekey(t, client, "127.0.0.1:12333", id)
+}
+
+func TestHandshakeIdentity(t *testing.T) {
+	clientIdentity, err := session.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverIdentity, err := session.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer()
+	srv.SetIdentity(serverIdentity)
+	srv.AddGETResource("/whoami", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(NewBytesPayload(message.PeerIdentity), CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12318")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+	client.SetIdentity(clientIdentity)
+	resp, err := client.GET("coaps://127.0.0.1:12318/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Body, clientIdentity.PublicKey()) {
+		t.Fatal("handler got no verified client identity")
+	}
+	if !bytes.Equal(resp.PeerIdentity, serverIdentity.PublicKey()) {
+		t.Fatal("client got no verified server identity")
+	}
+}
+
+func TestHandshakePeerIdentityPolicy(t *testing.T) {
+	serverIdentity, err := session.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientIdentity, err := session.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	handler := func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		atomic.AddInt32(&requests, 1)
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	}
+	srv := NewServer()
+	srv.SetIdentity(serverIdentity)
+	srv.SetPeerIdentityPolicy(PeerIdentityPolicy{Required: true})
+	srv.AddPOSTResource("/secure", handler)
+	anonymous := NewServer()
+	anonymous.AddPOSTResource("/secure", handler)
+	go func() {
+		err := srv.Listen(":12334")
+		if err != nil {
+			panic(err)
+		}
+	}()
+	go func() {
+		err := anonymous.Listen(":12335")
+		if err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second)
+
+	pinned := func(identity ed25519.PublicKey) bool {
+		return bytes.Equal(identity, serverIdentity.PublicKey())
+	}
+	for _, tc := range []struct {
+		name     string
+		addr     string
+		identity bool
+		policy   PeerIdentityPolicy
+		err      error
+	}{
+		{"pinned server", "127.0.0.1:12334", true, PeerIdentityPolicy{Pin: pinned}, nil},
+		{"other server", "127.0.0.1:12334", true, PeerIdentityPolicy{Pin: func(ed25519.PublicKey) bool { return false }}, ErrorPeerIdentityRejected},
+		{"server without identity", "127.0.0.1:12335", true, PeerIdentityPolicy{Required: true}, ErrorPeerIdentityRequired},
+		{"pin without identity", "127.0.0.1:12335", true, PeerIdentityPolicy{Pin: pinned}, ErrorPeerIdentityRequired},
+		{"client without identity", "127.0.0.1:12334", false, PeerIdentityPolicy{}, ErrorHandshakeSignature},
+	} {
+		client := NewClient()
+		if tc.identity {
+			client.SetIdentity(clientIdentity)
+		}
+		client.SetPeerIdentityPolicy(tc.policy)
+
+		before := atomic.LoadInt32(&requests)
+		_, err := client.POST([]byte("secret"), "coaps://"+tc.addr+"/secure")
+		client.Close()
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+		if err != nil && atomic.LoadInt32(&requests) != before {
+			t.Fatalf("%s: request reached a rejected peer", tc.name)
+		}
+	}
+}
+
+func TestPeerInfo(t *testing.T) {
+	infos := make(chan *PeerInfo, 2)
+	srv := NewServer()
+	srv.AddGETResource("/info", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		infos <- message.PeerInfo
+		return NewResponse(NewStringPayload("ok"), CoapCodeContent)
+	})
+	go func() {
+		err := srv.Listen(":12321")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+	client.SetSessionStorage(NewMemorySessionStorage())
+
+	if _, err := client.GET("coaps://127.0.0.1:12321/info"); err != nil {
+		t.Fatal(err)
+	}
+	info := <-infos
+	if info.Scheme != COAPS_SCHEME || info.ViaProxy {
+		t.Fatalf("unexpected peer info %+v", info)
+	}
+	if len(info.SessionID) != 2*session.SESSION_ID_SIZE || len(info.PublicKey) == 0 {
+		t.Fatalf("session is not described: %+v", info)
+	}
+	if age := info.SessionAge(); age <= 0 || age > time.Minute {
+		t.Fatalf("unexpected session age %v", age)
+	}
+
+	if _, err := client.GET("coap://127.0.0.1:12321/info"); err != nil {
+		t.Fatal(err)
+	}
+	info = <-infos
+	if info.Scheme != COAP_SCHEME || info.SessionID != "" || info.Addr == nil {
+		t.Fatalf("unexpected peer info %+v", info)
+	}
+}
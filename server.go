@@ -5,6 +5,9 @@ import (
 	"net"
 	"strings"
 	"sync"
+
+	"github.com/coalalib/coalago/session"
+	"github.com/patrickmn/go-cache"
 )
 
 type rawData struct {
@@ -13,14 +16,49 @@ type rawData struct {
 }
 
 type Server struct {
-	proxyEnable bool
-	sr          *transport
-	resources   sync.Map
-	privatekey  []byte
+	proxyEnable  bool
+	mx           sync.Mutex
+	sr           *transport
+	resources    sync.Map
+	privatekey   []byte
+	cipherSuites []session.CipherSuite
+	identity     *session.Identity
+	peerIdentity PeerIdentityPolicy
+	rekeyPolicy  RekeyPolicy
+	sessions     SessionStorage
+	previous     *sessionStorageImpl
+	handshakes   *handshakeState
+	hooks        SecurityHooks
+
+	oscoreContexts *oscoreRegistry
+	// EDHOC responders waiting for message_3 by their connection identifier
+	edhocResponders *cache.Cache
+	access          *accessControl
+	blockwise       *blockwiseModes
+	windowPolicy    WindowPolicy
+	transfers       TransferStorage
+	digest          DigestAlgorithm
+	limits          TransferLimits
+	workers         WorkerPolicy
+	pool            *workerPool
+	transport       Transport
 }
 
 func NewServer() *Server {
 	s := new(Server)
+	s.rekeyPolicy = DefaultRekeyPolicy
+	s.handshakes = newHandshakeState()
+	s.sessions = globalSessions
+	s.previous = newSessionStorageImpl(false)
+	s.oscoreContexts = newOSCORERegistry()
+	s.edhocResponders = newEDHOCResponders()
+	s.access = newAccessControl()
+	s.blockwise = newBlockwiseModes()
+	s.windowPolicy = DefaultWindowPolicy
+	s.transfers = NewMemoryTransferStorage()
+	s.limits = DefaultTransferLimits
+	s.workers = DefaultWorkerPolicy
+	s.transport = UDPTransport
 	return s
 }
 
@@ -36,22 +74,28 @@ type Resourcer interface {
 }
 
 func (s *Server) Listen(addr string) (err error) {
-	conn, err := newListener(addr)
+	conn, err := s.transport.Listen(addr)
 	if err != nil {
 		return err
 	}
 
-	s.sr = newtransport(conn)
-	s.sr.privateKey = s.privatekey
+	return s.serve(s.start(newPacketDialer(conn, s.transport)))
+}
 
+// serve receives the messages of the started transport until the pool is stopped.
+func (s *Server) serve(sr *transport, pool *workerPool) error {
+	limit := messageSizeLimit(sr.conn.LocalAddr())
 	for {
-		readBuf := make([]byte, MTU+1)
+		readBuf := make([]byte, limit+1)
 	start:
-		n, senderAddr, err := s.sr.conn.Listen(readBuf)
+		n, senderAddr, err := sr.conn.Listen(readBuf)
 		if err != nil {
-			panic(err)
+			if pool.isStopped() {
+				return nil
+			}
+			return err
 		}
-		if n == 0 || n > MTU {
+		if n == 0 || n > limit {
 			goto start
 		}
 
@@ -63,35 +107,100 @@ func (s *Server) Listen(addr string) (err error) {
 		id := senderAddr.String() + message.GetTokenString()
 		fn, ok := StorageLocalStates.Get(id)
 		if !ok {
-			fn = MakeLocalStateFn(s, s.sr, nil, func() {
+			fn = MakeLocalStateFn(s, sr, nil, func() {
 				StorageLocalStates.Delete(id)
 			})
 		}
 		StorageLocalStates.SetDefault(id, fn)
 
-		go fn.(LocalStateFn)(message)
+		handle := fn.(LocalStateFn)
+		if !pool.submit(peerHost(senderAddr), func() { handle(message) }) {
+			sr.sendOverloaded(message, senderAddr)
+		}
 	}
 }
 
 func (s *Server) Serve(conn *net.UDPConn) {
 	c := new(connection)
 	c.conn = conn
-	s.sr = newtransport(c)
-	s.sr.privateKey = s.privatekey
+	s.start(c)
+}
+
+// newTransport makes the transport of the server on conn with its settings.
+func (s *Server) newTransport(conn dialer) *transport {
+	sr := newtransport(conn)
+	sr.privateKey = s.privatekey
+	sr.cipherSuites = s.cipherSuites
+	sr.identity = s.identity
+	sr.peerIdentity = s.peerIdentity
+	sr.rekeyPolicy = s.rekeyPolicy
+	sr.handshakes = s.handshakes
+	sr.sessions = s.sessions
+	sr.previousSessions = s.previous
+	sr.hooks = s.hooks
+	sr.oscoreContexts = s.oscoreContexts
+	sr.access = s.access
+	sr.blockwise = s.blockwise
+	sr.windowPolicy = s.windowPolicy
+	sr.transfers = s.transfers
+	sr.digest = s.digest
+	sr.limits = s.limits
+	sr.workers = s.workers
+	if s.workers.MaxHandlers > 0 {
+		sr.handlers = make(chan struct{}, s.workers.MaxHandlers)
+	}
+	return sr
+}
 
+// start serves conn, the workers serving a previous conn are stopped.
+func (s *Server) start(conn dialer) (*transport, *workerPool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.pool != nil {
+		s.pool.stop()
+	}
+	s.sr = s.newTransport(conn)
+	s.pool = newWorkerPool(s.workers)
+	watchSessionExpiry(s.sr)
+	return s.sr, s.pool
+}
+
+// Close stops the workers and closes the conn of the server, Listen returns.
+func (s *Server) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.pool == nil {
+		return nil
+	}
+	s.pool.stop()
+	s.pool = nil
+	unwatchSessionExpiry(s.sr.conn.LocalAddr().String())
+	return s.sr.conn.Close()
 }
 
 func (s *Server) ServeMessage(message *CoAPMessage) {
+	s.mx.Lock()
+	sr, pool := s.sr, s.pool
+	s.mx.Unlock()
+	if pool == nil {
+		return
+	}
+
 	id := message.Sender.String() + message.GetTokenString()
 	fn, ok := StorageLocalStates.Get(id)
 	if !ok {
-		fn = MakeLocalStateFn(s, s.sr, nil, func() {
+		fn = MakeLocalStateFn(s, sr, nil, func() {
 			StorageLocalStates.Delete(id)
 		})
 		StorageLocalStates.SetDefault(id, fn)
 	}
 
-	go fn.(LocalStateFn)(message)
+	handle := fn.(LocalStateFn)
+	if !pool.submit(peerHost(message.Sender), func() { handle(message) }) {
+		sr.sendOverloaded(message, message.Sender)
+	}
 }
 
 func (s *Server) addResource(res *CoAPResource) {
@@ -99,6 +208,17 @@ func (s *Server) addResource(res *CoAPResource) {
 	s.resources.Store(key, res)
 }
 
+// AddResource adds a resource, e.g. one with a Policy. The policy is read
+// once here: its keys must be valid and its groups defined by the current
+// AccessPolicy.
+func (s *Server) AddResource(res *CoAPResource) error {
+	if err := s.access.add(res); err != nil {
+		return err
+	}
+	s.addResource(res)
+	return nil
+}
+
 func (s *Server) AddGETResource(path string, handler CoAPResourceHandler) {
 	s.addResource(NewCoAPResource(CoapMethodGet, path, handler))
 }
@@ -125,6 +245,87 @@ func (s *Server) getResourceForPathAndMethod(path string, method CoapMethod) *Co
 	return nil
 }
 
+// SetAccessPolicy replaces the key groups and resource policies checked
+// before handlers run. It may be called while the server is running. A policy
+// that lacks a group used by an added resource is rejected.
+func (s *Server) SetAccessPolicy(policy AccessPolicy) error {
+	return s.access.set(policy)
+}
+
+// LoadAccessPolicy reads the access policy from a JSON file, or a YAML one
+// if its extension is .yaml or .yml. A policy that fails to load leaves the
+// current one in place.
+func (s *Server) LoadAccessPolicy(path string) error {
+	return s.access.load(path)
+}
+
+// ReloadAccessPolicy reads the file given to LoadAccessPolicy again.
+func (s *Server) ReloadAccessPolicy() error {
+	return s.access.reload()
+}
+
+// SetWindowPolicy sets the bounds of the selective-repeat window of Block2
+// responses. It must be called before Listen or Serve.
+func (s *Server) SetWindowPolicy(policy WindowPolicy) {
+	s.windowPolicy = policy
+}
+
+// SetPayloadDigest sets the digest sent with large responses, so that
+// clients check them after reassembly. It must be called before Listen or Serve.
+func (s *Server) SetPayloadDigest(algorithm DigestAlgorithm) {
+	s.digest = algorithm
+}
+
+// SetTransferLimits bounds the requests the server reassembles from blocks
+// and how many it reassembles at once. It must be called before Listen or Serve.
+func (s *Server) SetTransferLimits(limits TransferLimits) {
+	s.limits = limits
+}
+
+// SetTransport sets the transport Listen receives requests on,
+// UDPTransport by default.
+func (s *Server) SetTransport(transport Transport) {
+	s.transport = transport
+}
+
+// SetWorkerPolicy bounds the goroutines processing received messages and
+// running handlers. It must be called before Listen or Serve.
+func (s *Server) SetWorkerPolicy(policy WorkerPolicy) {
+	s.workers = policy
+}
+
+// SetTransferStorage sets where the blocks of resumable transfers are kept
+// until they are complete, nil disables resuming. It must be called before
+// Listen or Serve.
+func (s *Server) SetTransferStorage(storage TransferStorage) {
+	s.transfers = storage
+}
+
+// SetBlockwiseMode sets how large payloads are transferred to peers without
+// a mode of their own. Peers that send RFC 7959 block options are answered
+// in RFC 7959 mode anyway.
+func (s *Server) SetBlockwiseMode(mode BlockwiseMode) {
+	s.blockwise.setDefault(mode)
+}
+
+// SetPeerBlockwiseMode sets how large payloads are transferred to the peer at addr.
+func (s *Server) SetPeerBlockwiseMode(addr string, mode BlockwiseMode) error {
+	return s.blockwise.setPeer(addr, mode)
+}
+
+// SetBlockSize sets the size of blocks exchanged with peers without a size
+// of their own: a power of two from 16 to 1024 bytes, or a multiple of 1024
+// bytes for BERT blocks, which are used only over reliable transports.
+// Peers may shrink it for themselves.
+func (s *Server) SetBlockSize(size int) error {
+	return s.blockwise.setDefaultSize(size)
+}
+
+// SetPeerBlockSize sets the size of blocks exchanged with the peer at addr.
+func (s *Server) SetPeerBlockSize(addr string, size int) error {
+	return s.blockwise.setPeerSize(addr, size)
+}
+
 func (s *Server) EnableProxy() {
 	s.proxyEnable = true
 }
@@ -141,6 +342,52 @@ func (s *Server) GetPrivateKey() []byte {
 	return s.privatekey
 }
 
+// SetSessionStorage sets where the server keeps its coaps:// sessions.
+// It must be called before Listen or Serve.
+func (s *Server) SetSessionStorage(storage SessionStorage) {
+	s.sessions = storage
+}
+
+// SetRekeyPolicy sets the limits after which the server asks its clients to
+// renew coaps:// session keys. It must be called before Listen or Serve.
+func (s *Server) SetRekeyPolicy(policy RekeyPolicy) {
+	s.rekeyPolicy = policy
+}
+
+// SetPeerIdentityPolicy sets which client identities coaps:// handshakes
+// accept. It must be called before Listen or Serve.
+func (s *Server) SetPeerIdentityPolicy(policy PeerIdentityPolicy) {
+	s.peerIdentity = policy
+}
+
+// SetSecurityHooks sets the receiver of the server's security events.
+// It must be called before Listen or Serve.
+func (s *Server) SetSecurityHooks(hooks SecurityHooks) {
+	s.hooks = hooks
+}
+
+// SetIdentity makes the server sign its coaps:// handshakes with a long-term
+// Ed25519 identity. It must be called before Listen or Serve.
+func (s *Server) SetIdentity(identity session.Identity) {
+	s.identity = &identity
+}
+
+// SetCipherSuites sets the cipher suites accepted from clients.
+// The first suite of the client's offer that is accepted wins.
+func (s *Server) SetCipherSuites(suites ...session.CipherSuite) {
+	s.cipherSuites = suites
+}
+
+// AddOSCOREContext accepts OSCORE requests from the client whose Sender ID is
+// the context's Recipient ID.
+func (s *Server) AddOSCOREContext(ctx *session.OSCOREContext) {
+	s.oscoreContexts.add(ctx)
+}
+
+func (s *Server) RemoveOSCOREContext(ctx *session.OSCOREContext) {
+	s.oscoreContexts.remove(ctx)
+}
+
 func (s *Server) SendToSocket(message *CoAPMessage, addr string) error {
 	b, err := Serialize(message)
 	if err != nil {
@@ -0,0 +1,19 @@
+package coalago
+
+import "testing"
+
+// listenServer starts srv on addr, e.g. "127.0.0.1:0" for a free port, and
+// returns the address it listens on. The server receives messages once it
+// returns and is closed at the end of the test.
+func listenServer(t *testing.T, srv *Server, addr string) string {
+	t.Helper()
+	conn, err := srv.transport.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr, pool := srv.start(newPacketDialer(conn, srv.transport))
+	t.Cleanup(func() { srv.Close() })
+	go srv.serve(sr, pool)
+	return conn.LocalAddr().String()
+}
@@ -4,64 +4,89 @@ import (
 	"crypto/cipher"
 	"encoding/binary"
 	"errors"
-
-	"github.com/lucas-clemente/aes12"
+	"strconv"
 )
 
-type AEAD struct {
-	PeerKey   []byte
-	MyKey     []byte
-	PeerIV    []byte
-	MyIV      []byte
+const IV_SIZE int = 4
+
+type AEAD interface {
+	Open(cipherText []byte, counter uint16, associatedData []byte) ([]byte, error)
+	Seal(plainText []byte, counter uint16, associatedData []byte) []byte
+	Suite() CipherSuite
+	Keys() (peerKey, myKey, peerIV, myIV []byte)
+}
+
+type aead struct {
+	suite     CipherSuite
+	peerKey   []byte
+	myKey     []byte
+	peerIV    []byte
+	myIV      []byte
 	encrypter cipher.AEAD
 	decrypter cipher.AEAD
 }
 
+// NewAEAD creates an AEAD of the default AES-128-GCM cipher suite.
 func NewAEAD(peerKey, myKey, peerIV, myIV []byte) (AEAD, error) {
-	if len(myKey) != 16 || len(peerKey) != 16 || len(myIV) != 4 || len(peerIV) != 4 {
-		return AEAD{}, errors.New("AES-GCM: expected 16-byte keys and 4-byte IVs")
+	return NewAEADWithSuite(CipherSuiteAES128GCM, peerKey, myKey, peerIV, myIV)
+}
+
+func NewAEADWithSuite(suite CipherSuite, peerKey, myKey, peerIV, myIV []byte) (AEAD, error) {
+	info, ok := lookupCipherSuite(suite)
+	if !ok {
+		return nil, ErrUnknownCipherSuite
 	}
 
-	encrypterCipher, err := aes12.NewCipher(myKey)
-	if err != nil {
-		return AEAD{}, err
+	if len(myKey) != info.keySize || len(peerKey) != info.keySize || len(myIV) != IV_SIZE || len(peerIV) != IV_SIZE {
+		return nil, errors.New(suite.String() + ": expected " + strconv.Itoa(info.keySize) + "-byte keys and 4-byte IVs")
 	}
-	encrypter, err := aes12.NewGCM(encrypterCipher)
+
+	encrypter, err := info.newCipher(myKey)
 	if err != nil {
-		return AEAD{}, err
+		return nil, err
 	}
-	decrypterCipher, err := aes12.NewCipher(peerKey)
+	decrypter, err := info.newCipher(peerKey)
 	if err != nil {
-		return AEAD{}, err
+		return nil, err
 	}
-	decrypter, err := aes12.NewGCM(decrypterCipher)
-	if err != nil {
-		return AEAD{}, err
+	if encrypter.NonceSize() != nonceSize {
+		return nil, errors.New(suite.String() + ": expected " + strconv.Itoa(nonceSize) + "-byte nonces")
 	}
 
-	return AEAD{
-		PeerKey:   peerKey,
-		MyKey:     myKey,
-		PeerIV:    peerIV,
-		MyIV:      myIV,
+	return &aead{
+		suite:     suite,
+		peerKey:   peerKey,
+		myKey:     myKey,
+		peerIV:    peerIV,
+		myIV:      myIV,
 		encrypter: encrypter,
 		decrypter: decrypter,
 	}, nil
 }
 
-func (aead *AEAD) Open(cipherText []byte, counter uint16, associatedData []byte) ([]byte, error) {
-	plainText, err := aead.decrypter.Open(nil, makeNonce(aead.PeerIV, counter), cipherText, associatedData)
+func (aead *aead) Open(cipherText []byte, counter uint16, associatedData []byte) ([]byte, error) {
+	plainText, err := aead.decrypter.Open(nil, makeNonce(aead.peerIV, counter), cipherText, associatedData)
 	return plainText, err
 }
 
-func (aead *AEAD) Seal(plainText []byte, counter uint16, associatedData []byte) []byte {
-	cipherText := aead.encrypter.Seal(nil, makeNonce(aead.MyIV, counter), plainText, associatedData)
+func (aead *aead) Seal(plainText []byte, counter uint16, associatedData []byte) []byte {
+	cipherText := aead.encrypter.Seal(nil, makeNonce(aead.myIV, counter), plainText, associatedData)
 	return cipherText
 }
 
+func (aead *aead) Suite() CipherSuite {
+	return aead.suite
+}
+
+func (aead *aead) Keys() (peerKey, myKey, peerIV, myIV []byte) {
+	return aead.peerKey, aead.myKey, aead.peerIV, aead.myIV
+}
+
+const nonceSize = 12
+
 func makeNonce(iv []byte, counter uint16) []byte {
-	res := make([]byte, 12)
-	copy(res[0:4], iv)
-	binary.LittleEndian.PutUint16(res[4:12], counter)
+	res := make([]byte, nonceSize)
+	copy(res[0:IV_SIZE], iv)
+	binary.LittleEndian.PutUint16(res[IV_SIZE:nonceSize], counter)
 	return res
 }
@@ -10,7 +10,7 @@ import (
 
 func TestSealOpen(t *testing.T) {
 	var (
-		alice, bob                       *AEAD
+		alice, bob                       AEAD
 		keyAlice, keyBob, ivAlice, ivBob []byte
 		err                              error
 	)
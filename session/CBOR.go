@@ -0,0 +1,127 @@
+package session
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Minimal deterministic CBOR (RFC 8949) encoding used by OSCORE and EDHOC structures.
+
+const (
+	cborMajorUint   = 0
+	cborMajorNegInt = 1
+	cborMajorBytes  = 2
+	cborMajorText   = 3
+	cborMajorArray  = 4
+	cborMajorMap    = 5
+	cborNull        = 0xf6
+	cborTrue        = 0xf5
+)
+
+var ErrCBOR = errors.New("CBOR: malformed data")
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		return b
+	case n <= 0xffffffff:
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return b
+	default:
+		b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[1:], n)
+		return b
+	}
+}
+
+func cborInt(v int) []byte {
+	if v < 0 {
+		return cborHead(cborMajorNegInt, uint64(-1-v))
+	}
+	return cborHead(cborMajorUint, uint64(v))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(cborMajorBytes, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(cborMajorText, uint64(len(s))), s...)
+}
+
+// cborArray joins already encoded items into an array.
+func cborArray(items ...[]byte) []byte {
+	res := cborHead(cborMajorArray, uint64(len(items)))
+	for _, item := range items {
+		res = append(res, item...)
+	}
+	return res
+}
+
+// cborBytesOrNull encodes nil as CBOR null and anything else as a byte string.
+func cborBytesOrNull(b []byte) []byte {
+	if b == nil {
+		return []byte{cborNull}
+	}
+	return cborBytes(b)
+}
+
+func cborMap(n int) []byte {
+	return cborHead(cborMajorMap, uint64(n))
+}
+
+// cborReadHead reads the major type and argument of the next item.
+func cborReadHead(data []byte) (major byte, n uint64, rest []byte, err error) {
+	if len(data) == 0 {
+		return 0, 0, nil, ErrCBOR
+	}
+	major = data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return major, uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return major, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return major, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return major, binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	return 0, 0, nil, ErrCBOR
+}
+
+func cborReadBytes(data []byte) ([]byte, []byte, error) {
+	major, n, rest, err := cborReadHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if major != cborMajorBytes || uint64(len(rest)) < n {
+		return nil, nil, ErrCBOR
+	}
+	return rest[:n], rest[n:], nil
+}
+
+func cborReadInt(data []byte) (int, []byte, error) {
+	major, n, rest, err := cborReadHead(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch major {
+	case cborMajorUint:
+		return int(n), rest, nil
+	case cborMajorNegInt:
+		return -1 - int(n), rest, nil
+	}
+	return 0, nil, ErrCBOR
+}
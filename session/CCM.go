@@ -0,0 +1,159 @@
+package session
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ccm implements the CCM mode of RFC 3610 for 128-bit block ciphers.
+type ccm struct {
+	block     cipher.Block
+	tagSize   int
+	nonceSize int
+}
+
+var errOpen = errors.New("CCM: message authentication failed")
+
+// NewCCM returns CCM with the given tag and nonce sizes, e.g. 8 and 13 for
+// AES-CCM-16-64-128 of OSCORE.
+func NewCCM(block cipher.Block, tagSize, nonceSize int) (cipher.AEAD, error) {
+	if block.BlockSize() != 16 {
+		return nil, errors.New("CCM: expected 128-bit block cipher")
+	}
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, errors.New("CCM: invalid tag size")
+	}
+	if nonceSize < 7 || nonceSize > 13 {
+		return nil, errors.New("CCM: invalid nonce size")
+	}
+	return &ccm{block: block, tagSize: tagSize, nonceSize: nonceSize}, nil
+}
+
+func (c *ccm) NonceSize() int {
+	return c.nonceSize
+}
+
+func (c *ccm) Overhead() int {
+	return c.tagSize
+}
+
+func (c *ccm) maxLength() uint64 {
+	l := 15 - c.nonceSize
+	if l >= 8 {
+		return 1<<64 - 1
+	}
+	return 1<<(8*uint(l)) - 1
+}
+
+func (c *ccm) counter(nonce []byte, i int) []byte {
+	a := make([]byte, 16)
+	a[0] = byte(14 - c.nonceSize)
+	copy(a[1:], nonce)
+	for j := 15; j > c.nonceSize; j-- {
+		a[j] = byte(i)
+		i >>= 8
+	}
+	return a
+}
+
+func (c *ccm) mac(nonce, plainText, additionalData []byte) []byte {
+	l := 15 - c.nonceSize
+
+	b := make([]byte, 16)
+	b[0] = byte(8*((c.tagSize-2)/2) + (l - 1))
+	if len(additionalData) > 0 {
+		b[0] |= 64
+	}
+	copy(b[1:], nonce)
+	n := uint64(len(plainText))
+	for i := 15; i > c.nonceSize; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+
+	tag := make([]byte, 16)
+	c.block.Encrypt(tag, b)
+
+	mac := func(data []byte) {
+		for len(data) > 0 {
+			var chunk [16]byte
+			n := copy(chunk[:], data)
+			data = data[n:]
+			xorBytes(tag, tag, chunk[:])
+			c.block.Encrypt(tag, tag)
+		}
+	}
+
+	if len(additionalData) > 0 {
+		var prefix []byte
+		if len(additionalData) < 0xff00 {
+			prefix = make([]byte, 2)
+			binary.BigEndian.PutUint16(prefix, uint16(len(additionalData)))
+		} else {
+			prefix = []byte{0xff, 0xfe, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(prefix[2:], uint32(len(additionalData)))
+		}
+		mac(append(prefix, additionalData...))
+	}
+	mac(plainText)
+
+	return tag[:c.tagSize]
+}
+
+func (c *ccm) ctr(dst, src, nonce []byte) {
+	stream := cipher.NewCTR(c.block, c.counter(nonce, 1))
+	stream.XORKeyStream(dst, src)
+}
+
+func (c *ccm) Seal(dst, nonce, plainText, additionalData []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("CCM: incorrect nonce length")
+	}
+	if uint64(len(plainText)) > c.maxLength() {
+		panic("CCM: message too large")
+	}
+
+	tag := c.mac(nonce, plainText, additionalData)
+
+	s0 := make([]byte, 16)
+	c.block.Encrypt(s0, c.counter(nonce, 0))
+
+	out := make([]byte, len(plainText)+c.tagSize)
+	c.ctr(out, plainText, nonce)
+	xorBytes(out[len(plainText):], tag, s0[:c.tagSize])
+
+	return append(dst, out...)
+}
+
+func (c *ccm) Open(dst, nonce, cipherText, additionalData []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize {
+		panic("CCM: incorrect nonce length")
+	}
+	if len(cipherText) < c.tagSize {
+		return nil, errOpen
+	}
+
+	n := len(cipherText) - c.tagSize
+	plainText := make([]byte, n)
+	c.ctr(plainText, cipherText[:n], nonce)
+
+	s0 := make([]byte, 16)
+	c.block.Encrypt(s0, c.counter(nonce, 0))
+
+	expected := c.mac(nonce, plainText, additionalData)
+	xorBytes(expected, expected, s0[:c.tagSize])
+
+	if subtle.ConstantTimeCompare(expected, cipherText[n:]) != 1 {
+		return nil, errOpen
+	}
+
+	return append(dst, plainText...), nil
+}
+
+func xorBytes(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
@@ -0,0 +1,112 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/lucas-clemente/aes12"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuite identifies the AEAD negotiated during ClientHello/PeerHello.
+type CipherSuite uint8
+
+const (
+	// AES-128-GCM with 12-byte tags, the only suite of older peers
+	CipherSuiteAES128GCM        CipherSuite = 1
+	CipherSuiteChaCha20Poly1305 CipherSuite = 2
+	CipherSuiteAES256GCM        CipherSuite = 3
+)
+
+var (
+	ErrUnknownCipherSuite  = errors.New("unknown cipher suite")
+	ErrNoCommonCipherSuite = errors.New("no common cipher suite")
+)
+
+type cipherSuiteInfo struct {
+	name      string
+	keySize   int
+	newCipher func(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	cipherSuitesMx sync.RWMutex
+	cipherSuites   = make(map[CipherSuite]cipherSuiteInfo)
+
+	// DefaultCipherSuites are offered by a client and accepted by a peer
+	// unless configured otherwise, in order of preference.
+	DefaultCipherSuites = []CipherSuite{
+		CipherSuiteAES128GCM,
+		CipherSuiteChaCha20Poly1305,
+		CipherSuiteAES256GCM,
+	}
+)
+
+func init() {
+	RegisterCipherSuite(CipherSuiteAES128GCM, "AES-128-GCM", 16, func(key []byte) (cipher.AEAD, error) {
+		c, err := aes12.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return aes12.NewGCM(c)
+	})
+	RegisterCipherSuite(CipherSuiteChaCha20Poly1305, "ChaCha20-Poly1305", chacha20poly1305.KeySize, chacha20poly1305.New)
+	RegisterCipherSuite(CipherSuiteAES256GCM, "AES-256-GCM", 32, func(key []byte) (cipher.AEAD, error) {
+		c, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(c)
+	})
+}
+
+// RegisterCipherSuite adds or replaces a cipher suite. newCipher must return
+// an AEAD with 12-byte nonces for keys of keySize bytes.
+func RegisterCipherSuite(suite CipherSuite, name string, keySize int, newCipher func(key []byte) (cipher.AEAD, error)) {
+	cipherSuitesMx.Lock()
+	defer cipherSuitesMx.Unlock()
+
+	cipherSuites[suite] = cipherSuiteInfo{
+		name:      name,
+		keySize:   keySize,
+		newCipher: newCipher,
+	}
+}
+
+func lookupCipherSuite(suite CipherSuite) (cipherSuiteInfo, bool) {
+	cipherSuitesMx.RLock()
+	defer cipherSuitesMx.RUnlock()
+
+	info, ok := cipherSuites[suite]
+	return info, ok
+}
+
+func (suite CipherSuite) String() string {
+	if info, ok := lookupCipherSuite(suite); ok {
+		return info.name
+	}
+	return "CipherSuite(" + strconv.Itoa(int(suite)) + ")"
+}
+
+// KeySize returns the length of traffic keys of the suite, or 0 if the suite is unknown.
+func (suite CipherSuite) KeySize() int {
+	info, _ := lookupCipherSuite(suite)
+	return info.keySize
+}
+
+// negotiateCipherSuite picks the first suite offered by the client that we accept.
+func negotiateCipherSuite(offered []byte, accepted []CipherSuite) (CipherSuite, error) {
+	for _, o := range offered {
+		for _, a := range accepted {
+			if CipherSuite(o) == a {
+				if _, ok := lookupCipherSuite(a); ok {
+					return a, nil
+				}
+			}
+		}
+	}
+	return 0, ErrNoCommonCipherSuite
+}
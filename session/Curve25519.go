@@ -47,6 +47,10 @@ func NewStaticCurve25519(privateKey [KEY_SIZE]byte) Curve25519 {
 	return curve
 }
 
+func (curve *Curve25519) GetPrivateKey() []byte {
+	return curve.privateKey[:]
+}
+
 func (curve *Curve25519) GetPublicKey() []byte {
 	return curve.publicKey[:]
 }
@@ -8,9 +8,9 @@ func TestNewStaticCurve25519(t *testing.T) {
 	private := [KEY_SIZE]byte{}
 	copy(private[:], []byte("Hello"))
 
-	_, err := NewStaticCurve25519(private)
+	curve := NewStaticCurve25519(private)
 
-	if err != nil {
-		t.Error(err)
+	if len(curve.GetPublicKey()) != KEY_SIZE {
+		t.Error("unexpected public key length")
 	}
 }
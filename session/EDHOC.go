@@ -0,0 +1,523 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// EDHOC (RFC 9528) with static-DH authentication of both parties (method 3)
+// and cipher suite 0: AES-CCM-16-64-128, SHA-256, 8 byte MAC, X25519.
+// Credentials are CWT Claims Sets with an X25519 COSE_Key identified by kid.
+// External authorization data is not supported and is ignored.
+
+const (
+	EDHOC_METHOD_STATIC_DH = 3
+	EDHOC_CIPHER_SUITE     = 0
+
+	edhocHashSize  = sha256.Size
+	edhocMACSize   = 8
+	edhocKeySize   = 16
+	edhocNonceSize = 13
+
+	EDHOC_OSCORE_SECRET_SIZE = 16
+	EDHOC_OSCORE_SALT_SIZE   = 8
+)
+
+var (
+	ErrEDHOCMessage            = errors.New("EDHOC: malformed message")
+	ErrEDHOCMethod             = errors.New("EDHOC: unsupported method")
+	ErrEDHOCCipherSuite        = errors.New("EDHOC: unsupported cipher suite")
+	ErrEDHOCUnknownCredential  = errors.New("EDHOC: unknown credential")
+	ErrEDHOCMAC                = errors.New("EDHOC: MAC verification failed")
+	ErrEDHOCDecrypt            = errors.New("EDHOC: decryption failed")
+	ErrEDHOCState              = errors.New("EDHOC: unexpected message")
+	ErrEDHOCConnectionIDsEqual = errors.New("EDHOC: connection identifiers must differ")
+)
+
+// EDHOCCredential is the static X25519 public key of a party identified by kid.
+type EDHOCCredential struct {
+	KID       []byte
+	Subject   string
+	PublicKey []byte
+}
+
+// EDHOCCredentialLookup resolves the credential of a peer by its kid.
+type EDHOCCredentialLookup func(kid []byte) (EDHOCCredential, bool)
+
+// encode returns CRED_x: a CWT Claims Set {2: sub, 8: {1: COSE_Key}}.
+func (c EDHOCCredential) encode() []byte {
+	res := cborMap(2)
+	res = append(res, cborInt(2)...)
+	res = append(res, cborText(c.Subject)...)
+	res = append(res, cborInt(8)...)
+	res = append(res, cborMap(1)...)
+	res = append(res, cborInt(1)...)
+	res = append(res, cborMap(4)...)
+	res = append(res, cborInt(1)...) // kty: OKP
+	res = append(res, cborInt(1)...)
+	res = append(res, cborInt(2)...) // kid
+	res = append(res, cborBytes(c.KID)...)
+	res = append(res, cborInt(-1)...) // crv: X25519
+	res = append(res, cborInt(4)...)
+	res = append(res, cborInt(-2)...) // x
+	return append(res, cborBytes(c.PublicKey)...)
+}
+
+// idCred returns ID_CRED_x: {4: kid}.
+func (c EDHOCCredential) idCred() []byte {
+	res := cborMap(1)
+	res = append(res, cborInt(4)...)
+	return append(res, cborBytes(c.KID)...)
+}
+
+// EDHOC runs one key exchange either as Initiator (Message1, ReceiveMessage2,
+// Message3) or as Responder (ReceiveMessage1, Message2, ReceiveMessage3).
+type EDHOC struct {
+	// C_I of the Initiator or C_R of the Responder. It becomes the OSCORE Recipient ID.
+	ConnectionID     []byte
+	PeerConnectionID []byte
+
+	Credential     EDHOCCredential
+	PeerCredential EDHOCCredential
+
+	credentials EDHOCCredentialLookup
+
+	static        Curve25519
+	ephemeral     Curve25519
+	peerEphemeral []byte
+
+	initiator bool
+	message1  []byte
+	th2       []byte
+	th3       []byte
+	prk2e     []byte
+	prk3e2m   []byte
+	prkOut    []byte
+}
+
+// NewEDHOC creates a party with its static key, its kid and connection identifier.
+// credentials resolves the static keys of peers.
+func NewEDHOC(static Curve25519, kid, connectionID []byte, credentials EDHOCCredentialLookup) (*EDHOC, error) {
+	ephemeral, err := NewCurve25519()
+	if err != nil {
+		return nil, err
+	}
+
+	return &EDHOC{
+		ConnectionID: connectionID,
+		Credential: EDHOCCredential{
+			KID:       kid,
+			PublicKey: static.GetPublicKey(),
+		},
+		credentials: credentials,
+		static:      static,
+		ephemeral:   ephemeral,
+	}, nil
+}
+
+func edhocHash(items ...[]byte) []byte {
+	h := sha256.New()
+	for _, item := range items {
+		h.Write(item)
+	}
+	return h.Sum(nil)
+}
+
+func edhocExtract(salt, ikm []byte) []byte {
+	return hkdf.Extract(sha256.New, ikm, salt)
+}
+
+func edhocKDF(prk []byte, label int, context []byte, length int) []byte {
+	info := append(cborInt(label), cborBytes(context)...)
+	info = append(info, cborInt(length)...)
+
+	res := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), res); err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// cborCompactID encodes a connection identifier or kid: one byte identifiers
+// that are valid one byte CBOR integers are encoded as integers.
+func cborCompactID(id []byte) []byte {
+	if len(id) == 1 && (id[0] <= 0x17 || (id[0] >= 0x20 && id[0] <= 0x37)) {
+		return []byte{id[0]}
+	}
+	return cborBytes(id)
+}
+
+func cborReadCompactID(data []byte) ([]byte, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, ErrCBOR
+	}
+	if major := data[0] >> 5; (major == cborMajorUint || major == cborMajorNegInt) && data[0]&0x1f < 24 {
+		return []byte{data[0]}, data[1:], nil
+	}
+	return cborReadBytes(data)
+}
+
+// cborReadIDCred reads ID_CRED_x either as a compact kid or as a {4: kid} map.
+func cborReadIDCred(data []byte) ([]byte, []byte, error) {
+	if len(data) > 0 && data[0]>>5 == cborMajorMap {
+		major, n, rest, err := cborReadHead(data)
+		if err != nil || major != cborMajorMap || n != 1 {
+			return nil, nil, ErrEDHOCUnknownCredential
+		}
+		label, rest, err := cborReadInt(rest)
+		if err != nil || label != 4 {
+			return nil, nil, ErrEDHOCUnknownCredential
+		}
+		return cborReadBytes(rest)
+	}
+	return cborReadCompactID(data)
+}
+
+func (e *EDHOC) peerCredential(kid []byte) error {
+	if e.credentials == nil {
+		return ErrEDHOCUnknownCredential
+	}
+	cred, ok := e.credentials(kid)
+	if !ok || len(cred.PublicKey) != KEY_SIZE {
+		return ErrEDHOCUnknownCredential
+	}
+	cred.KID = kid
+	e.PeerCredential = cred
+	return nil
+}
+
+// Message1 returns message_1 of the Initiator.
+func (e *EDHOC) Message1() []byte {
+	res := cborInt(EDHOC_METHOD_STATIC_DH)
+	res = append(res, cborInt(EDHOC_CIPHER_SUITE)...)
+	res = append(res, cborBytes(e.ephemeral.GetPublicKey())...)
+	res = append(res, cborCompactID(e.ConnectionID)...)
+	e.initiator = true
+	e.message1 = res
+	return res
+}
+
+// ReceiveMessage1 processes message_1 on the Responder.
+func (e *EDHOC) ReceiveMessage1(message []byte) error {
+	method, rest, err := cborReadInt(message)
+	if err != nil {
+		return ErrEDHOCMessage
+	}
+	if method != EDHOC_METHOD_STATIC_DH {
+		return ErrEDHOCMethod
+	}
+
+	// SUITES_I is the selected suite or an array of suites with the selected one last
+	var suite int
+	if len(rest) > 0 && rest[0]>>5 == cborMajorArray {
+		_, n, items, err := cborReadHead(rest)
+		if err != nil || n == 0 {
+			return ErrEDHOCMessage
+		}
+		for i := uint64(0); i < n; i++ {
+			if suite, items, err = cborReadInt(items); err != nil {
+				return ErrEDHOCMessage
+			}
+		}
+		rest = items
+	} else if suite, rest, err = cborReadInt(rest); err != nil {
+		return ErrEDHOCMessage
+	}
+	if suite != EDHOC_CIPHER_SUITE {
+		return ErrEDHOCCipherSuite
+	}
+
+	gx, rest, err := cborReadBytes(rest)
+	if err != nil || len(gx) != KEY_SIZE {
+		return ErrEDHOCMessage
+	}
+	ci, _, err := cborReadCompactID(rest)
+	if err != nil {
+		return ErrEDHOCMessage
+	}
+	if bytes.Equal(ci, e.ConnectionID) {
+		return ErrEDHOCConnectionIDsEqual
+	}
+
+	e.peerEphemeral = gx
+	e.PeerConnectionID = ci
+	e.message1 = message
+	return nil
+}
+
+// mac2 computes MAC_2 over the Responder's identity.
+func (e *EDHOC) mac2(responder EDHOCCredential, cr, ead2 []byte) []byte {
+	context := cborCompactID(cr)
+	context = append(context, responder.idCred()...)
+	context = append(context, cborBytes(e.th2)...)
+	context = append(context, responder.encode()...)
+	context = append(context, ead2...)
+	return edhocKDF(e.prk3e2m, 2, context, edhocMACSize)
+}
+
+// mac3 computes MAC_3 over the Initiator's identity.
+func (e *EDHOC) mac3(initiator EDHOCCredential, prk4e3m, ead3 []byte) []byte {
+	context := initiator.idCred()
+	context = append(context, cborBytes(e.th3)...)
+	context = append(context, initiator.encode()...)
+	context = append(context, ead3...)
+	return edhocKDF(prk4e3m, 6, context, edhocMACSize)
+}
+
+// keySchedule2 derives PRK_2e and PRK_3e2m. gRX is the DH secret of the
+// Responder's static key and the Initiator's ephemeral key.
+func (e *EDHOC) keySchedule2(gY, gXY, gRX []byte) {
+	e.th2 = edhocHash(cborBytes(gY), cborBytes(edhocHash(e.message1)))
+	e.prk2e = edhocExtract(e.th2, gXY)
+	salt3e2m := edhocKDF(e.prk2e, 1, e.th2, edhocHashSize)
+	e.prk3e2m = edhocExtract(salt3e2m, gRX)
+}
+
+// keySchedule3 derives PRK_4e3m from TH_3. gIY is the DH secret of the
+// Initiator's static key and the Responder's ephemeral key.
+func (e *EDHOC) keySchedule3(gIY []byte) []byte {
+	salt4e3m := edhocKDF(e.prk3e2m, 5, e.th3, edhocHashSize)
+	return edhocExtract(salt4e3m, gIY)
+}
+
+type edhocCipher3 struct {
+	aead  cipher.AEAD
+	nonce []byte
+	ad    []byte
+}
+
+func (e *EDHOC) aead3() (*edhocCipher3, error) {
+	block, err := aes.NewCipher(edhocKDF(e.prk3e2m, 3, e.th3, edhocKeySize))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := NewCCM(block, edhocMACSize, edhocNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	return &edhocCipher3{
+		aead:  aead,
+		nonce: edhocKDF(e.prk3e2m, 4, e.th3, edhocNonceSize),
+		ad:    cborArray(cborText("Encrypt0"), cborBytes(nil), cborBytes(e.th3)),
+	}, nil
+}
+
+// Message2 returns message_2 of the Responder.
+func (e *EDHOC) Message2() ([]byte, error) {
+	if e.initiator || e.peerEphemeral == nil || e.th2 != nil {
+		return nil, ErrEDHOCState
+	}
+
+	gXY, err := e.ephemeral.GenerateSharedSecret(e.peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	gRX, err := e.static.GenerateSharedSecret(e.peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	gY := e.ephemeral.GetPublicKey()
+	e.keySchedule2(gY, gXY, gRX)
+
+	plainText := cborCompactID(e.ConnectionID)
+	plainText = append(plainText, cborCompactID(e.Credential.KID)...)
+	plainText = append(plainText, cborBytes(e.mac2(e.Credential, e.ConnectionID, nil))...)
+
+	cipherText := make([]byte, len(plainText))
+	xorBytes(cipherText, plainText, edhocKDF(e.prk2e, 0, e.th2, len(plainText)))
+
+	e.th3 = edhocHash(cborBytes(e.th2), plainText, e.Credential.encode())
+
+	return cborBytes(append(append([]byte{}, gY...), cipherText...)), nil
+}
+
+// ReceiveMessage2 processes message_2 on the Initiator and authenticates the Responder.
+func (e *EDHOC) ReceiveMessage2(message []byte) error {
+	if !e.initiator || e.th2 != nil {
+		return ErrEDHOCState
+	}
+
+	data, _, err := cborReadBytes(message)
+	if err != nil || len(data) <= KEY_SIZE {
+		return ErrEDHOCMessage
+	}
+	gY, cipherText := data[:KEY_SIZE], data[KEY_SIZE:]
+
+	gXY, err := e.ephemeral.GenerateSharedSecret(gY)
+	if err != nil {
+		return err
+	}
+	e.th2 = edhocHash(cborBytes(gY), cborBytes(edhocHash(e.message1)))
+	e.prk2e = edhocExtract(e.th2, gXY)
+
+	plainText := make([]byte, len(cipherText))
+	xorBytes(plainText, cipherText, edhocKDF(e.prk2e, 0, e.th2, len(cipherText)))
+
+	cr, rest, err := cborReadCompactID(plainText)
+	if err != nil {
+		return ErrEDHOCMessage
+	}
+	if bytes.Equal(cr, e.ConnectionID) {
+		return ErrEDHOCConnectionIDsEqual
+	}
+	kid, rest, err := cborReadIDCred(rest)
+	if err != nil {
+		return err
+	}
+	mac2, ead2, err := cborReadBytes(rest)
+	if err != nil {
+		return ErrEDHOCMessage
+	}
+	if err = e.peerCredential(kid); err != nil {
+		return err
+	}
+
+	gRX, err := e.ephemeral.GenerateSharedSecret(e.PeerCredential.PublicKey)
+	if err != nil {
+		return err
+	}
+	e.keySchedule2(gY, gXY, gRX)
+
+	if !hmac.Equal(mac2, e.mac2(e.PeerCredential, cr, ead2)) {
+		return ErrEDHOCMAC
+	}
+
+	e.peerEphemeral = gY
+	e.PeerConnectionID = cr
+	e.th3 = edhocHash(cborBytes(e.th2), plainText, e.PeerCredential.encode())
+	return nil
+}
+
+// Message3 returns message_3 of the Initiator. The key exchange is complete
+// for the Initiator afterwards.
+func (e *EDHOC) Message3() ([]byte, error) {
+	if !e.initiator || e.th3 == nil || e.prkOut != nil {
+		return nil, ErrEDHOCState
+	}
+
+	gIY, err := e.static.GenerateSharedSecret(e.peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	prk4e3m := e.keySchedule3(gIY)
+
+	plainText := cborCompactID(e.Credential.KID)
+	plainText = append(plainText, cborBytes(e.mac3(e.Credential, prk4e3m, nil))...)
+
+	c, err := e.aead3()
+	if err != nil {
+		return nil, err
+	}
+	cipherText := c.aead.Seal(nil, c.nonce, plainText, c.ad)
+
+	e.finish(prk4e3m, plainText, e.Credential)
+	return cborBytes(cipherText), nil
+}
+
+// ReceiveMessage3 processes message_3 on the Responder and authenticates the
+// Initiator. The key exchange is complete for the Responder afterwards.
+func (e *EDHOC) ReceiveMessage3(message []byte) error {
+	if e.initiator || e.th3 == nil || e.prkOut != nil {
+		return ErrEDHOCState
+	}
+
+	cipherText, _, err := cborReadBytes(message)
+	if err != nil {
+		return ErrEDHOCMessage
+	}
+
+	c, err := e.aead3()
+	if err != nil {
+		return err
+	}
+	plainText, err := c.aead.Open(nil, c.nonce, cipherText, c.ad)
+	if err != nil {
+		return ErrEDHOCDecrypt
+	}
+
+	kid, rest, err := cborReadIDCred(plainText)
+	if err != nil {
+		return err
+	}
+	mac3, ead3, err := cborReadBytes(rest)
+	if err != nil {
+		return ErrEDHOCMessage
+	}
+	if err = e.peerCredential(kid); err != nil {
+		return err
+	}
+
+	gIY, err := e.ephemeral.GenerateSharedSecret(e.PeerCredential.PublicKey)
+	if err != nil {
+		return err
+	}
+	prk4e3m := e.keySchedule3(gIY)
+
+	if !hmac.Equal(mac3, e.mac3(e.PeerCredential, prk4e3m, ead3)) {
+		return ErrEDHOCMAC
+	}
+
+	e.finish(prk4e3m, plainText, e.PeerCredential)
+	return nil
+}
+
+func (e *EDHOC) finish(prk4e3m, plainText3 []byte, initiator EDHOCCredential) {
+	th4 := edhocHash(cborBytes(e.th3), plainText3, initiator.encode())
+	e.prkOut = edhocKDF(prk4e3m, 7, th4, edhocHashSize)
+}
+
+// Exporter derives application keys once the key exchange is complete.
+func (e *EDHOC) Exporter(label int, context []byte, length int) ([]byte, error) {
+	if e.prkOut == nil {
+		return nil, ErrEDHOCState
+	}
+	prkExporter := edhocKDF(e.prkOut, 10, nil, edhocHashSize)
+	return edhocKDF(prkExporter, label, context, length), nil
+}
+
+// ExportOSCORE derives the OSCORE Master Secret and Master Salt (RFC 9528, Appendix A.1).
+func (e *EDHOC) ExportOSCORE() (masterSecret, masterSalt []byte, err error) {
+	if masterSecret, err = e.Exporter(0, nil, EDHOC_OSCORE_SECRET_SIZE); err != nil {
+		return nil, nil, err
+	}
+	if masterSalt, err = e.Exporter(1, nil, EDHOC_OSCORE_SALT_SIZE); err != nil {
+		return nil, nil, err
+	}
+	return masterSecret, masterSalt, nil
+}
+
+// OSCOREContext creates the OSCORE security context of this party: the peer's
+// connection identifier is the Sender ID and its own is the Recipient ID.
+func (e *EDHOC) OSCOREContext() (*OSCOREContext, error) {
+	masterSecret, masterSalt, err := e.ExportOSCORE()
+	if err != nil {
+		return nil, err
+	}
+	return NewOSCOREContext(masterSecret, masterSalt, e.PeerConnectionID, e.ConnectionID, nil)
+}
+
+// EncodeEDHOCConnectionID encodes a connection identifier as it is prepended
+// to message_3 sent over CoAP.
+func EncodeEDHOCConnectionID(id []byte) []byte {
+	return cborCompactID(id)
+}
+
+// DecodeEDHOCConnectionID reads a connection identifier and returns the rest of data.
+func DecodeEDHOCConnectionID(data []byte) (id, rest []byte, err error) {
+	if id, rest, err = cborReadCompactID(data); err != nil {
+		return nil, nil, ErrEDHOCMessage
+	}
+	return id, rest, nil
+}
+
+// EDHOCError encodes an EDHOC error message with an unspecified error and diagnostic text.
+func EDHOCError(err error) []byte {
+	return append(cborInt(1), cborText(err.Error())...)
+}
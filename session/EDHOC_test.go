@@ -0,0 +1,126 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newEDHOCPair(t *testing.T) (initiator, responder *EDHOC) {
+	initiatorKey, err := NewCurve25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderKey, err := NewCurve25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := map[string]EDHOCCredential{
+		"\x0a": {PublicKey: initiatorKey.GetPublicKey()},
+		"\x32": {PublicKey: responderKey.GetPublicKey()},
+	}
+	lookup := func(kid []byte) (EDHOCCredential, bool) {
+		cred, ok := credentials[string(kid)]
+		return cred, ok
+	}
+
+	if initiator, err = NewEDHOC(initiatorKey, []byte{0x0a}, []byte{0x37}, lookup); err != nil {
+		t.Fatal(err)
+	}
+	if responder, err = NewEDHOC(responderKey, []byte{0x32}, []byte{0x27, 0x01}, lookup); err != nil {
+		t.Fatal(err)
+	}
+	return initiator, responder
+}
+
+func TestEDHOCExchange(t *testing.T) {
+	initiator, responder := newEDHOCPair(t)
+
+	if err := responder.ReceiveMessage1(initiator.Message1()); err != nil {
+		t.Fatal(err)
+	}
+	message2, err := responder.Message2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = initiator.ReceiveMessage2(message2); err != nil {
+		t.Fatal(err)
+	}
+	message3, err := initiator.Message3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = responder.ReceiveMessage3(message3); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(initiator.PeerConnectionID, responder.ConnectionID) || !bytes.Equal(responder.PeerConnectionID, initiator.ConnectionID) {
+		t.Fatal("connection identifiers are not exchanged")
+	}
+	if !bytes.Equal(initiator.PeerCredential.KID, []byte{0x32}) || !bytes.Equal(responder.PeerCredential.KID, []byte{0x0a}) {
+		t.Fatal("credentials are not exchanged")
+	}
+
+	initiatorSecret, initiatorSalt, err := initiator.ExportOSCORE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderSecret, responderSalt, err := responder.ExportOSCORE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(initiatorSecret, responderSecret) || !bytes.Equal(initiatorSalt, responderSalt) {
+		t.Fatal("exported OSCORE master secret and salt are not equal")
+	}
+
+	client, err := initiator.OSCOREContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := responder.OSCOREContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	partialIV, cipherText, err := client.Seal([]byte("request"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := server.Open(partialIV, cipherText, nil, nil); err != nil || string(text) != "request" {
+		t.Fatalf("unexpected request %q: %v", text, err)
+	}
+}
+
+func TestEDHOCUnknownInitiator(t *testing.T) {
+	initiator, responder := newEDHOCPair(t)
+	initiator.Credential.KID = []byte{0x0b}
+
+	responder.ReceiveMessage1(initiator.Message1())
+	message2, _ := responder.Message2()
+	if err := initiator.ReceiveMessage2(message2); err != nil {
+		t.Fatal(err)
+	}
+	message3, _ := initiator.Message3()
+	if err := responder.ReceiveMessage3(message3); err != ErrEDHOCUnknownCredential {
+		t.Fatalf("expected %v, got %v", ErrEDHOCUnknownCredential, err)
+	}
+}
+
+func TestEDHOCTamperedMessage2(t *testing.T) {
+	initiator, responder := newEDHOCPair(t)
+
+	responder.ReceiveMessage1(initiator.Message1())
+	message2, _ := responder.Message2()
+	message2[len(message2)-1] ^= 1
+	if err := initiator.ReceiveMessage2(message2); err != ErrEDHOCMAC {
+		t.Fatalf("expected %v, got %v", ErrEDHOCMAC, err)
+	}
+}
+
+func TestEDHOCCompactID(t *testing.T) {
+	for _, id := range [][]byte{{0x00}, {0x17}, {0x20}, {0x37}, {0x18}, {0x38}, {0xff}, {}, {0x01, 0x02}} {
+		decoded, rest, err := cborReadCompactID(cborCompactID(id))
+		if err != nil || len(rest) != 0 || !bytes.Equal(decoded, id) {
+			t.Fatalf("identifier %x decoded as %x", id, decoded)
+		}
+	}
+}
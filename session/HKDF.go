@@ -7,20 +7,43 @@ import (
 	"golang.org/x/crypto/hkdf"
 )
 
-var keyLen int = 16
-
+// DeriveKeysFromSharedSecret derives traffic keys of the default AES-128-GCM cipher suite.
 func DeriveKeysFromSharedSecret(sharedSecret, salt, info []byte) ([]byte, []byte, []byte, []byte, error) {
+	return DeriveSuiteKeysFromSharedSecret(CipherSuiteAES128GCM, sharedSecret, salt, info)
+}
+
+func DeriveSuiteKeysFromSharedSecret(suite CipherSuite, sharedSecret, salt, info []byte) ([]byte, []byte, []byte, []byte, error) {
+	keyLen := suite.KeySize()
+	if keyLen == 0 {
+		return nil, nil, nil, nil, ErrUnknownCipherSuite
+	}
+
 	r := hkdf.New(sha256.New, sharedSecret, salt, info)
 
-	s := make([]byte, 2*keyLen+2*4)
+	s := make([]byte, 2*keyLen+2*IV_SIZE)
 	if _, err := io.ReadFull(r, s); err != nil {
 		return nil, nil, nil, nil, err
 	}
 
 	peerKey := s[:keyLen]
 	myKey := s[keyLen : 2*keyLen]
-	peerIV := s[2*keyLen : 2*keyLen+4]
-	myIV := s[2*keyLen+4:]
+	peerIV := s[2*keyLen : 2*keyLen+IV_SIZE]
+	myIV := s[2*keyLen+IV_SIZE:]
 
 	return peerKey, myKey, peerIV, myIV, nil
 }
+
+var confirmationInfo = []byte("coala key confirmation")
+
+// DeriveConfirmationKey derives the HMAC key used by both sides to prove
+// they have computed the same traffic keys during the handshake.
+func DeriveConfirmationKey(sharedSecret, salt, info []byte) ([]byte, error) {
+	r := hkdf.New(sha256.New, sharedSecret, salt, append(append([]byte{}, confirmationInfo...), info...))
+
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,192 @@
+package session
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Identity is a long-term Ed25519 key. It signs the handshake transcript, and
+// with it the ephemeral Curve25519 keys, so that sessions keep forward secrecy
+// while the peer is identified by a stable key.
+type Identity struct {
+	PrivateKey ed25519.PrivateKey
+}
+
+const IDENTITY_PROOF_SIZE = ed25519.PublicKeySize + ed25519.SignatureSize
+
+var (
+	ErrInvalidIdentity          = errors.New("identity: expected Ed25519 key")
+	ErrIdentitySignatureInvalid = errors.New("identity: signature verification failed")
+)
+
+var (
+	clientIdentityLabel = []byte("coala client identity")
+	peerIdentityLabel   = []byte("coala peer identity")
+)
+
+func NewIdentity() (Identity, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{PrivateKey: privateKey}, nil
+}
+
+func NewIdentityFromSeed(seed []byte) (Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return Identity{}, ErrInvalidIdentity
+	}
+	return Identity{PrivateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+func (id Identity) PublicKey() ed25519.PublicKey {
+	return id.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// proof returns the public key and its signature of label || transcript.
+func (id Identity) proof(label, transcript []byte) []byte {
+	signature := ed25519.Sign(id.PrivateKey, append(append([]byte{}, label...), transcript...))
+	return append(append([]byte{}, id.PublicKey()...), signature...)
+}
+
+func verifyIdentityProof(proof, label, transcript []byte) (ed25519.PublicKey, error) {
+	if len(proof) != IDENTITY_PROOF_SIZE {
+		return nil, ErrIdentitySignatureInvalid
+	}
+	publicKey := ed25519.PublicKey(append([]byte{}, proof[:ed25519.PublicKeySize]...))
+	if !ed25519.Verify(publicKey, append(append([]byte{}, label...), transcript...), proof[ed25519.PublicKeySize:]) {
+		return nil, ErrIdentitySignatureInvalid
+	}
+	return publicKey, nil
+}
+
+// MarshalPEM encodes the private key as PKCS #8 "PRIVATE KEY".
+func (id Identity) MarshalPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(id.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalOpenSSH encodes the private key as unencrypted "OPENSSH PRIVATE KEY".
+func (id Identity) MarshalOpenSSH(comment string) ([]byte, error) {
+	if len(id.PrivateKey) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidIdentity
+	}
+
+	publicKey := sshString(nil, []byte(ssh.KeyAlgoED25519))
+	publicKey = sshString(publicKey, id.PublicKey())
+
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	private := append(check[:], check[:]...)
+	private = sshString(private, []byte(ssh.KeyAlgoED25519))
+	private = sshString(private, id.PublicKey())
+	private = sshString(private, id.PrivateKey)
+	private = sshString(private, []byte(comment))
+	for i := byte(1); len(private)%8 != 0; i++ {
+		private = append(private, i)
+	}
+
+	data := []byte("openssh-key-v1\x00")
+	data = sshString(data, []byte("none"))
+	data = sshString(data, []byte("none"))
+	data = sshString(data, nil)
+	data = sshUint32(data, 1)
+	data = sshString(data, publicKey)
+	data = sshString(data, private)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data}), nil
+}
+
+func sshUint32(dst []byte, n uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return append(dst, b[:]...)
+}
+
+func sshString(dst, s []byte) []byte {
+	return append(sshUint32(dst, uint32(len(s))), s...)
+}
+
+// ParseIdentity decodes a private key in PKCS #8 PEM or OpenSSH format.
+func ParseIdentity(data []byte) (Identity, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Identity{}, ErrInvalidIdentity
+	}
+
+	var key interface{}
+	var err error
+	if block.Type == "PRIVATE KEY" {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	} else {
+		key, err = ssh.ParseRawPrivateKey(data)
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return Identity{PrivateKey: k}, nil
+	case *ed25519.PrivateKey:
+		return Identity{PrivateKey: *k}, nil
+	}
+	return Identity{}, ErrInvalidIdentity
+}
+
+// MarshalPublicKeyPEM encodes an identity public key as PKIX "PUBLIC KEY".
+func MarshalPublicKeyPEM(publicKey ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// MarshalPublicKeyOpenSSH encodes an identity public key as an authorized_keys line.
+func MarshalPublicKeyOpenSSH(publicKey ed25519.PublicKey) ([]byte, error) {
+	key, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.MarshalAuthorizedKey(key), nil
+}
+
+// ParsePublicKey decodes an identity public key in PKIX PEM or authorized_keys format.
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	var key interface{}
+	if block, _ := pem.Decode(data); block != nil {
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	} else {
+		k, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		cryptoKey, ok := k.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, ErrInvalidIdentity
+		}
+		key = cryptoKey.CryptoPublicKey()
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, ErrInvalidIdentity
+	}
+	return publicKey, nil
+}
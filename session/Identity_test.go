@@ -0,0 +1,112 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIdentityHandshake(t *testing.T) {
+	clientIdentity, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerIdentity, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewSecuredSessionWithIdentity(clientIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := NewSecuredSessionWithIdentity(peerIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.ReceiveClientHello(client.ClientHello()); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.ReceivePeerHello(peer.PeerHello()); err != nil {
+		t.Fatal(err)
+	}
+
+	clientSignature, err := client.ClientSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.VerifyClientSignature(clientSignature); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.VerifyPeerSignature(peer.PeerSignature()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(peer.PeerIdentity, clientIdentity.PublicKey()) {
+		t.Fatal("peer has not verified the client identity")
+	}
+	if !bytes.Equal(client.PeerIdentity, peerIdentity.PublicKey()) {
+		t.Fatal("client has not verified the peer identity")
+	}
+}
+
+func TestIdentityForgedProof(t *testing.T) {
+	client, peer := newHandshakePair(t)
+
+	// An attacker's identity signs someone else's transcript
+	attacker, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSignature, err := client.ClientSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSignature = append(clientSignature, attacker.proof(clientIdentityLabel, []byte("other transcript"))...)
+
+	if err = peer.VerifyClientSignature(clientSignature); err != ErrIdentitySignatureInvalid {
+		t.Fatalf("expected %v, got %v", ErrIdentitySignatureInvalid, err)
+	}
+}
+
+func TestIdentityFormats(t *testing.T) {
+	identity, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemKey, err := identity.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshKey, err := identity.MarshalOpenSSH("coala")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{pemKey, sshKey} {
+		parsed, err := ParseIdentity(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parsed.PrivateKey, identity.PrivateKey) {
+			t.Fatalf("private key is not restored from %s", data)
+		}
+	}
+
+	pemPublicKey, err := MarshalPublicKeyPEM(identity.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPublicKey, err := MarshalPublicKeyOpenSSH(identity.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{pemPublicKey, sshPublicKey} {
+		parsed, err := ParsePublicKey(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parsed, identity.PublicKey()) {
+			t.Fatalf("public key is not restored from %s", data)
+		}
+	}
+}
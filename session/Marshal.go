@@ -0,0 +1,77 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// securedSessionState is the persistent state of an established session.
+// The traffic keys are enough to go on with the session, so the private key
+// of the handshake is not kept. They must still be stored securely.
+type securedSessionState struct {
+	PeerPublicKey []byte      `json:"peer_public_key"`
+	PeerIdentity  []byte      `json:"peer_identity,omitempty"`
+	ID            []byte      `json:"id,omitempty"`
+	Suite         CipherSuite `json:"suite"`
+	PeerKey       []byte      `json:"peer_key"`
+	MyKey         []byte      `json:"my_key"`
+	PeerIV        []byte      `json:"peer_iv"`
+	MyIV          []byte      `json:"my_iv"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     int         `json:"updated_at"`
+	Messages      int64       `json:"messages"`
+	Bytes         int64       `json:"bytes"`
+}
+
+var ErrSessionNotEstablished = errors.New("session is not established")
+
+func (session SecuredSession) MarshalJSON() ([]byte, error) {
+	if session.AEAD == nil {
+		return nil, ErrSessionNotEstablished
+	}
+
+	peerKey, myKey, peerIV, myIV := session.AEAD.Keys()
+
+	return json.Marshal(securedSessionState{
+		PeerPublicKey: session.PeerPublicKey,
+		PeerIdentity:  session.PeerIdentity,
+		ID:            session.ID,
+		Suite:         session.AEAD.Suite(),
+		PeerKey:       peerKey,
+		MyKey:         myKey,
+		PeerIV:        peerIV,
+		MyIV:          myIV,
+		CreatedAt:     session.CreatedAt,
+		UpdatedAt:     session.UpdatedAt,
+		Messages:      session.Usage.Messages(),
+		Bytes:         session.Usage.Bytes(),
+	})
+}
+
+func (session *SecuredSession) UnmarshalJSON(data []byte) error {
+	var state securedSessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	aead, err := NewAEADWithSuite(state.Suite, state.PeerKey, state.MyKey, state.PeerIV, state.MyIV)
+	if err != nil {
+		return err
+	}
+
+	*session = SecuredSession{
+		AEAD:          aead,
+		PeerPublicKey: state.PeerPublicKey,
+		PeerIdentity:  state.PeerIdentity,
+		ID:            state.ID,
+		UpdatedAt:     state.UpdatedAt,
+		CreatedAt:     state.CreatedAt,
+		Usage:         &Usage{messages: state.Messages, bytes: state.Bytes},
+		CipherSuites:  []CipherSuite{state.Suite},
+		Suite:         state.Suite,
+		Restored:      true,
+	}
+
+	return nil
+}
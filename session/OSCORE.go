@@ -0,0 +1,336 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// OSCORE (RFC 8613) security context with AES-CCM-16-64-128.
+
+const (
+	OSCORE_ALG_AES_CCM_16_64_128 = 10
+
+	OSCORE_KEY_SIZE   = 16
+	OSCORE_NONCE_SIZE = 13
+	OSCORE_TAG_SIZE   = 8
+
+	// Sender and Recipient IDs fit in the nonce next to the longest Partial IV
+	OSCORE_MAX_ID_SIZE = OSCORE_NONCE_SIZE - 6
+
+	// Maximum Partial IV is 5 bytes long
+	oscoreMaxSequenceNumber = 1<<40 - 1
+
+	// Coala keeps up to DEFAULT_WINDOW_SIZE blocks in flight, so the replay
+	// window is larger than the 32 entries suggested by RFC 8613.
+	OSCORE_REPLAY_WINDOW_SIZE = 128
+)
+
+var (
+	ErrOSCORESequenceExhausted = errors.New("OSCORE: sender sequence number exhausted")
+	ErrOSCOREReplay            = errors.New("OSCORE: replayed message")
+	ErrOSCOREDecrypt           = errors.New("OSCORE: decryption failed")
+	ErrOSCOREOption            = errors.New("OSCORE: malformed option")
+	ErrOSCOREIDLength          = errors.New("OSCORE: Sender and Recipient IDs must not be longer than 7 bytes")
+)
+
+type OSCOREContext struct {
+	SenderID    []byte
+	RecipientID []byte
+	IDContext   []byte
+
+	SenderKey    []byte
+	RecipientKey []byte
+	CommonIV     []byte
+
+	sender    cipher.AEAD
+	recipient cipher.AEAD
+
+	mx                   sync.Mutex
+	senderSequenceNumber uint64
+	replay               replayWindow
+}
+
+// NewOSCOREContext derives an OSCORE security context from a master secret and salt.
+// The IDs of the client and the server are swapped on the other side.
+func NewOSCOREContext(masterSecret, masterSalt, senderID, recipientID, idContext []byte) (*OSCOREContext, error) {
+	if len(senderID) > OSCORE_MAX_ID_SIZE || len(recipientID) > OSCORE_MAX_ID_SIZE {
+		return nil, ErrOSCOREIDLength
+	}
+
+	c := &OSCOREContext{
+		SenderID:    senderID,
+		RecipientID: recipientID,
+		IDContext:   idContext,
+	}
+
+	var err error
+	if c.SenderKey, err = oscoreDerive(masterSecret, masterSalt, senderID, idContext, "Key", OSCORE_KEY_SIZE); err != nil {
+		return nil, err
+	}
+	if c.RecipientKey, err = oscoreDerive(masterSecret, masterSalt, recipientID, idContext, "Key", OSCORE_KEY_SIZE); err != nil {
+		return nil, err
+	}
+	if c.CommonIV, err = oscoreDerive(masterSecret, masterSalt, []byte{}, idContext, "IV", OSCORE_NONCE_SIZE); err != nil {
+		return nil, err
+	}
+
+	if c.sender, err = newAESCCM(c.SenderKey); err != nil {
+		return nil, err
+	}
+	if c.recipient, err = newAESCCM(c.RecipientKey); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func newAESCCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewCCM(block, OSCORE_TAG_SIZE, OSCORE_NONCE_SIZE)
+}
+
+func oscoreDerive(masterSecret, masterSalt, id, idContext []byte, kind string, size int) ([]byte, error) {
+	info := cborArray(
+		cborBytes(id),
+		cborBytesOrNull(idContext),
+		cborInt(OSCORE_ALG_AES_CCM_16_64_128),
+		cborText(kind),
+		cborInt(size),
+	)
+
+	r := hkdf.New(sha256.New, masterSecret, masterSalt, info)
+	res := make([]byte, size)
+	if _, err := io.ReadFull(r, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// nonce builds the AEAD nonce from the ID of the Partial IV's owner and the Partial IV.
+func (c *OSCOREContext) nonce(id, partialIV []byte) []byte {
+	nonce := make([]byte, OSCORE_NONCE_SIZE)
+	nonce[0] = byte(len(id))
+	copy(nonce[OSCORE_NONCE_SIZE-5-len(id):OSCORE_NONCE_SIZE-5], id)
+	copy(nonce[OSCORE_NONCE_SIZE-len(partialIV):], partialIV)
+	xorBytes(nonce, nonce, c.CommonIV)
+	return nonce
+}
+
+// oscoreAAD builds the Enc_structure of COSE_Encrypt0 with the OSCORE external_aad.
+func oscoreAAD(requestKID, requestPIV []byte) []byte {
+	externalAAD := cborArray(
+		cborInt(1),
+		cborArray(cborInt(OSCORE_ALG_AES_CCM_16_64_128)),
+		cborBytes(requestKID),
+		cborBytes(requestPIV),
+		cborBytes(nil),
+	)
+	return cborArray(
+		cborText("Encrypt0"),
+		cborBytes(nil),
+		cborBytes(externalAAD),
+	)
+}
+
+func (c *OSCOREContext) nextPartialIV() ([]byte, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.senderSequenceNumber > oscoreMaxSequenceNumber {
+		return nil, ErrOSCORESequenceExhausted
+	}
+	piv := encodePartialIV(c.senderSequenceNumber)
+	c.senderSequenceNumber++
+	return piv, nil
+}
+
+func encodePartialIV(n uint64) []byte {
+	piv := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		piv = append([]byte{byte(n)}, piv...)
+	}
+	return piv
+}
+
+func decodePartialIV(piv []byte) uint64 {
+	var n uint64
+	for _, b := range piv {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+// Seal protects a message with a fresh Partial IV of ours. A request is bound to
+// its own kid and Partial IV: pass nil requestKID. A response is bound to the
+// kid and Partial IV of the request it answers.
+func (c *OSCOREContext) Seal(plainText, requestKID, requestPIV []byte) (partialIV, cipherText []byte, err error) {
+	partialIV, err = c.nextPartialIV()
+	if err != nil {
+		return nil, nil, err
+	}
+	if requestKID == nil {
+		requestKID, requestPIV = c.SenderID, partialIV
+	}
+
+	cipherText = c.sender.Seal(nil, c.nonce(c.SenderID, partialIV), plainText, oscoreAAD(requestKID, requestPIV))
+	return partialIV, cipherText, nil
+}
+
+// Open verifies and decrypts a message of the peer. Arguments mirror Seal.
+// A response without Partial IV uses the nonce of its request.
+func (c *OSCOREContext) Open(partialIV, cipherText, requestKID, requestPIV []byte) ([]byte, error) {
+	var nonce []byte
+	switch {
+	case len(partialIV) > 0:
+		nonce = c.nonce(c.RecipientID, partialIV)
+	case requestKID != nil:
+		nonce = c.nonce(requestKID, requestPIV)
+	default:
+		return nil, ErrOSCOREOption
+	}
+	if requestKID == nil {
+		requestKID, requestPIV = c.RecipientID, partialIV
+	}
+
+	if len(partialIV) > 0 && !c.replay.check(decodePartialIV(partialIV)) {
+		return nil, ErrOSCOREReplay
+	}
+
+	plainText, err := c.recipient.Open(nil, nonce, cipherText, oscoreAAD(requestKID, requestPIV))
+	if err != nil {
+		return nil, ErrOSCOREDecrypt
+	}
+
+	if len(partialIV) > 0 && !c.replay.accept(decodePartialIV(partialIV)) {
+		return nil, ErrOSCOREReplay
+	}
+	return plainText, nil
+}
+
+// replayWindow is a sliding window over received Partial IVs.
+type replayWindow struct {
+	mx      sync.Mutex
+	started bool
+	highest uint64
+	seen    [OSCORE_REPLAY_WINDOW_SIZE / 64]uint64
+}
+
+func (w *replayWindow) check(n uint64) bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.isFresh(n)
+}
+
+func (w *replayWindow) isFresh(n uint64) bool {
+	if !w.started || n > w.highest {
+		return true
+	}
+	diff := w.highest - n
+	if diff >= OSCORE_REPLAY_WINDOW_SIZE {
+		return false
+	}
+	return w.seen[diff/64]&(1<<(diff%64)) == 0
+}
+
+func (w *replayWindow) accept(n uint64) bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if !w.isFresh(n) {
+		return false
+	}
+
+	if !w.started || n > w.highest {
+		shift := n - w.highest
+		if !w.started {
+			shift = OSCORE_REPLAY_WINDOW_SIZE
+		}
+		w.shift(shift)
+		w.highest = n
+		w.started = true
+	}
+
+	diff := w.highest - n
+	w.seen[diff/64] |= 1 << (diff % 64)
+	return true
+}
+
+func (w *replayWindow) shift(n uint64) {
+	if n >= OSCORE_REPLAY_WINDOW_SIZE {
+		w.seen = [OSCORE_REPLAY_WINDOW_SIZE / 64]uint64{}
+		return
+	}
+	for ; n > 0; n-- {
+		var carry uint64
+		for i := range w.seen {
+			next := w.seen[i] >> 63
+			w.seen[i] = w.seen[i]<<1 | carry
+			carry = next
+		}
+	}
+}
+
+// EncodeOSCOREOption encodes the value of the OSCORE option. kid is omitted when nil.
+func EncodeOSCOREOption(partialIV, kid, kidContext []byte) []byte {
+	if len(partialIV) == 0 && kid == nil && kidContext == nil {
+		return []byte{}
+	}
+
+	flags := byte(len(partialIV))
+	if kid != nil {
+		flags |= 0x08
+	}
+	if kidContext != nil {
+		flags |= 0x10
+	}
+
+	res := append([]byte{flags}, partialIV...)
+	if kidContext != nil {
+		res = append(res, byte(len(kidContext)))
+		res = append(res, kidContext...)
+	}
+	return append(res, kid...)
+}
+
+// DecodeOSCOREOption decodes the value of the OSCORE option. kid is nil when absent.
+func DecodeOSCOREOption(value []byte) (partialIV, kid, kidContext []byte, err error) {
+	if len(value) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	flags := value[0]
+	value = value[1:]
+	if flags&0xe0 != 0 {
+		return nil, nil, nil, ErrOSCOREOption
+	}
+
+	n := int(flags & 0x07)
+	if n > 5 || len(value) < n {
+		return nil, nil, nil, ErrOSCOREOption
+	}
+	partialIV, value = value[:n], value[n:]
+
+	if flags&0x10 != 0 {
+		if len(value) < 1 || len(value) < 1+int(value[0]) {
+			return nil, nil, nil, ErrOSCOREOption
+		}
+		kidContext, value = value[1:1+int(value[0])], value[1+int(value[0]):]
+	}
+
+	if flags&0x08 != 0 {
+		kid = append([]byte{}, value...)
+	} else if len(value) > 0 {
+		return nil, nil, nil, ErrOSCOREOption
+	}
+
+	return partialIV, kid, kidContext, nil
+}
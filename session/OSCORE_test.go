@@ -0,0 +1,211 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+func fromHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 3610, Packet Vector #1
+func TestCCMVector(t *testing.T) {
+	block, err := aes.NewCipher(fromHex(t, "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccm, err := NewCCM(block, 8, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := fromHex(t, "00000003020100a0a1a2a3a4a5")
+	aad := fromHex(t, "0001020304050607")
+	plainText := fromHex(t, "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e")
+	expected := fromHex(t, "588c979a61c663d2f066d0c2c0f989806d5f6b61dac38417e8d12cfdf926e0")
+
+	cipherText := ccm.Seal(nil, nonce, plainText, aad)
+	if !bytes.Equal(cipherText, expected) {
+		t.Fatalf("unexpected cipher text %x", cipherText)
+	}
+
+	text, err := ccm.Open(nil, nonce, cipherText, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(text, plainText) {
+		t.Fatal("Seal & Open are not Equal")
+	}
+
+	cipherText[0] ^= 1
+	if _, err = ccm.Open(nil, nonce, cipherText, aad); err == nil {
+		t.Fatal("expected authentication failure")
+	}
+}
+
+// RFC 8613, Appendix C.1.1 and C.4
+func TestOSCOREVectors(t *testing.T) {
+	client, err := NewOSCOREContext(
+		fromHex(t, "0102030405060708090a0b0c0d0e0f10"),
+		fromHex(t, "9e7ca92223786340"),
+		[]byte{}, []byte{0x01}, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(client.SenderKey, fromHex(t, "f0910ed7295e6ad4b54fc793154302ff")) {
+		t.Fatalf("unexpected sender key %x", client.SenderKey)
+	}
+	if !bytes.Equal(client.RecipientKey, fromHex(t, "ffb14e093c94c9cac9471648b4f98710")) {
+		t.Fatalf("unexpected recipient key %x", client.RecipientKey)
+	}
+	if !bytes.Equal(client.CommonIV, fromHex(t, "4622d4dd6d944168eefb54987c")) {
+		t.Fatalf("unexpected common IV %x", client.CommonIV)
+	}
+
+	partialIV := []byte{0x14}
+	if aad := oscoreAAD(client.SenderID, partialIV); !bytes.Equal(aad, fromHex(t, "8368456e63727970743040488501810a40411440")) {
+		t.Fatalf("unexpected AAD %x", aad)
+	}
+	if nonce := client.nonce(client.SenderID, partialIV); !bytes.Equal(nonce, fromHex(t, "4622d4dd6d944168eefb549868")) {
+		t.Fatalf("unexpected nonce %x", nonce)
+	}
+
+	client.senderSequenceNumber = 20
+	piv, cipherText, err := client.Seal(fromHex(t, "01b3747631"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(piv, partialIV) {
+		t.Fatalf("unexpected partial IV %x", piv)
+	}
+	if !bytes.Equal(cipherText, fromHex(t, "612f1092f1776f1c1668b3825e")) {
+		t.Fatalf("unexpected cipher text %x", cipherText)
+	}
+}
+
+func newOSCOREPair(t *testing.T) (client, server *OSCOREContext) {
+	secret, salt := []byte("master secret 16"), []byte("salt")
+	client, err := NewOSCOREContext(secret, salt, []byte{}, []byte{0x01}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewOSCOREContext(secret, salt, []byte{0x01}, []byte{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestOSCORERequestResponse(t *testing.T) {
+	client, server := newOSCOREPair(t)
+
+	requestPIV, cipherText, err := client.Seal([]byte("request"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := server.Open(requestPIV, cipherText, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(text) != "request" {
+		t.Fatalf("unexpected request %q", text)
+	}
+
+	// Replayed request is rejected
+	if _, err = server.Open(requestPIV, cipherText, nil, nil); err != ErrOSCOREReplay {
+		t.Fatalf("expected %v, got %v", ErrOSCOREReplay, err)
+	}
+
+	responsePIV, cipherText, err := server.Seal([]byte("response"), client.SenderID, requestPIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err = client.Open(responsePIV, cipherText, client.SenderID, requestPIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(text) != "response" {
+		t.Fatalf("unexpected response %q", text)
+	}
+
+	// Response bound to another request is rejected
+	_, cipherText, _ = server.Seal([]byte("response"), client.SenderID, []byte{0x42})
+	if _, err = client.Open([]byte{0x01}, cipherText, client.SenderID, requestPIV); err != ErrOSCOREDecrypt {
+		t.Fatalf("expected %v, got %v", ErrOSCOREDecrypt, err)
+	}
+}
+
+func TestOSCOREIDLength(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	long := bytes.Repeat([]byte{0x01}, OSCORE_MAX_ID_SIZE+1)
+	if _, err := NewOSCOREContext(secret, nil, long, []byte{}, nil); err != ErrOSCOREIDLength {
+		t.Fatalf("expected %v, got %v", ErrOSCOREIDLength, err)
+	}
+	if _, err := NewOSCOREContext(secret, nil, []byte{}, long, nil); err != ErrOSCOREIDLength {
+		t.Fatalf("expected %v, got %v", ErrOSCOREIDLength, err)
+	}
+
+	id := bytes.Repeat([]byte{0x01}, OSCORE_MAX_ID_SIZE)
+	client, err := NewOSCOREContext(secret, nil, id, []byte{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewOSCOREContext(secret, nil, []byte{}, id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partialIV, cipherText, err := client.Seal([]byte("request"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.Open(partialIV, cipherText, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOSCOREReplayWindow(t *testing.T) {
+	var w replayWindow
+
+	for _, n := range []uint64{5, 3, 200, 199, 100} {
+		if !w.accept(n) {
+			t.Fatalf("%d should be accepted", n)
+		}
+	}
+	for _, n := range []uint64{5, 3, 200, 199, 100, 72} {
+		if w.accept(n) {
+			t.Fatalf("%d should be rejected", n)
+		}
+	}
+	if !w.accept(150) {
+		t.Fatal("150 should be accepted")
+	}
+}
+
+func TestOSCOREOption(t *testing.T) {
+	value := EncodeOSCOREOption([]byte{0x14}, []byte{}, nil)
+	if !bytes.Equal(value, []byte{0x09, 0x14}) {
+		t.Fatalf("unexpected option %x", value)
+	}
+
+	value = EncodeOSCOREOption([]byte{0x05}, []byte{0x01}, []byte{0x37, 0xcb})
+	partialIV, kid, kidContext, err := DecodeOSCOREOption(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(partialIV, []byte{0x05}) || !bytes.Equal(kid, []byte{0x01}) || !bytes.Equal(kidContext, []byte{0x37, 0xcb}) {
+		t.Fatalf("unexpected decoded option %x %x %x", partialIV, kid, kidContext)
+	}
+
+	if len(EncodeOSCOREOption(nil, nil, nil)) != 0 {
+		t.Fatal("expected empty option")
+	}
+}
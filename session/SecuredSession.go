@@ -1,16 +1,64 @@
 package session
 
 import (
-	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"errors"
+	"time"
 )
 
+const NONCE_SIZE int = 32
+
+var (
+	ErrSignatureMismatch = errors.New("signature and peerSignature are not Equal")
+	ErrInvalidHello      = errors.New("hello: expected public key and nonce")
+)
+
+// Labels bind a confirmation signature to the side that produced it,
+// so a peer cannot reflect our own signature back to us.
+var (
+	clientSignatureLabel = []byte("coala client signature")
+	peerSignatureLabel   = []byte("coala peer signature")
+	sessionIDLabel       = []byte("coala session id")
+)
+
+const SESSION_ID_SIZE = 16
+
 type SecuredSession struct {
 	Curve         Curve25519
 	AEAD          AEAD
 	PeerPublicKey []byte
 	UpdatedAt     int
+	CreatedAt     time.Time
+	Usage         *Usage
+
+	// Fresh random data of both sides, so that every handshake derives
+	// unique keys even when both ends use static Curve25519 keys.
+	Nonce     []byte
+	PeerNonce []byte
+
+	// CipherSuites we offer as a client or accept as a peer, in order of preference
+	CipherSuites []CipherSuite
+	// Suite is the cipher suite negotiated during the handshake
+	Suite CipherSuite
+
+	// Identity signs our side of the handshake when set.
+	// PeerIdentity is the peer's identity verified during the handshake, if it sent one.
+	Identity     *Identity
+	PeerIdentity ed25519.PublicKey
+
+	// ID is a fingerprint of the handshake transcript, the same on both sides.
+	ID []byte
+
+	// Restored sessions are loaded from storage without their Curve. The
+	// message IDs used as nonces before may come again, so they are
+	// renegotiated before use.
+	Restored bool
+
+	offeredSuites   []byte
+	confirmationKey []byte
 }
 
 func NewSecuredSession(privateKey []byte) (session SecuredSession, err error) {
@@ -23,91 +71,227 @@ func NewSecuredSession(privateKey []byte) (session SecuredSession, err error) {
 	if err != nil {
 		return session, err
 	}
+
+	session.CipherSuites = DefaultCipherSuites
+	session.CreatedAt = time.Now()
+	session.Usage = new(Usage)
+
+	session.Nonce = make([]byte, NONCE_SIZE)
+	if _, err = rand.Read(session.Nonce); err != nil {
+		return session, errors.New("SecuredSession: could not create nonce")
+	}
 	return
 }
 
-func (session *SecuredSession) getSignature() ([]byte, error) {
-	// Generating Shared Secret based on: MyPrivateKey + PeerPublicKey
-	sharedSecret, err := session.Curve.GenerateSharedSecret(session.PeerPublicKey)
+// NewSecuredSessionWithIdentity creates a session with an ephemeral Curve25519
+// key that is signed by the long-term identity during the handshake.
+func NewSecuredSessionWithIdentity(identity Identity) (SecuredSession, error) {
+	session, err := NewSecuredSession(nil)
 	if err != nil {
-		return nil, err
+		return session, err
 	}
+	session.Identity = &identity
+	return session, nil
+}
 
-	hasher := sha256.New()
-	hasher.Write(sharedSecret)
+func (session *SecuredSession) hello() []byte {
+	payload := make([]byte, 0, KEY_SIZE+NONCE_SIZE+len(session.CipherSuites))
+	payload = append(payload, session.Curve.GetPublicKey()...)
+	return append(payload, session.Nonce...)
+}
 
-	return hasher.Sum(nil), nil
+func (session *SecuredSession) setPeerHello(payload []byte) ([]byte, error) {
+	if len(payload) < KEY_SIZE+NONCE_SIZE {
+		return nil, ErrInvalidHello
+	}
+	session.PeerPublicKey = append([]byte{}, payload[:KEY_SIZE]...)
+	session.PeerNonce = append([]byte{}, payload[KEY_SIZE:KEY_SIZE+NONCE_SIZE]...)
+	return payload[KEY_SIZE+NONCE_SIZE:], nil
 }
 
-func (session *SecuredSession) GetSignature() ([]byte, error) {
-	b, err := session.getSignature()
-	return b, err
+// ClientHello returns the ClientHello payload: our public key, our nonce
+// and the cipher suites we offer in order of preference.
+func (session *SecuredSession) ClientHello() []byte {
+	session.offeredSuites = make([]byte, len(session.CipherSuites))
+	for i, suite := range session.CipherSuites {
+		session.offeredSuites[i] = byte(suite)
+	}
+	return append(session.hello(), session.offeredSuites...)
 }
 
-func (session *SecuredSession) Verify(peerSignature []byte) error {
-	signature, err := session.getSignature()
+// ReceiveClientHello takes the client's public key and nonce and picks the first
+// offered cipher suite we accept. A ClientHello without suites offers AES-128-GCM only.
+func (session *SecuredSession) ReceiveClientHello(payload []byte) (err error) {
+	offered, err := session.setPeerHello(payload)
 	if err != nil {
 		return err
 	}
 
-	// If the Peer is not a Man-In-The-Middle then Peer's Shared Secret is the Same!
-	// Hash our Shared Secret to Compare with Peer's Signature!
-	if !bytes.Equal(signature, peerSignature) {
-		err2 := errors.New("signature and peerSignature are not Equal")
-		return err2
+	session.offeredSuites = append([]byte{}, offered...)
+	if len(offered) == 0 {
+		offered = []byte{byte(CipherSuiteAES128GCM)}
+	}
+
+	session.Suite, err = negotiateCipherSuite(offered, session.CipherSuites)
+	return err
+}
+
+// PeerHello returns the PeerHello payload: our public key, our nonce and the chosen cipher suite.
+func (session *SecuredSession) PeerHello() []byte {
+	return append(session.hello(), byte(session.Suite))
+}
+
+// ReceivePeerHello takes the peer's public key, nonce and chosen cipher suite.
+func (session *SecuredSession) ReceivePeerHello(payload []byte) error {
+	chosen, err := session.setPeerHello(payload)
+	if err != nil {
+		return err
+	}
+
+	switch len(chosen) {
+	case 0:
+		session.Suite = CipherSuiteAES128GCM
+	case 1:
+		session.Suite = CipherSuite(chosen[0])
+	default:
+		return ErrInvalidHello
+	}
+
+	if _, err = negotiateCipherSuite([]byte{byte(session.Suite)}, session.CipherSuites); err != nil {
+		return err
+	}
+	return nil
+}
+
+// roles orders our own and the peer's values as client first, peer second.
+func roles(isClient bool, my, peer []byte) ([]byte, []byte) {
+	if isClient {
+		return my, peer
 	}
+	return peer, my
+}
+
+// Transcript hashes both handshake public keys and nonces, the client's first,
+// and the cipher suite negotiation, so that both sides agree on exactly what
+// was exchanged and a suite downgrade is detected.
+func (session *SecuredSession) Transcript(isClient bool) []byte {
+	clientPublicKey, peerPublicKey := roles(isClient, session.Curve.GetPublicKey(), session.PeerPublicKey)
+	clientNonce, peerNonce := roles(isClient, session.Nonce, session.PeerNonce)
+
+	hasher := sha256.New()
+	hasher.Write(clientPublicKey)
+	hasher.Write(peerPublicKey)
+	hasher.Write(clientNonce)
+	hasher.Write(peerNonce)
+	hasher.Write(session.offeredSuites)
+	hasher.Write([]byte{byte(session.Suite)})
+
+	return hasher.Sum(nil)
+}
+
+func (session *SecuredSession) salt(isClient bool) []byte {
+	clientNonce, peerNonce := roles(isClient, session.Nonce, session.PeerNonce)
+	return append(append([]byte{}, clientNonce...), peerNonce...)
+}
 
+func (session *SecuredSession) deriveKeys(isClient bool) error {
 	// Generating Shared Secret based on: MyPrivateKey + PeerPublicKey
 	sharedSecret, err := session.Curve.GenerateSharedSecret(session.PeerPublicKey)
 	if err != nil {
 		return err
 	}
 
-	/*
-	   var nonces [32]byte // Just random data
-	   if _, err := rand.Read(nonces[:]); err != nil {
-	   	return err
-	   }
+	salt := session.salt(isClient)
+	transcript := session.Transcript(isClient)
 
-	   var info []byte // Should be some public data
-	*/
-	peerKey, myKey, peerIV, myIV, err := DeriveKeysFromSharedSecret(sharedSecret, nil, nil)
+	id := sha256.Sum256(append(append([]byte{}, sessionIDLabel...), transcript...))
+	session.ID = id[:SESSION_ID_SIZE]
+
+	peerKey, myKey, peerIV, myIV, err := DeriveSuiteKeysFromSharedSecret(session.Suite, sharedSecret, salt, transcript)
 	if err != nil {
 		return err
 	}
 
-	// OK! Session is started! We can communicate now with AES Ephemeral Key!
-	session.AEAD, err = NewAEAD(peerKey, myKey, peerIV, myIV)
+	session.confirmationKey, err = DeriveConfirmationKey(sharedSecret, salt, transcript)
+	if err != nil {
+		return err
+	}
+
+	if isClient {
+		session.AEAD, err = NewAEADWithSuite(session.Suite, peerKey, myKey, peerIV, myIV)
+	} else {
+		session.AEAD, err = NewAEADWithSuite(session.Suite, myKey, peerKey, myIV, peerIV)
+	}
 
 	return err
 }
 
-func (session *SecuredSession) PeerVerify(peerSignature []byte) error {
-	signature, err := session.getSignature()
+func (session *SecuredSession) sign(label []byte, isClient bool) []byte {
+	mac := hmac.New(sha256.New, session.confirmationKey)
+	mac.Write(label)
+	mac.Write(session.Transcript(isClient))
+	return mac.Sum(nil)
+}
+
+// signature returns the key confirmation followed by the identity proof, if we have an identity.
+func (session *SecuredSession) signature(label, identityLabel []byte, isClient bool) []byte {
+	signature := session.sign(label, isClient)
+	if session.Identity != nil {
+		signature = append(signature, session.Identity.proof(identityLabel, session.Transcript(isClient))...)
+	}
+	return signature
+}
+
+func (session *SecuredSession) verifySignature(signature, label, identityLabel []byte, isClient bool) error {
+	if len(signature) < sha256.Size || !hmac.Equal(session.sign(label, isClient), signature[:sha256.Size]) {
+		return ErrSignatureMismatch
+	}
+
+	proof := signature[sha256.Size:]
+	if len(proof) == 0 {
+		return nil
+	}
+	peerIdentity, err := verifyIdentityProof(proof, identityLabel, session.Transcript(isClient))
 	if err != nil {
 		return err
 	}
+	session.PeerIdentity = peerIdentity
+	return nil
+}
 
-	// If the Peer is not a Man-In-The-Middle then Peer's Shared Secret is the Same!
-	// Hash our Shared Secret to Compare with Peer's Signature!
-	if !bytes.Equal(signature, peerSignature) {
-		err2 := errors.New("signature and peerSignature are not Equal")
-		return err2
+// ClientSignature derives the session keys on the client side and returns
+// the key confirmation the client sends in the ClientSignature message.
+func (session *SecuredSession) ClientSignature() ([]byte, error) {
+	if err := session.deriveKeys(true); err != nil {
+		return nil, err
 	}
+	return session.signature(clientSignatureLabel, clientIdentityLabel, true), nil
+}
 
-	// Generating Shared Secret based on: MyPrivateKey + PeerPublicKey
-	sharedSecret, err := session.Curve.GenerateSharedSecret(session.PeerPublicKey)
-	if err != nil {
+// VerifyClientSignature derives the session keys on the peer side and
+// checks that the client has derived the same ones.
+func (session *SecuredSession) VerifyClientSignature(clientSignature []byte) error {
+	if err := session.deriveKeys(false); err != nil {
 		return err
 	}
 
-	peerKey, myKey, peerIV, myIV, err := DeriveKeysFromSharedSecret(sharedSecret, nil, nil)
-	if err != nil {
+	// If the Client is not a Man-In-The-Middle then Client's keys are the Same!
+	return session.verifySignature(clientSignature, clientSignatureLabel, clientIdentityLabel, false)
+}
+
+// PeerSignature returns the key confirmation the peer answers with in the
+// PeerSignature message. VerifyClientSignature must be called first.
+func (session *SecuredSession) PeerSignature() []byte {
+	return session.signature(peerSignatureLabel, peerIdentityLabel, false)
+}
+
+// VerifyPeerSignature checks the peer's key confirmation on the client side.
+// ClientSignature must be called first.
+func (session *SecuredSession) VerifyPeerSignature(peerSignature []byte) error {
+	if err := session.verifySignature(peerSignature, peerSignatureLabel, peerIdentityLabel, true); err != nil {
 		return err
 	}
 
 	// OK! Session is started! We can communicate now with AES Ephemeral Key!
-	session.AEAD, err = NewAEAD(myKey, peerKey, myIV, peerIV)
-
-	return err
+	return nil
 }
@@ -0,0 +1,246 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func newHandshakePair(t *testing.T) (client, peer SecuredSession) {
+	client, err := NewSecuredSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err = NewSecuredSession([]byte("peer static key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = peer.ReceiveClientHello(client.ClientHello()); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.ReceivePeerHello(peer.PeerHello()); err != nil {
+		t.Fatal(err)
+	}
+	return client, peer
+}
+
+func TestSignatureExchange(t *testing.T) {
+	client, peer := newHandshakePair(t)
+
+	clientSignature, err := client.ClientSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.VerifyClientSignature(clientSignature); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.VerifyPeerSignature(peer.PeerSignature()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(client.Transcript(true), peer.Transcript(false)) {
+		t.Fatal("transcripts are not Equal")
+	}
+	if len(client.ID) != SESSION_ID_SIZE || !bytes.Equal(client.ID, peer.ID) {
+		t.Fatal("session IDs are not Equal")
+	}
+
+	b := client.AEAD.Seal([]byte("foobar"), 1, nil)
+	text, err := peer.AEAD.Open(b, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(text, []byte("foobar")) {
+		t.Fatal("Seal & Open are not Equal")
+	}
+}
+
+func TestSignatureReflection(t *testing.T) {
+	client, peer := newHandshakePair(t)
+
+	clientSignature, err := client.ClientSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.VerifyClientSignature(clientSignature); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.VerifyPeerSignature(clientSignature); err != ErrSignatureMismatch {
+		t.Fatalf("expected %v, got %v", ErrSignatureMismatch, err)
+	}
+}
+
+func TestSignatureMITM(t *testing.T) {
+	client, peer := newHandshakePair(t)
+
+	mitm, err := NewSecuredSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.ReceiveClientHello(mitm.ClientHello())
+
+	clientSignature, err := client.ClientSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.VerifyClientSignature(clientSignature); err != ErrSignatureMismatch {
+		t.Fatalf("expected %v, got %v", ErrSignatureMismatch, err)
+	}
+}
+
+func TestStaticKeysUniqueSessionKeys(t *testing.T) {
+	var myKeys [][]byte
+
+	for i := 0; i < 2; i++ {
+		client, err := NewSecuredSession([]byte("client static key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := NewSecuredSession([]byte("peer static key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.ReceiveClientHello(client.ClientHello())
+		client.ReceivePeerHello(peer.PeerHello())
+
+		if _, err = client.ClientSignature(); err != nil {
+			t.Fatal(err)
+		}
+		_, myKey, _, _ := client.AEAD.Keys()
+		myKeys = append(myKeys, myKey)
+	}
+
+	if bytes.Equal(myKeys[0], myKeys[1]) {
+		t.Fatal("sessions between the same static keys derived the same traffic key")
+	}
+}
+
+func TestReceivePeerHelloInvalid(t *testing.T) {
+	client, err := NewSecuredSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.ReceivePeerHello(client.Curve.GetPublicKey()); err != ErrInvalidHello {
+		t.Fatalf("expected %v, got %v", ErrInvalidHello, err)
+	}
+}
+
+func TestCipherSuiteNegotiation(t *testing.T) {
+	for _, suite := range DefaultCipherSuites {
+		client, err := NewSecuredSession(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := NewSecuredSession(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.CipherSuites = []CipherSuite{suite, CipherSuiteAES128GCM}
+
+		if err = peer.ReceiveClientHello(client.ClientHello()); err != nil {
+			t.Fatal(err)
+		}
+		if err = client.ReceivePeerHello(peer.PeerHello()); err != nil {
+			t.Fatal(err)
+		}
+		if client.Suite != suite || peer.Suite != suite {
+			t.Fatalf("expected %v, got %v and %v", suite, client.Suite, peer.Suite)
+		}
+
+		clientSignature, err := client.ClientSignature()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = peer.VerifyClientSignature(clientSignature); err != nil {
+			t.Fatal(err)
+		}
+		if client.AEAD.Suite() != suite {
+			t.Fatalf("expected %v AEAD, got %v", suite, client.AEAD.Suite())
+		}
+	}
+}
+
+func TestCipherSuiteNoCommon(t *testing.T) {
+	client, peer := newHandshakePair(t)
+	client.CipherSuites = []CipherSuite{CipherSuiteChaCha20Poly1305}
+	peer.CipherSuites = []CipherSuite{CipherSuiteAES128GCM}
+
+	if err := peer.ReceiveClientHello(client.ClientHello()); err != ErrNoCommonCipherSuite {
+		t.Fatalf("expected %v, got %v", ErrNoCommonCipherSuite, err)
+	}
+}
+
+func TestCipherSuiteDowngrade(t *testing.T) {
+	client, peer := newHandshakePair(t)
+	client.CipherSuites = []CipherSuite{CipherSuiteChaCha20Poly1305, CipherSuiteAES128GCM}
+
+	// A Man-In-The-Middle strips ChaCha20-Poly1305 from the offer
+	hello := client.ClientHello()
+	peer.ReceiveClientHello(append(hello[:KEY_SIZE+NONCE_SIZE:KEY_SIZE+NONCE_SIZE], byte(CipherSuiteAES128GCM)))
+	if err := client.ReceivePeerHello(peer.PeerHello()); err != nil {
+		t.Fatal(err)
+	}
+
+	clientSignature, err := client.ClientSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.VerifyClientSignature(clientSignature); err != ErrSignatureMismatch {
+		t.Fatalf("expected %v, got %v", ErrSignatureMismatch, err)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	client, peer := newHandshakePair(t)
+	client.CipherSuites = []CipherSuite{CipherSuiteChaCha20Poly1305}
+	peer.ReceiveClientHello(client.ClientHello())
+	client.ReceivePeerHello(peer.PeerHello())
+
+	clientSignature, err := client.ClientSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.VerifyClientSignature(clientSignature); err != nil {
+		t.Fatal(err)
+	}
+	peer.Usage.Add(100)
+
+	data, err := json.Marshal(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(data, []byte("private_key")) {
+		t.Fatal("private key is stored")
+	}
+
+	var restored SecuredSession
+	if err = json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored.ID, peer.ID) {
+		t.Fatal("session ID is not restored")
+	}
+	if restored.AEAD.Suite() != CipherSuiteChaCha20Poly1305 {
+		t.Fatalf("unexpected suite %v", restored.AEAD.Suite())
+	}
+	if restored.Usage.Bytes() != 100 || restored.Usage.Messages() != 1 {
+		t.Fatal("usage is not restored")
+	}
+
+	b := client.AEAD.Seal([]byte("foobar"), 7, nil)
+	text, err := restored.AEAD.Open(b, 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(text, []byte("foobar")) {
+		t.Fatal("Seal & Open are not Equal")
+	}
+
+	if _, err = json.Marshal(SecuredSession{}); err == nil {
+		t.Fatal("expected error for not established session")
+	}
+}
@@ -0,0 +1,49 @@
+package session
+
+import "sync/atomic"
+
+// Usage counts the messages and bytes protected under the keys of a session,
+// in both directions, and tells if the peer has asked for new keys.
+// It is shared by all copies of a SecuredSession.
+type Usage struct {
+	messages int64
+	bytes    int64
+	rekey    int32
+}
+
+func (u *Usage) Add(bytes int) {
+	if u == nil {
+		return
+	}
+	atomic.AddInt64(&u.messages, 1)
+	atomic.AddInt64(&u.bytes, int64(bytes))
+}
+
+func (u *Usage) Messages() int64 {
+	if u == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&u.messages)
+}
+
+func (u *Usage) Bytes() int64 {
+	if u == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&u.bytes)
+}
+
+// RequestRekey marks the session for a rekey before the local limits are reached.
+func (u *Usage) RequestRekey() {
+	if u == nil {
+		return
+	}
+	atomic.StoreInt32(&u.rekey, 1)
+}
+
+func (u *Usage) RekeyRequested() bool {
+	if u == nil {
+		return false
+	}
+	return atomic.LoadInt32(&u.rekey) == 1
+}
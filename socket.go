@@ -0,0 +1,254 @@
+package coalago
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// The socket of a Client is closed after being unused that long, the next
+// request opens another one
+var CLIENT_SOCKET_EXPIRATION = time.Minute
+
+var ErrClientSocket = errors.New("client socket does not listen")
+
+// clientSocket is the conn the requests of a Client to a peer share.
+// Messages are routed to requests by the address of the peer and their
+// token, so the peer sees the same address in every request and keeps its
+// session. The socket takes a slot of the connection pool while it is open.
+type clientSocket struct {
+	conn      PacketConn
+	transport Transport
+	pool      *connpool
+
+	mx     sync.Mutex
+	routes map[string]*socketConn
+	conns  int
+	idle   *time.Timer
+	closed bool
+}
+
+func newClientSocket(ctx context.Context, pool *connpool, transport Transport, addr string) (*clientSocket, error) {
+	if err := pool.acquire(ctx); err != nil {
+		return nil, err
+	}
+	conn, err := transport.Dial(addr)
+	if err != nil {
+		pool.release()
+		return nil, err
+	}
+	s := &clientSocket{
+		conn:      conn,
+		transport: transport,
+		pool:      pool,
+		routes:    make(map[string]*socketConn),
+	}
+	go s.receive()
+	return s, nil
+}
+
+func (s *clientSocket) receive() {
+	limit := messageSizeLimit(s.conn.LocalAddr())
+	for {
+		buf := make([]byte, limit+1)
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		token, ok := rawToken(buf[:n])
+		if !ok {
+			continue
+		}
+
+		s.mx.Lock()
+		c := s.routes[addr.String()+string(token)]
+		s.mx.Unlock()
+		if c == nil {
+			continue
+		}
+		// Datagrams the request does not read in time are lost like on the network
+		select {
+		case c.input <- buf[:n]:
+		default:
+		}
+	}
+}
+
+// dial returns the connection of a request to addr, false when the socket
+// is already closed.
+func (s *clientSocket) dial(addr net.Addr) (*socketConn, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.closed {
+		return nil, false
+	}
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	s.conns++
+
+	return &socketConn{
+		socket: s,
+		remote: addr,
+		input:  make(chan []byte, 2*DEFAULT_WINDOW_SIZE),
+	}, true
+}
+
+func (s *clientSocket) route(key string, c *socketConn) {
+	s.mx.Lock()
+	s.routes[key] = c
+	s.mx.Unlock()
+}
+
+func (s *clientSocket) release(c *socketConn) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for _, key := range c.keys {
+		if s.routes[key] == c {
+			delete(s.routes, key)
+		}
+	}
+	if s.conns--; s.conns == 0 && !s.closed {
+		s.idle = time.AfterFunc(CLIENT_SOCKET_EXPIRATION, s.expire)
+	}
+}
+
+func (s *clientSocket) expire() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.conns == 0 && !s.closed {
+		s.closed = true
+		unwatchSessionExpiry(s.conn.LocalAddr().String())
+		s.conn.Close()
+		s.pool.release()
+	}
+}
+
+func (s *clientSocket) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+	s.pool.release()
+	unwatchSessionExpiry(s.conn.LocalAddr().String())
+	return s.conn.Close()
+}
+
+// rawToken reads the token of a datagram without parsing the rest of it.
+func rawToken(data []byte) ([]byte, bool) {
+	if len(data) < DataTokenStart {
+		return nil, false
+	}
+	n := int(data[DataHeader] & 0x0f)
+	if n > 8 || len(data) < DataTokenStart+n {
+		return nil, false
+	}
+	return data[DataTokenStart : DataTokenStart+n], true
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// socketConn is the dialer of one request on a clientSocket. The tokens of
+// the datagrams it sends are routed back to it until it is closed.
+type socketConn struct {
+	socket *clientSocket
+	remote net.Addr
+	input  chan []byte
+
+	mx       sync.Mutex
+	keys     []string
+	deadline time.Time
+}
+
+func (c *socketConn) redial() (dialer, bool) {
+	return c.socket.dial(c.remote)
+}
+
+func (c *socketConn) Close() error {
+	c.socket.release(c)
+	return nil
+}
+
+func (c *socketConn) Listen([]byte) (int, net.Addr, error) {
+	return 0, nil, ErrClientSocket
+}
+
+func (c *socketConn) Read(buff []byte) (int, error) {
+	c.mx.Lock()
+	wait := time.Until(c.deadline)
+	c.mx.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case data := <-c.input:
+		return copy(buff, data), nil
+	case <-timer.C:
+		return 0, timeoutError{}
+	}
+}
+
+func (c *socketConn) Write(buf []byte) (int, error) {
+	return c.writeTo(buf, c.remote)
+}
+
+func (c *socketConn) WriteTo(buf []byte, addr string) (int, error) {
+	a, err := c.socket.transport.Resolve(addr)
+	if err != nil {
+		return 0, err
+	}
+	return c.writeTo(buf, a)
+}
+
+func (c *socketConn) writeTo(buf []byte, addr net.Addr) (int, error) {
+	if token, ok := rawToken(buf); ok {
+		key := addr.String() + string(token)
+		c.mx.Lock()
+		known := false
+		for _, k := range c.keys {
+			if k == key {
+				known = true
+				break
+			}
+		}
+		if !known {
+			c.keys = append(c.keys, key)
+		}
+		c.mx.Unlock()
+		if !known {
+			c.socket.route(key, c)
+		}
+	}
+	return c.socket.conn.WriteTo(buf, addr)
+}
+
+func (c *socketConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *socketConn) LocalAddr() net.Addr {
+	return c.socket.conn.LocalAddr()
+}
+
+func (c *socketConn) SetReadDeadline() {
+	c.mx.Lock()
+	c.deadline = time.Now().Add(timeWait)
+	c.mx.Unlock()
+}
@@ -0,0 +1,140 @@
+package coalago
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientSocketReuse(t *testing.T) {
+	var mx sync.Mutex
+	senders := make(map[string]bool)
+
+	srv := NewServer()
+	srv.AddPOSTResource("/echo", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		mx.Lock()
+		senders[message.Sender.String()] = true
+		mx.Unlock()
+		return NewResponse(message.Payload, CoapCodeChanged)
+	})
+	addr := listenServer(t, srv, "127.0.0.1:0")
+	client := NewClient()
+	defer client.Close()
+
+	handshakes := MetricSuccessfulHandhshakes.Val()
+	for i := 0; i < 3; i++ {
+		resp, err := client.POST([]byte("secure"), "coaps://"+addr+"/echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != "secure" {
+			t.Fatalf("unexpected body: %q", resp.Body)
+		}
+	}
+	if n := MetricSuccessfulHandhshakes.Val() - handshakes; n > 2 {
+		t.Fatalf("session is not reused, %d handshakes", n)
+	}
+
+	// Concurrent requests share the socket, responses are routed by token
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("request %d", i)
+			resp, err := client.POST([]byte(body), "coap://"+addr+"/echo")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(resp.Body) != body {
+				t.Errorf("request %d got %q", i, resp.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mx.Lock()
+	defer mx.Unlock()
+	if len(senders) != 1 {
+		t.Fatalf("requests come from %d addresses", len(senders))
+	}
+}
+
+func TestClientDialWhileWaitingForSlot(t *testing.T) {
+	number, timeout := NumberConnections, CONNECTIONS_WAIT_TIMEOUT
+	defer func() { NumberConnections, CONNECTIONS_WAIT_TIMEOUT = number, timeout }()
+	CONNECTIONS_WAIT_TIMEOUT = time.Second
+
+	client := NewClient()
+	defer client.Close()
+
+	// Requests racing to open the socket of a peer end up on one of them
+	var wg sync.WaitGroup
+	addrs := make(chan string, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := client.dial(context.Background(), "127.0.0.1:5683")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			addrs <- conn.LocalAddr().String()
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+	close(addrs)
+	first := <-addrs
+	for addr := range addrs {
+		if addr != first {
+			t.Fatalf("requests use sockets %s and %s", first, addr)
+		}
+	}
+
+	// No slot is free for the socket of another peer
+	NumberConnections = 0
+	waiting := make(chan error)
+	go func() {
+		_, err := client.dial(context.Background(), "127.0.0.1:5684")
+		waiting <- err
+	}()
+	for GetConnectionStats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	conn, err := client.dial(context.Background(), "127.0.0.1:5683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("request to a peer with an open socket waited %v", d)
+	}
+	if err = <-waiting; err != ErrNoConnections {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestClientSendContext(t *testing.T) {
+	number := NumberConnections
+	defer func() { NumberConnections = number }()
+	NumberConnections = 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	message, _ := constructMessage(GET, "coap://127.0.0.1:5685/test")
+	start := time.Now()
+	if _, err := NewClient().SendContext(ctx, message, "127.0.0.1:5685"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > CONNECTIONS_WAIT_TIMEOUT/2 {
+		t.Fatalf("request waited %v for a socket", d)
+	}
+}
@@ -1,53 +1,118 @@
 package coalago
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coalalib/coalago/session"
 	"github.com/patrickmn/go-cache"
 )
 
-type sessionStorage interface {
+// SessionStorage keeps coaps:// sessions by the local (sender) address, the peer's
+// (receiver) address and the proxy address. With a proxy the sender is ignored.
+type SessionStorage interface {
 	Set(sender string, receiver string, proxy string, sess session.SecuredSession)
 	Get(sender string, receiver string, proxy string) (session.SecuredSession, bool)
 	Delete(sender string, receiver string, proxy string)
 	ItemCount() int
 }
 
+func sessionKey(sender string, receiver string, proxy string) string {
+	if len(proxy) != 0 {
+		sender = ""
+	}
+	return sender + receiver + proxy
+}
+
+// storedSession is a session with the addresses it was stored for, which
+// tell whose session has expired.
+type storedSession struct {
+	sender   string
+	receiver string
+	proxy    string
+	session  session.SecuredSession
+	deleted  int32
+}
+
+// sessionWatchers are the transports with hooks by their local address.
+// They are told about the sessions expiring in the storages of this package.
+var sessionWatchers sync.Map
+
+func watchSessionExpiry(tr *transport) {
+	if tr.hooks != nil {
+		sessionWatchers.Store(tr.conn.LocalAddr().String(), tr)
+	}
+}
+
+func unwatchSessionExpiry(localAddr string) {
+	sessionWatchers.Delete(localAddr)
+}
+
+// sessionEvicted is the OnEvicted function of the session caches. Deletions
+// are reported by deleteSessionForAddress, so only expirations are here.
+func sessionEvicted(_ string, v interface{}) {
+	s := v.(*storedSession)
+	if atomic.LoadInt32(&s.deleted) != 0 {
+		return
+	}
+	tr, ok := sessionWatchers.Load(s.sender)
+	if !ok {
+		return
+	}
+	tr.(*transport).securityEvent(SecurityEvent{
+		Type:          SecurityEventSessionDeleted,
+		PeerAddr:      s.receiver,
+		ProxyAddr:     s.proxy,
+		PeerPublicKey: s.session.PeerPublicKey,
+		PeerIdentity:  s.session.PeerIdentity,
+		Err:           ErrorSessionExpired,
+	})
+}
+
+// deleteStoredSession deletes the session at key without reporting it as expired.
+func deleteStoredSession(c *cache.Cache, key string) {
+	if v, ok := c.Get(key); ok {
+		atomic.StoreInt32(&v.(*storedSession).deleted, 1)
+	}
+	c.Delete(key)
+}
+
 type sessionStorageImpl struct {
 	storage *cache.Cache
 }
 
-func newSessionStorageImpl() *sessionStorageImpl {
+func newSessionStorageImpl(reportExpiry bool) *sessionStorageImpl {
 	s := new(sessionStorageImpl)
 	s.storage = cache.New(SESSIONS_POOL_EXPIRATION, time.Second*1)
+	if reportExpiry {
+		s.storage.OnEvicted(sessionEvicted)
+	}
 
 	return s
 }
 
+// NewMemorySessionStorage returns the in-memory storage used by default.
+// Sessions expire after SESSIONS_POOL_EXPIRATION without use, which is
+// reported to security hooks as SecurityEventSessionDeleted.
+func NewMemorySessionStorage() SessionStorage {
+	return newSessionStorageImpl(true)
+}
+
 func (s *sessionStorageImpl) Set(sender string, receiver string, proxy string, sess session.SecuredSession) {
-	if len(proxy) != 0 {
-		sender = ""
-	}
-	s.storage.SetDefault(sender+receiver+proxy, sess)
+	s.storage.SetDefault(sessionKey(sender, receiver, proxy), &storedSession{sender: sender, receiver: receiver, proxy: proxy, session: sess})
 }
 
 func (s *sessionStorageImpl) Get(sender string, receiver string, proxy string) (session.SecuredSession, bool) {
-	if len(proxy) != 0 {
-		sender = ""
-	}
-	v, ok := s.storage.Get(sender + receiver + proxy)
+	v, ok := s.storage.Get(sessionKey(sender, receiver, proxy))
 	if ok {
-		return v.(session.SecuredSession), true
+		return v.(*storedSession).session, true
 	}
 	return session.SecuredSession{}, false
 }
 
 func (s *sessionStorageImpl) Delete(sender string, receiver string, proxy string) {
-	if len(proxy) != 0 {
-		sender = ""
-	}
-	s.storage.Delete(sender + receiver + proxy)
+	deleteStoredSession(s.storage, sessionKey(sender, receiver, proxy))
 }
 
 func (s *sessionStorageImpl) ItemCount() int {
@@ -0,0 +1,181 @@
+package coalago
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+	"github.com/patrickmn/go-cache"
+)
+
+var FILE_SESSIONS_FLUSH_INTERVAL = time.Second
+
+// FileSessionStorage keeps sessions in memory like the default storage and
+// flushes them to a file, so that coaps:// sessions survive a restart.
+// The file contains session keys and is written with 0600 permissions.
+// Expirations refreshed by use are written with the next change. Sessions
+// expiring are reported to security hooks as SecurityEventSessionDeleted.
+type FileSessionStorage struct {
+	path    string
+	storage *cache.Cache
+
+	mx    sync.Mutex
+	dirty bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type fileSessionEntry struct {
+	Sender     string                 `json:"sender,omitempty"`
+	Receiver   string                 `json:"receiver,omitempty"`
+	Proxy      string                 `json:"proxy,omitempty"`
+	Session    session.SecuredSession `json:"session"`
+	Expiration int64                  `json:"expiration"`
+}
+
+// NewFileSessionStorage loads the sessions stored at path, if any,
+// and starts flushing changes every FILE_SESSIONS_FLUSH_INTERVAL.
+func NewFileSessionStorage(path string) (*FileSessionStorage, error) {
+	s := new(FileSessionStorage)
+	s.path = path
+	s.storage = cache.New(SESSIONS_POOL_EXPIRATION, time.Second*1)
+	s.storage.OnEvicted(func(key string, v interface{}) {
+		sessionEvicted(key, v)
+		s.markDirty()
+	})
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	go s.flushLoop()
+
+	return s, nil
+}
+
+func (s *FileSessionStorage) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries map[string]fileSessionEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	for k, e := range entries {
+		if e.Expiration <= now {
+			continue
+		}
+		s.storage.Set(k, &storedSession{sender: e.Sender, receiver: e.Receiver, proxy: e.Proxy, session: e.Session}, time.Duration(e.Expiration-now))
+	}
+
+	return nil
+}
+
+func (s *FileSessionStorage) flushLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(FILE_SESSIONS_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Flush writes the sessions to the file if they have changed since the last flush.
+func (s *FileSessionStorage) Flush() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	entries := make(map[string]fileSessionEntry)
+	for k, item := range s.storage.Items() {
+		stored := item.Object.(*storedSession)
+		entries[k] = fileSessionEntry{
+			Sender:     stored.sender,
+			Receiver:   stored.receiver,
+			Proxy:      stored.proxy,
+			Session:    stored.session,
+			Expiration: item.Expiration,
+		}
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// Close stops the background flushing and writes the sessions one last time.
+func (s *FileSessionStorage) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.Flush()
+}
+
+func (s *FileSessionStorage) markDirty() {
+	s.mx.Lock()
+	s.dirty = true
+	s.mx.Unlock()
+}
+
+// Set marks the file for a flush unless it only refreshes the expiration
+// of the same session.
+func (s *FileSessionStorage) Set(sender string, receiver string, proxy string, sess session.SecuredSession) {
+	key := sessionKey(sender, receiver, proxy)
+	v, ok := s.storage.Get(key)
+	s.storage.SetDefault(key, &storedSession{sender: sender, receiver: receiver, proxy: proxy, session: sess})
+	if !ok || len(sess.ID) == 0 || !bytes.Equal(v.(*storedSession).session.ID, sess.ID) {
+		s.markDirty()
+	}
+}
+
+func (s *FileSessionStorage) Get(sender string, receiver string, proxy string) (session.SecuredSession, bool) {
+	v, ok := s.storage.Get(sessionKey(sender, receiver, proxy))
+	if ok {
+		return v.(*storedSession).session, true
+	}
+	return session.SecuredSession{}, false
+}
+
+func (s *FileSessionStorage) Delete(sender string, receiver string, proxy string) {
+	deleteStoredSession(s.storage, sessionKey(sender, receiver, proxy))
+	s.markDirty()
+}
+
+func (s *FileSessionStorage) ItemCount() int {
+	return s.storage.ItemCount()
+}
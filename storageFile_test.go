@@ -0,0 +1,122 @@
+package coalago
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coalalib/coalago/session"
+)
+
+func TestFileSessionStorageRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.json")
+
+	client, err := session.NewSecuredSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := session.NewSecuredSession([]byte("server key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.ReceiveClientHello(client.ClientHello())
+	client.ReceivePeerHello(peer.PeerHello())
+	signature, err := client.ClientSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.VerifyClientSignature(signature); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := NewFileSessionStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Set("0.0.0.0:5683", "10.0.0.1:40000", "", peer)
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewFileSessionStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	restored, ok := restarted.Get("0.0.0.0:5683", "10.0.0.1:40000", "")
+	if !ok {
+		t.Fatal("session is not restored")
+	}
+	if !restored.Restored || !DefaultRekeyPolicy.isDue(restored) {
+		t.Fatal("restored session is not renegotiated before use")
+	}
+	if !bytes.Equal(restored.PeerPublicKey, client.Curve.GetPublicKey()) {
+		t.Fatal("peer public keys are not Equal")
+	}
+
+	text, err := restored.AEAD.Open(client.AEAD.Seal([]byte("foobar"), 1, nil), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(text, []byte("foobar")) {
+		t.Fatal("Seal & Open are not Equal")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected permissions %v", info.Mode().Perm())
+	}
+}
+
+func TestFileSessionStorageRefreshIsNotAChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// No flush in between
+	interval := FILE_SESSIONS_FLUSH_INTERVAL
+	FILE_SESSIONS_FLUSH_INTERVAL = time.Hour
+	defer func() { FILE_SESSIONS_FLUSH_INTERVAL = interval }()
+
+	storage, err := NewFileSessionStorage(filepath.Join(dir, "sessions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	dirty := func() bool {
+		storage.mx.Lock()
+		defer storage.mx.Unlock()
+		return storage.dirty
+	}
+
+	ses := session.SecuredSession{ID: []byte("session")}
+	storage.Set("0.0.0.0:5683", "10.0.0.1:40000", "", ses)
+	storage.mx.Lock()
+	storage.dirty = false
+	storage.mx.Unlock()
+
+	// Like getSessionForAddress does on every use
+	storage.Set("0.0.0.0:5683", "10.0.0.1:40000", "", ses)
+	if dirty() {
+		t.Fatal("refreshing the session marks the storage dirty")
+	}
+
+	storage.Set("0.0.0.0:5683", "10.0.0.1:40000", "", session.SecuredSession{ID: []byte("rekeyed")})
+	if !dirty() {
+		t.Fatal("replacing the session does not mark the storage dirty")
+	}
+}
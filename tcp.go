@@ -0,0 +1,437 @@
+package coalago
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Signaling codes of RFC 8323
+const (
+	signalCSM     = 7<<5 | 1
+	signalPing    = 7<<5 | 2
+	signalPong    = 7<<5 | 3
+	signalRelease = 7<<5 | 4
+	signalAbort   = 7<<5 | 5
+)
+
+var ErrFrameTooLarge = errors.New("frame is larger than MAX_MESSAGE_SIZE")
+
+// csmOptions are the options of the CSM sent on new connections:
+// Max-Message-Size and Block-Wise-Transfer.
+func csmOptions() []byte {
+	size := MAX_MESSAGE_SIZE
+	return []byte{2<<4 | 3, byte(size >> 16), byte(size >> 8), byte(size), 2 << 4}
+}
+
+type tcpTransport struct {
+	config *tls.Config
+}
+
+// NewTCPTransport carries messages over TCP with the framing of RFC 8323.
+func NewTCPTransport() Transport {
+	return &tcpTransport{}
+}
+
+// NewTLSTransport carries messages over TLS with the framing of RFC 8323.
+// The config of servers needs their certificates.
+func NewTLSTransport(config *tls.Config) Transport {
+	return &tcpTransport{config: config}
+}
+
+func (t *tcpTransport) Listen(addr string) (PacketConn, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.config != nil {
+		l = tls.NewListener(l, t.config)
+	}
+
+	c := newStreamConn(l.Addr(), true)
+	c.listener = l
+	go c.accept()
+	return c, nil
+}
+
+func (t *tcpTransport) Dial(addr string) (PacketConn, error) {
+	dialed, err := t.Resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: sumTimeAttempts}
+	var conn net.Conn
+	if t.config != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, t.config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := newStreamConn(conn.LocalAddr(), false)
+	c.dialed = dialed.String()
+	c.add(newTCPFramer(conn), conn.RemoteAddr())
+	return c, nil
+}
+
+func (t *tcpTransport) Resolve(addr string) (net.Addr, error) {
+	return net.ResolveTCPAddr("tcp", addr)
+}
+
+// framer reads and writes the RFC 8323 frames of a connection.
+type framer interface {
+	ReadFrame() (code byte, token, rest []byte, err error)
+	WriteFrame(code byte, token, rest []byte) error
+	Close() error
+}
+
+type tcpFramer struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTCPFramer(conn net.Conn) *tcpFramer {
+	return &tcpFramer{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (f *tcpFramer) ReadFrame() (byte, []byte, []byte, error) {
+	return readFrame(f.r)
+}
+
+func (f *tcpFramer) WriteFrame(code byte, token, rest []byte) error {
+	frame := appendFrameHeader(nil, len(rest), len(token), code)
+	frame = append(frame, token...)
+	_, err := f.conn.Write(append(frame, rest...))
+	return err
+}
+
+func (f *tcpFramer) Close() error {
+	return f.conn.Close()
+}
+
+// streamConn exchanges messages with the peers of stream connections: all
+// the accepted ones of a server, or the one of a client. Messages are
+// turned into RFC 8323 frames and back, their type and message ID are
+// restored from the messages sent with the same token.
+type streamConn struct {
+	packetQueue
+	local    net.Addr
+	server   bool
+	listener net.Listener
+	// dialed is the address a client was dialed with as Resolve reports it
+	dialed string
+
+	mx    sync.Mutex
+	peers map[string]*streamPeer
+}
+
+func newStreamConn(local net.Addr, server bool) *streamConn {
+	return &streamConn{
+		packetQueue: newPacketQueue(),
+		local:       local,
+		server:      server,
+		peers:       make(map[string]*streamPeer),
+	}
+}
+
+func (c *streamConn) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		c.add(newTCPFramer(conn), conn.RemoteAddr())
+	}
+}
+
+// add starts exchanging messages with the peer at addr, it tells false
+// when the conn is closed.
+func (c *streamConn) add(frames framer, addr net.Addr) bool {
+	p := &streamPeer{frames: frames, addr: addr, sent: make(map[string]uint16)}
+	c.mx.Lock()
+	select {
+	case <-c.closed:
+		c.mx.Unlock()
+		frames.Close()
+		return false
+	default:
+	}
+	c.peers[p.addr.String()] = p
+	c.mx.Unlock()
+
+	go c.receive(p)
+	p.signal(signalCSM, csmOptions())
+	return true
+}
+
+func (c *streamConn) remove(p *streamPeer) {
+	c.mx.Lock()
+	if c.peers[p.addr.String()] == p {
+		delete(c.peers, p.addr.String())
+	}
+	c.mx.Unlock()
+	p.frames.Close()
+}
+
+func (c *streamConn) receive(p *streamPeer) {
+	defer c.remove(p)
+
+	for {
+		code, token, rest, err := p.frames.ReadFrame()
+		if errors.Is(err, ErrFrameTooLarge) {
+			p.signal(signalAbort, nil)
+		}
+		if err != nil || code == signalRelease || code == signalAbort {
+			return
+		}
+
+		if data := p.datagram(code, token, rest); data != nil {
+			if !c.push(queuedPacket{data: data, from: p.addr}) {
+				return
+			}
+		}
+	}
+}
+
+// WriteTo sends the message to the peer at addr, the one of a client is
+// reached by the address it was dialed with too.
+func (c *streamConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	c.mx.Lock()
+	p := c.peers[addr.String()]
+	if p == nil && !c.server && addr.String() == c.dialed {
+		for _, peer := range c.peers {
+			p = peer
+		}
+	}
+	c.mx.Unlock()
+
+	if p == nil {
+		return 0, fmt.Errorf("no connection to %s", addr)
+	}
+	if err := p.write(buf); err != nil {
+		c.remove(p)
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// Close releases the connections of the peers.
+func (c *streamConn) Close() error {
+	if !c.close() {
+		return nil
+	}
+
+	var err error
+	if c.listener != nil {
+		err = c.listener.Close()
+	}
+	c.mx.Lock()
+	peers := c.peers
+	c.peers = make(map[string]*streamPeer)
+	c.mx.Unlock()
+	for _, p := range peers {
+		p.signal(signalRelease, nil)
+		p.frames.Close()
+	}
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+type streamPeer struct {
+	frames framer
+	addr   net.Addr
+	wmx    sync.Mutex
+
+	mx sync.Mutex
+	// Message IDs of the requests sent, by token
+	sent map[string]uint16
+}
+
+func (p *streamPeer) signal(code byte, options []byte) error {
+	p.wmx.Lock()
+	defer p.wmx.Unlock()
+	return p.frames.WriteFrame(code, nil, options)
+}
+
+// write frames a message in the UDP encoding. Pings and their replies
+// become signals, empty ACKs are not needed on a reliable connection.
+func (p *streamPeer) write(data []byte) error {
+	if len(data) < DataTokenStart {
+		return ErrPacketLengthLessThan4
+	}
+	typ := CoapType(data[DataHeader] >> 4 & 0x03)
+	code := data[DataCode]
+	token, ok := rawToken(data)
+	if !ok {
+		return ErrInvalidTokenLength
+	}
+	rest := data[DataTokenStart+len(token):]
+
+	if code == byte(CoapCodeEmpty) {
+		switch typ {
+		case CON:
+			code = signalPing
+		case RST:
+			code = signalPong
+		default:
+			return nil
+		}
+		rest = nil
+	}
+	mid := uint16(data[DataMsgIDStart])<<8 | uint16(data[DataMsgIDStart+1])
+	if typ == CON {
+		p.mx.Lock()
+		p.sent[string(token)] = mid
+		p.mx.Unlock()
+	}
+	if rest != nil {
+		var err error
+		if rest, err = addMessageID(data, mid); err != nil {
+			return err
+		}
+	}
+
+	p.wmx.Lock()
+	defer p.wmx.Unlock()
+	return p.frames.WriteFrame(code, token, rest)
+}
+
+// datagram turns a frame into a message in the UDP encoding, nil for the
+// signals that are handled by the connection.
+func (p *streamPeer) datagram(code byte, token, rest []byte) []byte {
+	typ := CON
+	mid := generateMessageID()
+
+	switch {
+	case code == signalPing:
+		code, rest = byte(CoapCodeEmpty), nil
+	case code>>5 == 7 && code != signalPong:
+		return nil
+	case code == signalPong:
+		typ, rest = RST, nil
+		code = byte(CoapCodeEmpty)
+		fallthrough
+	case code>>5 != 0:
+		// Responses answer the request sent with their token
+		p.mx.Lock()
+		if sent, ok := p.sent[string(token)]; ok {
+			delete(p.sent, string(token))
+			mid = sent
+			if typ == CON {
+				typ = ACK
+			}
+		}
+		p.mx.Unlock()
+	}
+
+	data := make([]byte, 0, DataTokenStart+len(token)+len(rest))
+	data = append(data, byte(1<<6|byte(typ)<<4|byte(len(token))), code, byte(mid>>8), byte(mid))
+	data = append(data, token...)
+	return restoreMessageID(append(data, rest...))
+}
+
+// addMessageID returns the options and payload of a message, with the
+// message ID in them if the message is a coaps:// one.
+func addMessageID(data []byte, mid uint16) ([]byte, error) {
+	token, _ := rawToken(data)
+	rest := data[DataTokenStart+len(token):]
+
+	message, err := Deserialize(data)
+	if err != nil {
+		return nil, err
+	}
+	if message.GetScheme() != COAPS_SCHEME {
+		return rest, nil
+	}
+	message.AddOption(OptionMessageID, int(mid))
+	if data, err = Serialize(message); err != nil {
+		return nil, err
+	}
+	return data[DataTokenStart+len(token):], nil
+}
+
+// restoreMessageID gives a message the message ID carried in its options.
+func restoreMessageID(data []byte) []byte {
+	message, err := Deserialize(data)
+	if err != nil {
+		return data
+	}
+	option := message.GetOption(OptionMessageID)
+	if option == nil {
+		return data
+	}
+	message.MessageID = uint16(option.IntValue())
+	message.RemoveOptions(OptionMessageID)
+	if restored, err := Serialize(message); err == nil {
+		return restored
+	}
+	return data
+}
+
+// appendFrameHeader appends the length, token length and code of a frame
+// whose options and payload take length bytes.
+func appendFrameHeader(b []byte, length, tkl int, code byte) []byte {
+	switch {
+	case length < 13:
+		b = append(b, byte(length<<4|tkl))
+	case length < 269:
+		b = append(b, byte(13<<4|tkl), byte(length-13))
+	case length < 65805:
+		l := length - 269
+		b = append(b, byte(14<<4|tkl), byte(l>>8), byte(l))
+	default:
+		l := length - 65805
+		b = append(b, byte(15<<4|tkl), byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+	return append(b, code)
+}
+
+func readFrame(r *bufio.Reader) (code byte, token, rest []byte, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	length, tkl := int(first>>4), int(first&0x0f)
+	if tkl > 8 {
+		return 0, nil, nil, ErrInvalidTokenLength
+	}
+
+	var ext []byte
+	var offset int
+	switch length {
+	case 13:
+		ext, offset = make([]byte, 1), 13
+	case 14:
+		ext, offset = make([]byte, 2), 269
+	case 15:
+		ext, offset = make([]byte, 4), 65805
+	}
+	if ext != nil {
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return 0, nil, nil, err
+		}
+		length = offset
+		for i, b := range ext {
+			length += int(b) << (8 * (len(ext) - 1 - i))
+		}
+	}
+	if length > MAX_MESSAGE_SIZE {
+		return 0, nil, nil, ErrFrameTooLarge
+	}
+
+	buf := make([]byte, 1+tkl+length)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return 0, nil, nil, err
+	}
+	return buf[0], buf[1 : 1+tkl], buf[1+tkl:], nil
+}
@@ -0,0 +1,182 @@
+package coalago
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrameHeader(t *testing.T) {
+	for _, length := range []int{0, 12, 13, 268, 269, 1500, 65535} {
+		token := []byte("tok")
+		rest := bytes.Repeat([]byte{0xab}, length)
+		frame := appendFrameHeader(nil, length, len(token), byte(POST))
+		frame = append(append(frame, token...), rest...)
+
+		code, gotToken, gotRest, err := readFrame(bufio.NewReader(bytes.NewReader(frame)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != byte(POST) || !bytes.Equal(gotToken, token) || !bytes.Equal(gotRest, rest) {
+			t.Fatalf("frame of %d bytes is read back wrong", length)
+		}
+	}
+
+	frame := appendFrameHeader(nil, MAX_MESSAGE_SIZE+1, 0, byte(POST))
+	if _, _, _, err := readFrame(bufio.NewReader(bytes.NewReader(frame))); err != ErrFrameTooLarge {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestStreamPeerMessages(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sender := &streamPeer{frames: newTCPFramer(client), sent: make(map[string]uint16)}
+	receiver := &streamPeer{frames: newTCPFramer(server), sent: make(map[string]uint16)}
+
+	request := NewCoAPMessage(CON, POST)
+	request.SetURIPath("/echo")
+	request.Payload = NewStringPayload("ping")
+	data, err := Serialize(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go sender.write(data)
+	code, token, rest, err := receiver.frames.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := Deserialize(receiver.datagram(code, token, rest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Type != CON || received.GetURIPath() != "/echo" || received.Payload.String() != "ping" {
+		t.Fatalf("unexpected request %v", received.ToReadableString())
+	}
+
+	// The response gets the type and message ID of the request back
+	response := NewCoAPMessageId(ACK, CoapCodeChanged, received.MessageID)
+	response.Token = received.Token
+	if data, err = Serialize(response); err != nil {
+		t.Fatal(err)
+	}
+	go receiver.write(data)
+	code, token, rest, err = sender.frames.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != byte(CoapCodeChanged) {
+		t.Fatalf("unexpected code %d", code)
+	}
+	answer, err := Deserialize(sender.datagram(code, token, rest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Type != ACK || answer.MessageID != request.MessageID {
+		t.Fatalf("unexpected response %v", answer.ToReadableString())
+	}
+}
+
+func TestStreamClientWriteTo(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	conn, err := NewTCPTransport().Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := Serialize(NewCoAPMessage(CON, GET))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.WriteTo(data, l.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.WriteTo(data, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1}); err == nil {
+		t.Fatal("message to another address is sent to the dialed peer")
+	}
+}
+
+func testTransport(t *testing.T, server, client Transport, addr string) {
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+
+	srv := NewServer()
+	srv.SetTransport(server)
+	srv.AddPOSTResource("/echo", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(message.Payload, CoapCodeChanged)
+	})
+	addr = listenServer(t, srv, addr)
+	c := NewClient()
+	c.SetTransport(client)
+	defer c.Close()
+
+	for _, scheme := range []string{"coap", "coaps"} {
+		resp, err := c.POST(body, scheme+"://"+addr+"/echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != CoapCodeChanged || !bytes.Equal(resp.Body, body) {
+			t.Fatalf("unexpected %s response %v of %d bytes", scheme, resp.Code, len(resp.Body))
+		}
+	}
+}
+
+func TestPipeTransport(t *testing.T) {
+	pipe := NewPipeTransport()
+	testTransport(t, pipe, pipe, "127.0.0.1:1")
+}
+
+func TestTCPTransport(t *testing.T) {
+	testTransport(t, NewTCPTransport(), NewTCPTransport(), "127.0.0.1:0")
+}
+
+func TestTLSTransport(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	server := NewTLSTransport(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	client := NewTLSTransport(&tls.Config{RootCAs: roots})
+	testTransport(t, server, client, "127.0.0.1:0")
+}
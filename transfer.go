@@ -0,0 +1,185 @@
+package coalago
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+const (
+	TRANSFER_ID_MAX_SIZE = 16
+	TRANSFER_HASH_SIZE   = 8
+)
+
+// Blocks of resumable transfers that were neither completed nor resumed are dropped after it
+var TRANSFERS_EXPIRATION = 24 * time.Hour
+
+var (
+	ErrInvalidTransferID = errors.New("invalid transfer ID")
+	ErrCorruptTransfer   = errors.New("corrupt transfer record")
+)
+
+// TransferStorage keeps the blocks of resumable Block1 transfers received so
+// far, so that the sender can continue an interrupted transfer. Transfers
+// are keyed by their peer, ID, the hash of their content and the block size.
+type TransferStorage interface {
+	Store(key string, num int, data []byte) error
+	Load(key string) (map[int][]byte, error)
+	Delete(key string) error
+}
+
+// NewTransferID returns a random ID for SetTransferID. It should be kept
+// with the payload for as long as the transfer may have to be resumed.
+func NewTransferID() []byte {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return id
+}
+
+// SetTransferID makes the transfer of a large payload resumable: when it is
+// sent again with the same ID, the blocks the peer already has are skipped.
+func (m *CoAPMessage) SetTransferID(id []byte) error {
+	if len(id) == 0 || len(id) > TRANSFER_ID_MAX_SIZE {
+		return ErrInvalidTransferID
+	}
+	m.RemoveOptions(OptionTransferID)
+	m.AddOption(OptionTransferID, string(id))
+	return nil
+}
+
+// transferOptionValue is the value of the option in blocks: the transfer ID
+// followed by the hash of the content, a changed payload is a new transfer.
+func transferOptionValue(id string, payload []byte) string {
+	hash := sha256.Sum256(payload)
+	return id + string(hash[:TRANSFER_HASH_SIZE])
+}
+
+// transferPeer is who may resume a transfer: the identity or public key of
+// a coaps:// peer, which it keeps across sessions, or the host of a coap:// one.
+func transferPeer(message *CoAPMessage) string {
+	switch {
+	case len(message.PeerIdentity) > 0:
+		return "identity:" + string(message.PeerIdentity)
+	case len(message.PeerPublicKey) > 0:
+		return "key:" + string(message.PeerPublicKey)
+	}
+	return "host:" + peerHost(message.Sender)
+}
+
+func transferKey(peer, value string, blockSize int) string {
+	return hex.EncodeToString([]byte(peer)) + "-" + hex.EncodeToString([]byte(value)) + "-" + strconv.Itoa(blockSize)
+}
+
+// checkTransferHash tells whether the payload is the content whose hash
+// ends the value of the option.
+func checkTransferHash(value string, payload []byte) bool {
+	if len(value) <= TRANSFER_HASH_SIZE {
+		return false
+	}
+	hash := sha256.Sum256(payload)
+	return value[len(value)-TRANSFER_HASH_SIZE:] == string(hash[:TRANSFER_HASH_SIZE])
+}
+
+// contiguousBlocks is the number of blocks received from the first one without a gap.
+func contiguousBlocks(buf map[int][]byte) int {
+	n := 0
+	for {
+		if _, ok := buf[n]; !ok {
+			return n
+		}
+		n++
+	}
+}
+
+// resumeBlock1 asks the peer for the blocks of the transfer it already has
+// and returns the number of the block to continue from.
+func (sr *transport) resumeBlock1(message *CoAPMessage, value string, blockSize int) (int, error) {
+	query := newLockStepBlock(message, OptionBlock1, newBlock(true, 0, blockSize), nil)
+	query.RemoveOptions(OptionTransferID)
+	query.AddOption(OptionTransferID, value)
+
+	resp, err := sr.exchange(query)
+	if err != nil {
+		return 0, err
+	}
+	b := resp.GetBlock1()
+	if resp.Code != CoapCodeContinue || b == nil || b.BERT || b.BlockSize != blockSize {
+		return 0, nil
+	}
+	return b.BlockNumber, nil
+}
+
+// loadTransfer adds the blocks of the transfer kept by the storage to buf.
+// A transfer that can't be loaded starts anew, a corrupt one is dropped.
+func loadTransfer(sr *transport, key string, buf map[int][]byte) {
+	blocks, err := sr.transfers.Load(key)
+	if err != nil {
+		MetricTransferStorageErrors.Inc()
+		if errors.Is(err, ErrCorruptTransfer) {
+			sr.transfers.Delete(key)
+		}
+		return
+	}
+	for num, data := range blocks {
+		if _, ok := buf[num]; !ok {
+			buf[num] = data
+		}
+	}
+}
+
+// receiveTransferQuery answers the query of a resumable transfer with the
+// number of the first block the receiver does not have.
+func receiveTransferQuery(sr *transport, inputMessage *CoAPMessage, buf map[int][]byte, blockSize int) error {
+	ack := ackTo(nil, inputMessage, CoapCodeContinue)
+	ack.RemoveOptions(OptionBlock1)
+	ack.AddOption(OptionBlock1, newBlock(true, contiguousBlocks(buf), blockSize).ToInt())
+	return sr.sendToSocketByAddress(ack, inputMessage.Sender)
+}
+
+type memoryTransferStorage struct {
+	mx      sync.Mutex
+	storage *cache.Cache
+}
+
+// NewMemoryTransferStorage returns the in-memory storage used by default.
+// Transfers are dropped after TRANSFERS_EXPIRATION without new blocks.
+func NewMemoryTransferStorage() TransferStorage {
+	return &memoryTransferStorage{storage: cache.New(TRANSFERS_EXPIRATION, time.Minute)}
+}
+
+func (s *memoryTransferStorage) Store(key string, num int, data []byte) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	blocks := make(map[int][]byte)
+	if v, ok := s.storage.Get(key); ok {
+		blocks = v.(map[int][]byte)
+	}
+	blocks[num] = data
+	s.storage.SetDefault(key, blocks)
+	return nil
+}
+
+func (s *memoryTransferStorage) Load(key string) (map[int][]byte, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	blocks := make(map[int][]byte)
+	if v, ok := s.storage.Get(key); ok {
+		for num, data := range v.(map[int][]byte) {
+			blocks[num] = data
+		}
+	}
+	return blocks, nil
+}
+
+func (s *memoryTransferStorage) Delete(key string) error {
+	s.storage.Delete(key)
+	return nil
+}
@@ -0,0 +1,111 @@
+package coalago
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileTransferStorage keeps the blocks of resumable transfers in a
+// directory, one file per transfer, so that they survive a restart of the
+// receiver. Blocks are appended as they arrive; files of transfers idle
+// for TRANSFERS_EXPIRATION are removed when the storage is opened.
+type FileTransferStorage struct {
+	dir string
+	mx  sync.Mutex
+}
+
+// NewFileTransferStorage creates dir if needed and removes expired transfers from it.
+func NewFileTransferStorage(dir string) (*FileTransferStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !f.IsDir() && time.Since(f.ModTime()) > TRANSFERS_EXPIRATION {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+
+	return &FileTransferStorage{dir: dir}, nil
+}
+
+func (s *FileTransferStorage) path(key string) string {
+	return filepath.Join(s.dir, key+".blocks")
+}
+
+// Store appends the block as its number and length in 4 bytes each, then the data.
+func (s *FileTransferStorage) Store(key string, num int, data []byte) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	f, err := os.OpenFile(s.path(key), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(record, uint32(num))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(data)))
+	if _, err = f.Write(append(record, data...)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Load reads the blocks of the transfer, a record cut short by a crash is
+// ignored. A record larger than a block is ErrCorruptTransfer.
+func (s *FileTransferStorage) Load(key string) (map[int][]byte, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	blocks := make(map[int][]byte)
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return blocks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	for {
+		if _, err = io.ReadFull(f, header); err != nil {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(header[4:]))
+		if size > MAX_PAYLOAD_SIZE {
+			return nil, ErrCorruptTransfer
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(f, data); err != nil {
+			break
+		}
+		blocks[int(binary.BigEndian.Uint32(header))] = data
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return blocks, err
+}
+
+func (s *FileTransferStorage) Delete(key string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package coalago
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileTransferStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := NewFileTransferStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Store("key", 0, []byte("first"))
+	storage.Store("key", 2, []byte("third"))
+
+	// A restarted receiver finds the blocks
+	if storage, err = NewFileTransferStorage(dir); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := storage.Load("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || string(blocks[0]) != "first" || string(blocks[2]) != "third" {
+		t.Fatalf("unexpected blocks %q", blocks)
+	}
+	if contiguousBlocks(blocks) != 1 {
+		t.Fatal("unexpected number of contiguous blocks")
+	}
+
+	if err = storage.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if blocks, _ = storage.Load("key"); len(blocks) != 0 {
+		t.Fatal("transfer is not deleted")
+	}
+
+	// A record longer than a block is not taken for the end of the file
+	corrupt := []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}
+	if err = ioutil.WriteFile(storage.path("corrupt"), corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.Load("corrupt"); err != ErrCorruptTransfer {
+		t.Fatalf("expected corrupt transfer, got %v", err)
+	}
+}
+
+// countingTransferStorage counts the blocks stored by their number.
+type countingTransferStorage struct {
+	TransferStorage
+	mx     sync.Mutex
+	stored map[int]int
+}
+
+func (s *countingTransferStorage) Store(key string, num int, data []byte) error {
+	s.mx.Lock()
+	s.stored[num]++
+	s.mx.Unlock()
+	return s.TransferStorage.Store(key, num, data)
+}
+
+func (s *countingTransferStorage) reset() map[int]int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	stored := s.stored
+	s.stored = make(map[int]int)
+	return stored
+}
+
+func TestResumableTransfer(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	id := NewTransferID()
+	value := transferOptionValue(string(id), body)
+	key := transferKey("host:127.0.0.1", value, MAX_PAYLOAD_SIZE)
+
+	received := make(chan []byte, 1)
+	storage := &countingTransferStorage{TransferStorage: NewMemoryTransferStorage(), stored: make(map[int]int)}
+	srv := NewServer()
+	srv.SetTransferStorage(storage)
+	srv.AddPOSTResource("/firmware", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		received <- message.Payload.Bytes()
+		return NewResponse(NewEmptyPayload(), CoapCodeChanged)
+	})
+	go func() {
+		err := srv.Listen(":12325")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	// Blocks received before the transfer was interrupted
+	store := func(key string, data []byte) {
+		for i := 0; i < 6; i++ {
+			storage.TransferStorage.Store(key, i, data[i*MAX_PAYLOAD_SIZE:(i+1)*MAX_PAYLOAD_SIZE])
+		}
+	}
+	send := func() CoapCode {
+		t.Helper()
+		message := NewCoAPMessage(CON, POST)
+		message.SetURIPath("/firmware")
+		message.Payload = NewBytesPayload(body)
+		if err := message.SetTransferID(id); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := NewClient().Send(message, "127.0.0.1:12325")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Code
+	}
+
+	// Stored blocks of other content are not handled
+	store(key, bytes.Repeat([]byte("x"), len(body)))
+	if code := send(); code != CoapCodeRequestEntityIncomplete {
+		t.Fatalf("expected %v, got %v", CoapCodeRequestEntityIncomplete, code)
+	}
+	select {
+	case <-received:
+		t.Fatal("handler got a payload that does not match the transfer hash")
+	default:
+	}
+	if blocks, _ := storage.Load(key); len(blocks) != 0 {
+		t.Fatal("mismatching transfer is not deleted")
+	}
+
+	store(key, body)
+	storage.reset()
+	if code := send(); code != CoapCodeChanged {
+		t.Fatalf("unexpected response %v", code)
+	}
+	if got := <-received; !bytes.Equal(got, body) {
+		t.Fatalf("unexpected body of %d bytes", len(got))
+	}
+	if stored := storage.reset(); stored[0] != 0 || stored[5] != 0 || stored[6] == 0 {
+		t.Fatalf("stored blocks were sent again: %v", stored)
+	}
+	if blocks, _ := storage.Load(key); len(blocks) != 0 {
+		t.Fatal("complete transfer is not deleted")
+	}
+
+	// The blocks of another peer are not resumed
+	other := transferKey("host:192.0.2.1", value, MAX_PAYLOAD_SIZE)
+	store(other, body)
+	if code := send(); code != CoapCodeChanged {
+		t.Fatalf("unexpected response %v", code)
+	}
+	<-received
+	if stored := storage.reset(); stored[0] == 0 {
+		t.Fatal("transfer was resumed from the blocks of another peer")
+	}
+	if blocks, _ := storage.Load(other); len(blocks) != 6 {
+		t.Fatal("transfer of another peer was changed")
+	}
+}
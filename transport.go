@@ -9,12 +9,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/coalalib/coalago/session"
 	"github.com/patrickmn/go-cache"
 )
 
 var (
 	ErrUnsupportedType = errors.New("unsupported type of message")
-	globalSessions     = newSessionStorageImpl()
+	globalSessions     = newSessionStorageImpl(true)
 	handlersStateCache = cache.New(sumTimeAttempts, time.Second)
 	proxyIDSessions    = newProxySessionStorage()
 )
@@ -23,12 +24,41 @@ type transport struct {
 	conn           dialer
 	block2channels sync.Map
 	block1channels sync.Map
-	privateKey     []byte
+	pinnedSessions sync.Map
+	sessions       SessionStorage
+	// previousSessions are the sessions replaced by a rekey, kept so that
+	// messages of transfers that started on the old keys can be decrypted.
+	previousSessions *sessionStorageImpl
+	privateKey       []byte
+	cipherSuites     []session.CipherSuite
+	identity         *session.Identity
+	peerIdentity     PeerIdentityPolicy
+	rekeyPolicy      RekeyPolicy
+	rekeys           *rekeyer
+	handshakes       *handshakeState
+	oscoreContexts   *oscoreRegistry
+	access           *accessControl
+	hooks            SecurityHooks
+	blockwise        *blockwiseModes
+	windowPolicy     WindowPolicy
+	transfers        TransferStorage
+	digest           DigestAlgorithm
+	limits           TransferLimits
+	limiter          *transferLimiter
+	workers          WorkerPolicy
+	handlers         chan struct{}
 }
 
 func newtransport(conn dialer) *transport {
 	sr := new(transport)
 	sr.conn = conn
+	sr.sessions = globalSessions
+	sr.previousSessions = newSessionStorageImpl(false)
+	sr.handshakes = newHandshakeState()
+	sr.rekeyPolicy = DefaultRekeyPolicy
+	sr.windowPolicy = DefaultWindowPolicy
+	sr.limits = DefaultTransferLimits
+	sr.limiter = newTransferLimiter()
 
 	return sr
 }
@@ -50,13 +80,13 @@ func (sr *transport) Send(message *CoAPMessage) (resp *CoAPMessage, err error) {
 
 			_, err := handshake(sr, message, sr.conn.RemoteAddr(), proxyAddr)
 			if err != nil {
-				return nil, err
+				return nil, newError("handshake", message, sr.conn.RemoteAddr().String(), 0, err)
 			}
 		}
 
 		resp, err := sr.sendCON(message)
-		if err == ErrorSessionExpired || err == ErrorSessionNotFound ||
-			err == ErrorClientSessionExpired || err == ErrorClientSessionNotFound {
+		if errors.Is(err, ErrorSessionExpired) || errors.Is(err, ErrorSessionNotFound) ||
+			errors.Is(err, ErrorClientSessionExpired) || errors.Is(err, ErrorClientSessionNotFound) {
 			if message.GetScheme() == COAPS_SCHEME {
 				proxyAddr := message.ProxyAddr
 				if len(proxyAddr) > 0 {
@@ -64,15 +94,15 @@ func (sr *transport) Send(message *CoAPMessage) (resp *CoAPMessage, err error) {
 					proxyAddr = fmt.Sprintf("%v%v", proxyAddr, proxyID)
 				}
 				if _, err := handshake(sr, message, sr.conn.RemoteAddr(), proxyAddr); err != nil {
-					return nil, err
+					return nil, newError("handshake", message, sr.conn.RemoteAddr().String(), 0, err)
 				}
 			}
 
 			resp, err = sr.sendCON(message)
 		}
-		return resp, err
+		return resp, newError("send", message, sr.conn.RemoteAddr().String(), 0, err)
 	case RST, NON:
-		return nil, sr.sendToSocket(message)
+		return nil, newError("send", message, sr.conn.RemoteAddr().String(), 0, sr.sendToSocket(message))
 	default:
 		return nil, ErrUnsupportedType
 	}
@@ -88,7 +118,25 @@ func (sr *transport) SendTo(message *CoAPMessage, addr net.Addr) (resp *CoAPMess
 }
 
 func (sr *transport) sendCON(message *CoAPMessage) (resp *CoAPMessage, err error) {
-	if isBigPayload(message) {
+	if sr.lockStep() && message.Code != CoapCodeEmpty && message.GetOption(OptionHandshakeType) == nil {
+		return sr.sendCONLockStep(message)
+	}
+
+	if blockSize := sr.windowBlockSize(sr.conn.RemoteAddr()); blockSize < MAX_PAYLOAD_SIZE &&
+		message.Code != CoapCodeEmpty && message.GetOption(OptionHandshakeType) == nil && message.GetBlock2() == nil {
+		// Early negotiation of the size of response blocks, the window
+		// option keeps the request apart from RFC 7959 ones. They are
+		// added to a copy, the message of the caller may be sent again.
+		origMessage := message
+		message = origMessage.Clone(true)
+		message.Options = append([]*CoAPMessageOption{}, origMessage.Options...)
+		message.Recipient = origMessage.Recipient
+		message.Context = origMessage.Context
+		message.AddOption(OptionBlock2, newBlock(false, 0, blockSize).ToInt())
+		message.AddOption(OptionSelectiveRepeatWindowSize, sr.windowPolicy.Initial)
+	}
+
+	if isBigPayload(message, sr.windowBlockSize(sr.conn.RemoteAddr())) {
 		resp, err = sr.sendARQBlock1CON(message)
 		return
 	}
@@ -113,10 +161,10 @@ func (sr *transport) sendCON(message *CoAPMessage) (resp *CoAPMessage, err error
 		}
 
 		resp, err = receiveMessage(sr, message)
-		if err == ErrMaxAttempts {
+		if errors.Is(err, ErrMaxAttempts) {
 			if attempts == maxSendAttempts {
 				MetricExpiredMessages.Inc()
-				return nil, err
+				return nil, newError("send", message, sr.conn.RemoteAddr().String(), attempts, err)
 			}
 			continue
 		}
@@ -133,7 +181,8 @@ func (sr *transport) sendCON(message *CoAPMessage) (resp *CoAPMessage, err error
 			return resp, err
 		}
 
-		if resp.GetBlock2() != nil {
+		// Blocks come in CON, an ACK with Block2 only echoes the request
+		if resp.Type == CON && resp.GetBlock2() != nil {
 			resp, err = sr.receiveARQBlock2(message, resp)
 			return resp, err
 		}
@@ -150,8 +199,9 @@ func isPingACK(resp *CoAPMessage) bool {
 
 func (sr *transport) sendACKTo(message *CoAPMessage, addr net.Addr) (err error) {
 	if message.Type == ACK {
-		if isBigPayload(message) {
-			ch := make(chan *CoAPMessage, 102400)
+		if isBigPayload(message, sr.responseBlockSize(message, addr)) {
+			// ACKs that do not fit are dropped, their blocks are sent again
+			ch := make(chan *CoAPMessage, 2*DEFAULT_WINDOW_SIZE)
 			id := addr.String() + message.GetTokenString()
 			sr.block2channels.Store(id, ch)
 			err = sr.sendARQBlock2ACK(ch, message, addr)
@@ -192,63 +242,25 @@ func (sr *transport) sendToSocketByAddress(message *CoAPMessage, addr net.Addr)
 	return err
 }
 
-func (sr *transport) sendPackets(packets []*packet, windowsize int, shift int) error {
-	stop := shift + windowsize
+func (sr *transport) sendPackets(packets []*packet, w *window, shift int) error {
+	stop := shift + w.size()
 	if stop >= len(packets) {
 		stop = len(packets)
 	}
 
 	var acked int
-	for i := 0; i < stop; i++ {
-		if !packets[i].acked {
-			if time.Since(packets[i].lastSend) >= timeWait {
-				if packets[i].attempts > 0 {
-					MetricRetransmitMessages.Inc()
-				}
-				if packets[i].attempts == maxSendAttempts {
-					MetricExpiredMessages.Inc()
-					return ErrMaxAttempts
-				}
-				packets[i].attempts++
-				packets[i].lastSend = time.Now()
-				if err := sr.sendToSocket(packets[i].message); err != nil {
-					return err
-				}
-			}
-		} else {
-			acked++
+	var retransmitted bool
+	defer func() {
+		if retransmitted {
+			w.timeout()
 		}
-	}
-
-	if len(packets) == stop {
-		if time.Since(packets[len(packets)-1].lastSend) >= timeWait {
-			MetricExpiredMessages.Inc()
-			return ErrMaxAttempts
-		}
-	}
-
-	return nil
-}
-
-func (sr *transport) sendPacketsByWindowOffset(packets []*packet, windowsize, shift, blockNumber, offset int) error {
-	stop := shift + windowsize
-	if stop >= blockNumber {
-		stop = blockNumber
-	}
-
-	start := blockNumber - offset
-	if start < 0 {
-		start = 0
-	} else if start > blockNumber {
-		return nil
-	}
-
-	var acked int
-	for i := start; i < stop; i++ {
+	}()
+	for i := 0; i < stop; i++ {
 		if !packets[i].acked {
 			if time.Since(packets[i].lastSend) >= timeWait {
 				if packets[i].attempts > 0 {
 					MetricRetransmitMessages.Inc()
+					retransmitted = true
 				}
 				if packets[i].attempts == maxSendAttempts {
 					MetricExpiredMessages.Inc()
@@ -256,6 +268,7 @@ func (sr *transport) sendPacketsByWindowOffset(packets []*packet, windowsize, sh
 				}
 				packets[i].attempts++
 				packets[i].lastSend = time.Now()
+				packets[i].message.AddOption(OptionSelectiveRepeatWindowSize, w.size())
 				if err := sr.sendToSocket(packets[i].message); err != nil {
 					return err
 				}
@@ -275,53 +288,8 @@ func (sr *transport) sendPacketsByWindowOffset(packets []*packet, windowsize, sh
 	return nil
 }
 
-func (sr *transport) sendPacketsByWindowOffsetToAddr(packets []*packet, windowsize, shift, blockNumber, offset int, addr net.Addr) error {
-	stop := shift + windowsize
-	if stop >= blockNumber {
-		stop = blockNumber
-	}
-
-	start := blockNumber - offset
-	if start < 0 {
-		start = 0
-	} else if start > blockNumber {
-		return nil
-	}
-
-	var acked int
-	for i := start; i < stop; i++ {
-		if !packets[i].acked {
-			if time.Since(packets[i].lastSend) >= timeWait {
-				if packets[i].attempts > 0 {
-					MetricRetransmitMessages.Inc()
-				}
-				if packets[i].attempts == maxSendAttempts {
-					MetricExpiredMessages.Inc()
-					return ErrMaxAttempts
-				}
-				packets[i].attempts++
-				packets[i].lastSend = time.Now()
-				if err := sr.sendToSocketByAddress(packets[i].message, addr); err != nil {
-					return err
-				}
-			}
-		} else {
-			acked++
-		}
-	}
-
-	if len(packets) == stop {
-		if time.Since(packets[len(packets)-1].lastSend) >= timeWait {
-			MetricExpiredMessages.Inc()
-			return ErrMaxAttempts
-		}
-	}
-
-	return nil
-}
-
-func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize int, shift int, addr net.Addr) error {
-	stop := shift + windowsize
+func (sr *transport) sendPacketsToAddr(packets []*packet, w *window, shift int, addr net.Addr) error {
+	stop := shift + w.size()
 	if stop >= len(packets) {
 		stop = len(packets)
 	}
@@ -332,15 +300,25 @@ func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize int, shift
 	}
 
 	var acked int
+	var retransmitted bool
+	defer func() {
+		if retransmitted {
+			w.timeout()
+		}
+	}()
 	for i := 0; i < stop; i++ {
 		if !packets[i].acked {
 			if time.Since(packets[i].lastSend) >= timeWait {
+				if packets[i].attempts > 0 {
+					retransmitted = true
+				}
 				if packets[i].attempts == maxSendAttempts {
 					MetricExpiredMessages.Inc()
 					return ErrMaxAttempts
 				}
 				packets[i].attempts++
 				packets[i].lastSend = time.Now()
+				packets[i].message.AddOption(OptionSelectiveRepeatWindowSize, w.size())
 				if err := sr.sendToSocketByAddress(packets[i].message, addr); err != nil {
 					return err
 				}
@@ -354,17 +332,25 @@ func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize int, shift
 }
 
 func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error) {
+	for retries := 0; ; retries++ {
+		resp, err := sr.sendARQBlock1(message)
+		if err != nil || !isDigestMismatch(resp) || retries == MAX_DIGEST_RETRIES {
+			return resp, err
+		}
+	}
+}
+
+func (sr *transport) sendARQBlock1(message *CoAPMessage) (*CoAPMessage, error) {
+	defer sr.pinSession(message, sr.conn.RemoteAddr())()
+
 	state := new(stateSend)
 	state.payload = message.Payload.Bytes()
 	state.lenght = len(state.payload)
 	state.origMessage = message
-	state.blockSize = MAX_PAYLOAD_SIZE
-	numblocks := math.Ceil(float64(state.lenght) / float64(MAX_PAYLOAD_SIZE))
-	if numblocks < DEFAULT_WINDOW_SIZE {
-		state.windowsize = int(numblocks)
-	} else {
-		state.windowsize = DEFAULT_WINDOW_SIZE
-	}
+	state.blockSize = sr.windowBlockSize(sr.conn.RemoteAddr())
+	numblocks := math.Ceil(float64(state.lenght) / float64(state.blockSize))
+	w := newWindow(sr.windowPolicy, int(numblocks))
+	state.windowsize = w.size()
 
 	packets := []*packet{}
 
@@ -379,10 +365,27 @@ func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error
 			break
 		}
 	}
+	addPayloadDigest(packets[len(packets)-1].message, sr.digest, state.payload)
 
 	var shift = 0
 
-	err := sr.sendPackets(packets, state.windowsize, shift)
+	// A resumable transfer goes on from the first block the peer does not have
+	if option := message.GetOption(OptionTransferID); option != nil {
+		value := transferOptionValue(option.StringValue(), state.payload)
+		for _, p := range packets {
+			p.message.AddOption(OptionTransferID, value)
+		}
+		next, err := sr.resumeBlock1(message, value, state.blockSize)
+		if err != nil {
+			return nil, err
+		}
+		// The last block is sent anyway, it completes the transfer
+		for ; shift < next && shift < len(packets)-1; shift++ {
+			packets[shift].acked = true
+		}
+	}
+
+	err := sr.sendPackets(packets, w, shift)
 	if err != nil {
 		return nil, err
 	}
@@ -390,8 +393,8 @@ func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error
 	for {
 		resp, err := receiveMessage(sr, message)
 		if err != nil {
-			if err == ErrMaxAttempts {
-				if err = sr.sendPackets(packets, state.windowsize, shift); err != nil {
+			if errors.Is(err, ErrMaxAttempts) {
+				if err = sr.sendPackets(packets, w, shift); err != nil {
 					return nil, err
 				}
 				continue
@@ -404,32 +407,38 @@ func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error
 				return sr.receiveARQBlock2(message, nil)
 			}
 
-			if resp.GetBlock2() != nil {
-				return sr.receiveARQBlock2(message, resp)
+			block := resp.GetBlock1()
+			if block == nil {
+				if resp.GetBlock2() != nil {
+					return sr.receiveARQBlock2(message, resp)
+				}
+				continue
 			}
 
-			block := resp.GetBlock1()
-			if block != nil {
-				// wo := resp.GetOption(OptionWindowtOffset)
-				// if wo != nil {
-				// 	sr.sendPacketsByWindowOffset(packets, state.windowsize, shift, block.BlockNumber, int(wo.Value.(uint32)))
-				// }
-				if len(packets) >= block.BlockNumber {
-					if resp.Code != CoapCodeContinue {
-						return resp, nil
-					}
-					packets[block.BlockNumber].acked = true
-					if block.BlockNumber == shift {
-						shift++
-						for _, p := range packets[shift:] {
-							if p.acked {
-								shift++
-							} else {
-								break
-							}
-						}
+			if len(packets) > block.BlockNumber && resp.MessageID == packets[block.BlockNumber].message.MessageID {
+				// The server takes smaller blocks, the transfer starts over with them
+				if resp.Code == CoapCodeRequestEntityTooLarge && !block.BERT && block.BlockSize < state.blockSize {
+					sr.blockwise.shrink(sr.conn.RemoteAddr(), block.BlockSize)
+					return sr.sendARQBlock1(message)
+				}
+				if resp.Code != CoapCodeContinue {
+					return resp, nil
+				}
+				if !packets[block.BlockNumber].acked {
+					w.ack(block.BlockNumber == shift)
+				}
+				packets[block.BlockNumber].acked = true
 
-						if err = sr.sendPackets(packets, state.windowsize, shift); err != nil {
+				if err = retransmitPackets(selectiveAck(packets, resp, w), sr.sendToSocket); err != nil {
+					return nil, err
+				}
+
+				if shift < len(packets) && packets[shift].acked {
+					for shift < len(packets) && packets[shift].acked {
+						shift++
+					}
+					if shift < len(packets) {
+						if err = sr.sendPackets(packets, w, shift); err != nil {
 							return nil, err
 						}
 					}
@@ -440,17 +449,16 @@ func (sr *transport) sendARQBlock1CON(message *CoAPMessage) (*CoAPMessage, error
 }
 
 func (sr *transport) sendARQBlock2ACK(input chan *CoAPMessage, message *CoAPMessage, addr net.Addr) error {
+	defer sr.pinSession(message, addr)()
+
 	state := new(stateSend)
 	state.payload = message.Payload.Bytes()
 	state.lenght = len(state.payload)
 	state.origMessage = message
-	state.blockSize = MAX_PAYLOAD_SIZE
-	numblocks := math.Ceil(float64(state.lenght) / float64(MAX_PAYLOAD_SIZE))
-	if numblocks < DEFAULT_WINDOW_SIZE {
-		state.windowsize = int(numblocks)
-	} else {
-		state.windowsize = DEFAULT_WINDOW_SIZE
-	}
+	state.blockSize = sr.responseBlockSize(message, addr)
+	numblocks := math.Ceil(float64(state.lenght) / float64(state.blockSize))
+	w := newWindow(sr.windowPolicy, int(numblocks))
+	state.windowsize = w.size()
 
 	packets := []*packet{}
 
@@ -472,13 +480,16 @@ func (sr *transport) sendARQBlock2ACK(input chan *CoAPMessage, message *CoAPMess
 			break
 		}
 	}
+	addPayloadDigest(packets[len(packets)-1].message, sr.digest, state.payload)
 
 	var shift = 0
 
-	if err := sr.sendPacketsToAddr(packets, state.windowsize, shift, addr); err != nil {
+	if err := sr.sendPacketsToAddr(packets, w, shift, addr); err != nil {
 		return err
 	}
 
+	var retries int
+
 	for {
 		select {
 		case resp := <-input:
@@ -489,30 +500,41 @@ func (sr *transport) sendARQBlock2ACK(input chan *CoAPMessage, message *CoAPMess
 				block := resp.GetBlock2()
 				if block != nil {
 					if len(packets) >= block.BlockNumber {
+						// The client got a payload that does not match the digest
+						if isDigestMismatch(resp) && retries < MAX_DIGEST_RETRIES {
+							retries++
+							for _, p := range packets {
+								*p = packet{message: p.message}
+							}
+							shift = 0
+							w = newWindow(sr.windowPolicy, len(packets))
+							if err := sr.sendPacketsToAddr(packets, w, shift, addr); err != nil {
+								return err
+							}
+							continue
+						}
 						if resp.Code != CoapCodeContinue {
 							return nil
 						}
 						if block.BlockNumber < len(packets) {
-							// wo := resp.GetOption(OptionWindowtOffset)
-							// if wo != nil {
-							// 	wov := wo.Uint16Value()
-							// 	sr.sendPacketsByWindowOffset(packets, state.windowsize, shift, block.BlockNumber, int(wov))
+							if !packets[block.BlockNumber].acked {
+								w.ack(block.BlockNumber == shift)
+							}
+							packets[block.BlockNumber].acked = true
 
-							// }
+							sendToAddr := func(m *CoAPMessage) error { return sr.sendToSocketByAddress(m, addr) }
+							if err := retransmitPackets(selectiveAck(packets, resp, w), sendToAddr); err != nil {
+								return err
+							}
 
-							packets[block.BlockNumber].acked = true
-							if block.BlockNumber == shift {
-								shift++
-								for _, p := range packets[shift:] {
-									if p.acked {
-										shift++
-									} else {
-										break
-									}
+							if shift < len(packets) && packets[shift].acked {
+								for shift < len(packets) && packets[shift].acked {
+									shift++
 								}
-
-								if err := sr.sendPacketsToAddr(packets, state.windowsize, shift, addr); err != nil {
-									return err
+								if shift < len(packets) {
+									if err := sr.sendPacketsToAddr(packets, w, shift, addr); err != nil {
+										return err
+									}
 								}
 							}
 						}
@@ -520,7 +542,7 @@ func (sr *transport) sendARQBlock2ACK(input chan *CoAPMessage, message *CoAPMess
 				}
 			}
 		case <-time.After(sumTimeAttempts):
-			if err := sr.sendPacketsToAddr(packets, state.windowsize, shift, addr); err != nil {
+			if err := sr.sendPacketsToAddr(packets, w, shift, addr); err != nil {
 				return err
 			}
 		}
@@ -530,6 +552,7 @@ func (sr *transport) sendARQBlock2ACK(input chan *CoAPMessage, message *CoAPMess
 func (sr *transport) receiveARQBlock1(input chan *CoAPMessage) (*CoAPMessage, error) {
 	buf := make(map[int][]byte)
 	totalBlocks := -1
+	var digest *CoAPMessageOption
 
 	for {
 		select {
@@ -540,6 +563,7 @@ func (sr *transport) receiveARQBlock1(input chan *CoAPMessage) (*CoAPMessage, er
 			}
 			if !block.MoreBlocks {
 				totalBlocks = block.BlockNumber + 1
+				digest = inputMessage.GetOption(OptionPayloadDigest)
 			}
 
 			buf[block.BlockNumber] = inputMessage.Payload.Bytes()
@@ -548,15 +572,26 @@ func (sr *transport) receiveARQBlock1(input chan *CoAPMessage) (*CoAPMessage, er
 				for i := 0; i < totalBlocks; i++ {
 					b = append(b, buf[i]...)
 				}
-				inputMessage.Payload = NewBytesPayload(b)
 
+				// The sender retries the whole transfer
+				if !checkPayloadDigest(digest, b) {
+					ack := ackTo(nil, inputMessage, CoapCodeRequestEntityIncomplete)
+					ack.AddOption(OptionPayloadDigest, digest.StringValue())
+					buf, totalBlocks, digest = make(map[int][]byte), -1, nil
+					if err := sr.sendToSocketByAddress(ack, inputMessage.Sender); err != nil {
+						return nil, err
+					}
+					continue
+				}
+
+				inputMessage.Payload = NewBytesPayload(b)
 				return inputMessage, nil
 			}
 
 			var ack *CoAPMessage
 			w := inputMessage.GetOption(OptionSelectiveRepeatWindowSize)
 			if w != nil {
-				ack = ackToWithWindowOffset(nil, inputMessage, CoapCodeContinue, w.IntValue(), block.BlockNumber, buf)
+				ack = ackToWithSelectiveAck(nil, inputMessage, CoapCodeContinue, buf)
 			} else {
 				ack = ackTo(nil, inputMessage, CoapCodeContinue)
 			}
@@ -575,63 +610,55 @@ func (sr *transport) receiveARQBlock1(input chan *CoAPMessage) (*CoAPMessage, er
 func (sr *transport) receiveARQBlock2(origMessage *CoAPMessage, inputMessage *CoAPMessage) (rsp *CoAPMessage, err error) {
 	buf := make(map[int][]byte)
 	totalBlocks := -1
+	var digest *CoAPMessageOption
+	var contiguous int
 
-	var attempts int
+	var attempts, mismatches int
 
-	if inputMessage != nil {
-		block := inputMessage.GetBlock2()
-		if block != nil && inputMessage.Type == CON {
-			if !block.MoreBlocks {
-				totalBlocks = block.BlockNumber + 1
-			}
-			buf[block.BlockNumber] = inputMessage.Payload.Bytes()
-			if totalBlocks == len(buf) {
-				b := []byte{}
-				for i := 0; i < totalBlocks; i++ {
-					b = append(b, buf[i]...)
+	for ; ; inputMessage = nil {
+		if inputMessage == nil {
+			inputMessage, err = receiveMessage(sr, origMessage)
+			if errors.Is(err, ErrMaxAttempts) {
+				if attempts == maxSendAttempts {
+					MetricExpiredMessages.Inc()
+					return nil, newError("receive", origMessage, sr.conn.RemoteAddr().String(), attempts, err)
 				}
-				inputMessage.Payload = NewBytesPayload(b)
-
-				ack := ackTo(origMessage, inputMessage, CoapCodeEmpty)
-				sr.sendToSocket(ack)
-				return inputMessage, nil
+				attempts++
+				continue
+			}
+			if err != nil {
+				return nil, err
 			}
 
-			var ack *CoAPMessage
-			w := inputMessage.GetOption(OptionSelectiveRepeatWindowSize)
-			if w != nil {
-				ack = ackToWithWindowOffset(origMessage, inputMessage, CoapCodeContinue, w.IntValue(), block.BlockNumber, buf)
-			} else {
-				ack = ackTo(origMessage, inputMessage, CoapCodeContinue)
+			if attempts > 0 {
+				MetricRetransmitMessages.Inc()
 			}
-			sr.sendToSocket(ack)
 		}
-	}
 
-	for {
-		inputMessage, err = receiveMessage(sr, origMessage)
-		if err == ErrMaxAttempts {
-			if attempts == maxSendAttempts {
-				MetricExpiredMessages.Inc()
-				return nil, err
-			}
-			attempts++
+		block := inputMessage.GetBlock2()
+		if block == nil || inputMessage.Type != CON {
 			continue
 		}
-		if err != nil {
-			return nil, err
-		}
 
-		if attempts > 0 {
-			MetricRetransmitMessages.Inc()
+		end := block.BlockNumber*block.BlockSize + inputMessage.Payload.Length()
+		if limits := sr.limits; limits.MaxBodySize > 0 && end > limits.MaxBodySize {
+			MetricRejectedTransfers.Inc()
+			ack := ackTo(origMessage, inputMessage, CoapCodeRequestEntityTooLarge)
+			ack.AddOption(OptionSize1, limits.MaxBodySize)
+			sr.sendToSocket(ack)
+			return nil, newError("receive", origMessage, sr.conn.RemoteAddr().String(), attempts, ErrBodyTooLarge)
 		}
-		block := inputMessage.GetBlock2()
-		if block == nil || inputMessage.Type != CON {
+		for _, ok := buf[contiguous]; ok; _, ok = buf[contiguous] {
+			contiguous++
+		}
+		if limits := sr.limits; limits.MaxGap > 0 && block.BlockNumber-contiguous > limits.MaxGap {
+			MetricDroppedBlocks.Inc()
 			continue
 		}
 
 		if !block.MoreBlocks {
 			totalBlocks = block.BlockNumber + 1
+			digest = inputMessage.GetOption(OptionPayloadDigest)
 		}
 
 		buf[block.BlockNumber] = inputMessage.Payload.Bytes()
@@ -640,6 +667,22 @@ func (sr *transport) receiveARQBlock2(origMessage *CoAPMessage, inputMessage *Co
 			for i := 0; i < totalBlocks; i++ {
 				b = append(b, buf[i]...)
 			}
+
+			// The server sends all blocks again
+			if !checkPayloadDigest(digest, b) {
+				if mismatches == MAX_DIGEST_RETRIES {
+					return nil, newError("receive", origMessage, sr.conn.RemoteAddr().String(), mismatches+1, ErrPayloadDigest)
+				}
+				mismatches++
+				ack := ackTo(origMessage, inputMessage, CoapCodeRequestEntityIncomplete)
+				ack.AddOption(OptionPayloadDigest, digest.StringValue())
+				buf, totalBlocks, digest, contiguous = make(map[int][]byte), -1, nil, 0
+				if err = sr.sendToSocket(ack); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
 			inputMessage.Payload = NewBytesPayload(b)
 			ack := ackTo(origMessage, inputMessage, CoapCodeEmpty)
 			if err = sr.sendToSocket(ack); err != nil {
@@ -651,7 +694,7 @@ func (sr *transport) receiveARQBlock2(origMessage *CoAPMessage, inputMessage *Co
 		var ack *CoAPMessage
 		w := inputMessage.GetOption(OptionSelectiveRepeatWindowSize)
 		if w != nil {
-			ack = ackToWithWindowOffset(origMessage, inputMessage, CoapCodeContinue, w.IntValue(), block.BlockNumber, buf)
+			ack = ackToWithSelectiveAck(origMessage, inputMessage, CoapCodeContinue, buf)
 		} else {
 			ack = ackTo(origMessage, inputMessage, CoapCodeContinue)
 		}
@@ -0,0 +1,178 @@
+package coalago
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Subprotocol of CoAP over WebSockets
+const WEBSOCKET_PROTOCOL = "coap"
+
+var (
+	ErrWebSocketProtocol = errors.New("websocket peer does not speak coap")
+	ErrInvalidFrame      = errors.New("invalid frame")
+)
+
+// WebSocketTransport carries messages over WebSockets with the framing of
+// RFC 8323. Servers mount it as the handler of a path of their net/http
+// server, clients connect to that path at the address of their requests,
+// over TLS when the transport has a config.
+type WebSocketTransport struct {
+	path   string
+	config *tls.Config
+
+	mx   sync.Mutex
+	conn *streamConn
+}
+
+func NewWebSocketTransport(path string, config *tls.Config) *WebSocketTransport {
+	return &WebSocketTransport{path: path, config: config}
+}
+
+// Listen returns the conn of the connections ServeHTTP accepts, addr is the
+// one of the HTTP server.
+func (t *WebSocketTransport) Listen(addr string) (PacketConn, error) {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newStreamConn(a, true)
+	t.mx.Lock()
+	t.conn = c
+	t.mx.Unlock()
+	return c, nil
+}
+
+// ServeHTTP upgrades requests for the coap subprotocol to WebSockets and
+// serves them until the peer releases the connection. Origins are not
+// checked: coaps:// authenticates the peers of browsers.
+func (t *WebSocketTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mx.Lock()
+	c := t.conn
+	t.mx.Unlock()
+	if c == nil {
+		http.Error(w, "CoAP server is not listening", http.StatusServiceUnavailable)
+		return
+	}
+
+	websocket.Server{
+		Handshake: acceptCoAPProtocol,
+		Handler: func(ws *websocket.Conn) {
+			addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+			if err != nil {
+				return
+			}
+			f := newWebSocketFramer(ws)
+			if c.add(f, addr) {
+				<-f.done
+			}
+		},
+	}.ServeHTTP(w, r)
+}
+
+func acceptCoAPProtocol(config *websocket.Config, r *http.Request) error {
+	for _, protocol := range config.Protocol {
+		if protocol == WEBSOCKET_PROTOCOL {
+			config.Protocol = []string{protocol}
+			return nil
+		}
+	}
+	return ErrWebSocketProtocol
+}
+
+func (t *WebSocketTransport) Dial(addr string) (PacketConn, error) {
+	dialed, err := t.Resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, origin := "ws://", "http://"
+	if t.config != nil {
+		scheme, origin = "wss://", "https://"
+	}
+	config, err := websocket.NewConfig(scheme+addr+t.path, origin+addr)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{WEBSOCKET_PROTOCOL}
+
+	dialer := &net.Dialer{Timeout: sumTimeAttempts}
+	var conn net.Conn
+	if t.config != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, t.config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := newStreamConn(conn.LocalAddr(), false)
+	c.dialed = dialed.String()
+	c.add(newWebSocketFramer(ws), conn.RemoteAddr())
+	return c, nil
+}
+
+func (t *WebSocketTransport) Resolve(addr string) (net.Addr, error) {
+	return net.ResolveTCPAddr("tcp", addr)
+}
+
+// webSocketFramer sends every frame in a binary message, without the length
+// the message already has.
+type webSocketFramer struct {
+	ws   *websocket.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newWebSocketFramer(ws *websocket.Conn) *webSocketFramer {
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = MAX_MESSAGE_SIZE + 2 + 8
+	return &webSocketFramer{ws: ws, done: make(chan struct{})}
+}
+
+func (f *webSocketFramer) ReadFrame() (byte, []byte, []byte, error) {
+	var data []byte
+	if err := websocket.Message.Receive(f.ws, &data); err != nil {
+		if errors.Is(err, websocket.ErrFrameTooLarge) {
+			return 0, nil, nil, ErrFrameTooLarge
+		}
+		return 0, nil, nil, err
+	}
+	return readWebSocketFrame(data)
+}
+
+// readWebSocketFrame splits the frame of a message, whose length nibble is 0.
+func readWebSocketFrame(data []byte) (code byte, token, rest []byte, err error) {
+	if len(data) < 2 || data[0]>>4 != 0 {
+		return 0, nil, nil, ErrInvalidFrame
+	}
+	tkl := int(data[0] & 0x0f)
+	if tkl > 8 || len(data) < 2+tkl {
+		return 0, nil, nil, ErrInvalidTokenLength
+	}
+	return data[1], data[2 : 2+tkl], data[2+tkl:], nil
+}
+
+func (f *webSocketFramer) WriteFrame(code byte, token, rest []byte) error {
+	message := make([]byte, 0, 2+len(token)+len(rest))
+	message = append(message, byte(len(token)), code)
+	message = append(message, token...)
+	return websocket.Message.Send(f.ws, append(message, rest...))
+}
+
+func (f *webSocketFramer) Close() error {
+	f.once.Do(func() { close(f.done) })
+	return f.ws.Close()
+}
@@ -0,0 +1,56 @@
+package coalago
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketTransport(t *testing.T) {
+	server := NewWebSocketTransport("/coap", nil)
+	mux := http.NewServeMux()
+	mux.Handle("/coap", server)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, mux)
+
+	addr := l.Addr().String()
+	testTransport(t, server, NewWebSocketTransport("/coap", nil), addr)
+
+	// Other subprotocols are refused by the handshake
+	config, err := websocket.NewConfig("ws://"+addr+"/coap", "http://"+addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{"chat"}
+	if ws, err := websocket.DialConfig(config); err == nil {
+		ws.Close()
+		t.Fatal("websocket without the coap subprotocol is accepted")
+	}
+}
+
+func TestWebSocketFramer(t *testing.T) {
+	for _, data := range [][]byte{nil, {0x10, byte(POST)}, {0x09, byte(POST), 1, 2}} {
+		code, token, rest, err := readWebSocketFrame(data)
+		if err == nil {
+			t.Fatalf("frame %x is accepted as %d %x %x", data, code, token, rest)
+		}
+	}
+
+	code, token, rest, err := readWebSocketFrame([]byte{0x02, byte(POST), 't', 'k', 0xff, 'x'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != byte(POST) || string(token) != "tk" || string(rest) != "\xffx" {
+		t.Fatalf("unexpected frame %d %x %x", code, token, rest)
+	}
+}
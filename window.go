@@ -0,0 +1,83 @@
+package coalago
+
+// WindowPolicy bounds the number of blocks a selective-repeat transfer keeps
+// in flight. The window starts at Initial, grows by one block per in-order
+// ACK up to the slow start threshold and by one block per window after it,
+// and is halved on every timeout, but never leaves [Min, Max].
+type WindowPolicy struct {
+	Initial int
+	Min     int
+	Max     int
+}
+
+var DefaultWindowPolicy = WindowPolicy{
+	Initial: 4,
+	Min:     1,
+	Max:     DEFAULT_WINDOW_SIZE,
+}
+
+// window is the AIMD congestion window of one transfer.
+type window struct {
+	policy   WindowPolicy
+	cwnd     float64
+	ssthresh float64
+	// Losses of blocks before it belong to a window that was already shrunk
+	recover int
+}
+
+func newWindow(policy WindowPolicy, numblocks int) *window {
+	if policy.Min < 1 {
+		policy.Min = 1
+	}
+	if policy.Max < policy.Min {
+		policy.Max = policy.Min
+	}
+	w := &window{policy: policy, ssthresh: float64(policy.Max)}
+	w.cwnd = w.bound(float64(policy.Initial))
+	if numblocks > 0 && w.cwnd > float64(numblocks) {
+		w.cwnd = float64(numblocks)
+	}
+	return w
+}
+
+func (w *window) bound(cwnd float64) float64 {
+	if cwnd < float64(w.policy.Min) {
+		return float64(w.policy.Min)
+	}
+	if cwnd > float64(w.policy.Max) {
+		return float64(w.policy.Max)
+	}
+	return cwnd
+}
+
+func (w *window) size() int {
+	return int(w.cwnd)
+}
+
+// ack grows the window when the block was acknowledged in order.
+func (w *window) ack(inOrder bool) {
+	if !inOrder {
+		return
+	}
+	if w.cwnd < w.ssthresh {
+		w.cwnd = w.bound(w.cwnd + 1)
+	} else {
+		w.cwnd = w.bound(w.cwnd + 1/w.cwnd)
+	}
+}
+
+// loss shrinks the window when the receiver reports a missing block,
+// once for all blocks that were in flight together.
+func (w *window) loss(block, highestSent int) {
+	if block < w.recover {
+		return
+	}
+	w.timeout()
+	w.recover = highestSent + 1
+}
+
+// timeout shrinks the window after blocks had to be retransmitted.
+func (w *window) timeout() {
+	w.ssthresh = w.bound(w.cwnd / 2)
+	w.cwnd = w.ssthresh
+}
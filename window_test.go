@@ -0,0 +1,73 @@
+package coalago
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWindowAIMD(t *testing.T) {
+	w := newWindow(WindowPolicy{Initial: 2, Min: 1, Max: 8}, 100)
+	if w.size() != 2 {
+		t.Fatalf("unexpected initial window %d", w.size())
+	}
+
+	for i := 0; i < 6; i++ {
+		w.ack(true)
+	}
+	if w.size() != 8 {
+		t.Fatalf("window is not bounded by max: %d", w.size())
+	}
+
+	w.ack(false)
+	w.timeout()
+	if w.size() != 4 {
+		t.Fatalf("window is not halved: %d", w.size())
+	}
+
+	// Past the threshold the window grows by one block per window
+	for i := 0; i < 5; i++ {
+		w.ack(true)
+	}
+	if w.size() != 5 {
+		t.Fatalf("unexpected congestion avoidance window %d", w.size())
+	}
+
+	for i := 0; i < 5; i++ {
+		w.timeout()
+	}
+	if w.size() != 1 {
+		t.Fatalf("window is not bounded by min: %d", w.size())
+	}
+
+	if w = newWindow(DefaultWindowPolicy, 2); w.size() != 2 {
+		t.Fatalf("window is larger than the transfer: %d", w.size())
+	}
+}
+
+func TestWindowTransfer(t *testing.T) {
+	body := bytes.Repeat([]byte("coala"), 20000)
+
+	srv := NewServer()
+	srv.SetWindowPolicy(WindowPolicy{Initial: 1, Min: 1, Max: 16})
+	srv.AddPOSTResource("/echo", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		return NewResponse(message.Payload, CoapCodeChanged)
+	})
+	go func() {
+		err := srv.Listen(":12323")
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	client := NewClient()
+	client.SetWindowPolicy(WindowPolicy{Initial: 2, Min: 1, Max: 32})
+	resp, err := client.POST(body, "coap://127.0.0.1:12323/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Body, body) {
+		t.Fatalf("unexpected body of %d bytes", len(resp.Body))
+	}
+}
@@ -0,0 +1,156 @@
+package coalago
+
+import (
+	"net"
+	"sync"
+)
+
+// WorkerPolicy bounds the goroutines a server runs for received messages.
+// Zero fields are not limited.
+type WorkerPolicy struct {
+	// Goroutines processing received messages
+	Workers int
+	// Messages waiting for a worker in total and from one host, further
+	// ones are refused with 5.03 Service Unavailable. Hosts are served in turn.
+	QueueSize     int
+	PeerQueueSize int
+	// Request handlers running at once, further requests are refused with 5.03
+	MaxHandlers int
+	// Seconds clients are asked to wait in Max-Age of the refusals
+	RetryAfter int
+}
+
+var DefaultWorkerPolicy = WorkerPolicy{
+	Workers:       64,
+	QueueSize:     4096,
+	PeerQueueSize: 256,
+	MaxHandlers:   256,
+	RetryAfter:    1,
+}
+
+// workerPool runs tasks on a fixed number of goroutines, taking them from
+// the queues of hosts in turn so that a flooding host delays only itself.
+type workerPool struct {
+	policy WorkerPolicy
+
+	mx      sync.Mutex
+	cond    *sync.Cond
+	queues  map[string][]func()
+	peers   []string
+	queued  int
+	stopped bool
+}
+
+func newWorkerPool(policy WorkerPolicy) *workerPool {
+	p := &workerPool{policy: policy, queues: make(map[string][]func())}
+	p.cond = sync.NewCond(&p.mx)
+	for i := 0; i < policy.Workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// submit queues the task of the host, it tells false when the queues are full.
+func (p *workerPool) submit(peer string, task func()) bool {
+	if p.policy.Workers <= 0 {
+		go task()
+		return true
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	queue := p.queues[peer]
+	if p.stopped || (p.policy.QueueSize > 0 && p.queued >= p.policy.QueueSize) ||
+		(p.policy.PeerQueueSize > 0 && len(queue) >= p.policy.PeerQueueSize) {
+		return false
+	}
+	if len(queue) == 0 {
+		p.peers = append(p.peers, peer)
+	}
+	p.queues[peer] = append(queue, task)
+	p.queued++
+	p.cond.Signal()
+	return true
+}
+
+// next returns the next task, or nil once the pool is stopped.
+func (p *workerPool) next() func() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for p.queued == 0 && !p.stopped {
+		p.cond.Wait()
+	}
+	if p.stopped {
+		return nil
+	}
+
+	peer := p.peers[0]
+	queue := p.queues[peer]
+	task := queue[0]
+	queue[0] = nil
+	if len(queue) == 1 {
+		delete(p.queues, peer)
+		p.peers = p.peers[1:]
+	} else {
+		p.queues[peer] = queue[1:]
+		p.peers = append(p.peers[1:], peer)
+	}
+	p.queued--
+	return task
+}
+
+func (p *workerPool) work() {
+	for task := p.next(); task != nil; task = p.next() {
+		task()
+	}
+}
+
+// stop ends the workers after their current tasks, queued ones are dropped.
+func (p *workerPool) stop() {
+	p.mx.Lock()
+	p.stopped = true
+	p.queues = make(map[string][]func())
+	p.peers = nil
+	p.queued = 0
+	p.mx.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *workerPool) isStopped() bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.stopped
+}
+
+// goHandler runs the request handler unless MaxHandlers of them are running,
+// then the request is refused.
+func (sr *transport) goHandler(message *CoAPMessage, handler func()) {
+	if sr.handlers == nil {
+		go handler()
+		return
+	}
+
+	select {
+	case sr.handlers <- struct{}{}:
+		go func() {
+			defer func() { <-sr.handlers }()
+			handler()
+		}()
+	default:
+		sr.sendOverloaded(message, message.Sender)
+	}
+}
+
+// sendOverloaded refuses a confirmable message with 5.03 Service Unavailable,
+// Max-Age tells when to try again.
+func (sr *transport) sendOverloaded(message *CoAPMessage, addr net.Addr) {
+	MetricOverloadedMessages.Inc()
+	if message.Type != CON {
+		return
+	}
+	ack := ackTo(nil, message, CoapCodeServiceUnavailable)
+	ack.AddOption(OptionMaxAge, sr.workers.RetryAfter)
+	sr.sendToSocketByAddress(ack, addr)
+}
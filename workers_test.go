@@ -0,0 +1,139 @@
+package coalago
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolFairness(t *testing.T) {
+	p := newWorkerPool(WorkerPolicy{Workers: 1, QueueSize: 5, PeerQueueSize: 3})
+
+	// The only worker waits until the queues are filled
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if !p.submit("a", func() { close(started); <-release }) {
+		t.Fatal("task is refused")
+	}
+	<-started
+
+	done := make(chan string, 5)
+	task := func(name string) func() {
+		return func() { done <- name }
+	}
+	for i := 0; i < 3; i++ {
+		if !p.submit("a", task("a")) {
+			t.Fatal("task within the peer queue is refused")
+		}
+	}
+	if p.submit("a", task("a")) {
+		t.Fatal("task over the peer queue is accepted")
+	}
+	if !p.submit("b", task("b")) || !p.submit("b", task("b")) {
+		t.Fatal("task of another peer is refused")
+	}
+	if p.submit("c", task("c")) {
+		t.Fatal("task over the queue is accepted")
+	}
+
+	close(release)
+	var order string
+	for i := 0; i < 5; i++ {
+		select {
+		case name := <-done:
+			order += name
+		case <-time.After(time.Second):
+			t.Fatal("tasks are not run")
+		}
+	}
+	if order != "ababa" {
+		t.Fatalf("peers are served in order %s", order)
+	}
+}
+
+func TestWorkerPolicyHandlers(t *testing.T) {
+	srv := NewServer()
+	srv.SetWorkerPolicy(WorkerPolicy{Workers: 4, MaxHandlers: 1, RetryAfter: 5})
+
+	running := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv.AddGETResource("/slow", func(message *CoAPMessage) *CoAPResourceHandlerResult {
+		running <- struct{}{}
+		<-release
+		return NewResponse(NewStringPayload("done"), CoapCodeContent)
+	})
+	addr := listenServer(t, srv, "127.0.0.1:0")
+	client := NewClient()
+
+	first := make(chan *Response, 1)
+	go func() {
+		resp, err := client.GET("coap://" + addr + "/slow")
+		if err != nil {
+			t.Error(err)
+		}
+		first <- resp
+	}()
+	<-running
+
+	resp, err := client.GET("coap://" + addr + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if resp.Code != CoapCodeServiceUnavailable {
+		t.Fatalf("unexpected response %v", resp.Code)
+	}
+
+	if resp = <-first; resp == nil || resp.Code != CoapCodeContent {
+		t.Fatal("running handler is not answered")
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	srv := NewServer()
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Serve(conn)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The workers of both conns are gone
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines+DefaultWorkerPolicy.Workers/2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are left of %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	listened := make(chan error)
+	go func() { listened <- srv.Listen("127.0.0.1:0") }()
+	for {
+		srv.mx.Lock()
+		started := srv.pool != nil
+		srv.mx.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-listened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Listen does not return after Close")
+	}
+}